@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
+	dcbridge "github.com/deltachat/deltaircd/bridge/deltachat"
+	"github.com/deltachat/deltaircd/config"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"golang.org/x/term"
+)
+
+const accountUsage = `usage: deltaircd account [--conf deltaircd.toml] <command>
+
+Manage the Delta Chat accounts in the configured accounts folder. deltaircd
+must not be running, the accounts folder can only be used by one process.
+
+commands:
+  list                         list the accounts
+  add <email>                  add and configure an account, the password is
+                               read from $DELTAIRCD_PASSWORD or prompted for
+  import-backup <file>         add an account from a backup file
+  export-backup <id> <dir>     write a backup of an account to a folder
+  remove <id>                  remove an account and all its data
+  info <id>                    show information about an account
+
+Backups use the passphrase from $DELTAIRCD_PASSPHRASE if it is set.
+`
+
+// accountCommand runs the "account" subcommand and returns the exit code.
+func accountCommand(args []string) int {
+	flags := pflag.NewFlagSet("account", pflag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, accountUsage) }
+	cfgfile := flags.String("conf", "deltaircd.toml", "config file")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	cfg := viper.New()
+	if _, err := os.Stat(*cfgfile); err == nil {
+		if cfg, err = config.LoadConfig(*cfgfile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	commands := map[string]struct {
+		args int
+		run  func(manager *deltachat.AccountManager, args []string) error
+	}{
+		"list":          {0, accountList},
+		"add":           {1, accountAdd},
+		"import-backup": {1, accountImportBackup},
+		"export-backup": {2, accountExportBackup},
+		"remove":        {1, accountRemove},
+		"info":          {1, accountInfo},
+	}
+	cmd, ok := commands[args[0]]
+	if !ok || len(args)-1 != cmd.args {
+		flags.Usage()
+		return 2
+	}
+
+	dir, err := dcbridge.AccountsDir(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	rpc := deltachat.NewRpcIO()
+	rpc.AccountsDir = dir
+	if err := rpc.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "could not open the accounts in %q (deltaircd must not be running): %v\n", dir, err)
+		return 1
+	}
+	defer rpc.Stop()
+
+	if err := cmd.run(&deltachat.AccountManager{rpc}, args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "account %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func findAccount(manager *deltachat.AccountManager, id string) (*deltachat.Account, error) {
+	accountID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid account id %q", id)
+	}
+	accounts, err := manager.Accounts()
+	if err != nil {
+		return nil, err
+	}
+	for _, acc := range accounts {
+		if uint64(acc.Id) == accountID {
+			return acc, nil
+		}
+	}
+	return nil, fmt.Errorf("no account with id %s", id)
+}
+
+func accountAddress(acc *deltachat.Account) string {
+	if addr, _ := acc.GetConfig("configured_addr"); addr != "" {
+		return addr
+	}
+	addr, _ := acc.GetConfig("addr")
+	return addr
+}
+
+func accountList(manager *deltachat.AccountManager, args []string) error {
+	accounts, err := manager.Accounts()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADDRESS\tCONFIGURED\tSIZE")
+	for _, acc := range accounts {
+		configured, _ := acc.IsConfigured()
+		size, _ := acc.Size()
+		fmt.Fprintf(w, "%d\t%s\t%t\t%.1f MB\n", acc.Id, accountAddress(acc), configured, float64(size)/1e6)
+	}
+	return w.Flush()
+}
+
+// readPassword returns the password from $DELTAIRCD_PASSWORD, prompts for it
+// on a terminal or reads a line from stdin.
+func readPassword() (string, error) {
+	if password := os.Getenv("DELTAIRCD_PASSWORD"); password != "" {
+		return password, nil
+	}
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, "password: ")
+		password, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("no password given")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func accountAdd(manager *deltachat.AccountManager, args []string) error {
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	acc, err := manager.AddAccount()
+	if err != nil {
+		return err
+	}
+	err = acc.UpdateConfig(map[string]string{"addr": args[0], "mail_pw": password})
+	if err == nil {
+		err = acc.Configure()
+	}
+	if err != nil {
+		acc.Remove() //nolint:errcheck
+		return err
+	}
+	fmt.Printf("added account %d for %s\n", acc.Id, args[0])
+	return nil
+}
+
+func accountImportBackup(manager *deltachat.AccountManager, args []string) error {
+	acc, err := manager.AddAccount()
+	if err != nil {
+		return err
+	}
+	if err := acc.ImportBackup(args[0], os.Getenv("DELTAIRCD_PASSPHRASE")); err != nil {
+		acc.Remove() //nolint:errcheck
+		return err
+	}
+	fmt.Printf("imported account %d for %s\n", acc.Id, accountAddress(acc))
+	return nil
+}
+
+func accountExportBackup(manager *deltachat.AccountManager, args []string) error {
+	acc, err := findAccount(manager, args[0])
+	if err != nil {
+		return err
+	}
+	if err := acc.ExportBackup(args[1], os.Getenv("DELTAIRCD_PASSPHRASE")); err != nil {
+		return err
+	}
+	fmt.Printf("exported account %d to %s\n", acc.Id, args[1])
+	return nil
+}
+
+func accountRemove(manager *deltachat.AccountManager, args []string) error {
+	acc, err := findAccount(manager, args[0])
+	if err != nil {
+		return err
+	}
+	addr := accountAddress(acc)
+	if err := acc.Remove(); err != nil {
+		return err
+	}
+	fmt.Printf("removed account %d (%s)\n", acc.Id, addr)
+	return nil
+}
+
+func accountInfo(manager *deltachat.AccountManager, args []string) error {
+	acc, err := findAccount(manager, args[0])
+	if err != nil {
+		return err
+	}
+	info, err := acc.Info()
+	if err != nil {
+		return err
+	}
+	configured, _ := acc.IsConfigured()
+	info["address"] = accountAddress(acc)
+	info["configured"] = strconv.FormatBool(configured)
+
+	keys := make([]string, 0, len(info))
+	for key := range info {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%s\n", key, info[key])
+	}
+	return w.Flush()
+}
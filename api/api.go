@@ -0,0 +1,359 @@
+// Package api is the local admin HTTP API of deltaircd. It answers with JSON
+// and every request needs the APIToken as bearer token.
+//
+//	GET  /api/sessions                                   connected IRC clients
+//	POST /api/sessions/<id>/logout                       log a session out
+//	GET  /api/accounts                                   logged in accounts
+//	GET  /api/accounts/<address>/chats                   chats of an account
+//	GET  /api/accounts/<address>/chats/<chat>/messages   last messages, ?limit=20
+//	POST /api/accounts/<address>/chats/<chat>/messages   send {"text": "", "reply_to": ""}
+//	POST /api/reload                                     reload the config file
+//
+// A chat is its ID or its channel name without "#".
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
+	"github.com/deltachat/deltaircd/bridge"
+	"github.com/deltachat/deltaircd/config"
+	irckit "github.com/deltachat/deltaircd/mm-go-irckit"
+	"github.com/sirupsen/logrus"
+)
+
+var Logger *logrus.Entry
+
+const (
+	defaultLimit = 20
+	maxLimit     = 500
+)
+
+type handler struct {
+	cfg *config.Config
+}
+
+// NewHandler returns the API handler, the token is read from the config for
+// every request so reloads apply.
+func NewHandler(cfg *config.Config) http.Handler {
+	return &handler{cfg: cfg}
+}
+
+// httpError is an error with the status code of the response.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func errorf(status int, format string, args ...interface{}) error {
+	return &httpError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+func (h *handler) authorized(r *http.Request) bool {
+	token := h.cfg.Viper().GetString("apitoken")
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var result interface{}
+	var err error
+	if h.authorized(r) {
+		result, err = h.route(r)
+	} else {
+		err = errorf(http.StatusUnauthorized, "invalid token")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		status := http.StatusInternalServerError
+		var herr *httpError
+		if errors.As(err, &herr) {
+			status = herr.status
+		}
+		if status == http.StatusInternalServerError {
+			Logger.Errorf("api: %s %s: %v", r.Method, r.URL.Path, err)
+		}
+		w.WriteHeader(status)
+		result = map[string]string{"error": err.Error()}
+	}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		Logger.Debugf("api: writing the response failed: %v", err)
+	}
+}
+
+func (h *handler) route(r *http.Request) (interface{}, error) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(path) < 2 || path[0] != "api" {
+		return nil, errorf(http.StatusNotFound, "not found")
+	}
+	path = path[1:]
+
+	method := func(m string) error {
+		if r.Method != m {
+			return errorf(http.StatusMethodNotAllowed, "use %s", m)
+		}
+		return nil
+	}
+
+	switch {
+	case len(path) == 1 && path[0] == "sessions":
+		if err := method(http.MethodGet); err != nil {
+			return nil, err
+		}
+		return listSessions(), nil
+	case len(path) == 3 && path[0] == "sessions" && path[2] == "logout":
+		if err := method(http.MethodPost); err != nil {
+			return nil, err
+		}
+		return logoutSession(path[1])
+	case len(path) == 1 && path[0] == "accounts":
+		if err := method(http.MethodGet); err != nil {
+			return nil, err
+		}
+		return listAccounts(), nil
+	case len(path) == 3 && path[0] == "accounts" && path[2] == "chats":
+		if err := method(http.MethodGet); err != nil {
+			return nil, err
+		}
+		br, err := findAccount(path[1])
+		if err != nil {
+			return nil, err
+		}
+		return listChats(br), nil
+	case len(path) == 5 && path[0] == "accounts" && path[2] == "chats" && path[4] == "messages":
+		br, err := findAccount(path[1])
+		if err != nil {
+			return nil, err
+		}
+		channelID, err := findChat(br, path[3])
+		if err != nil {
+			return nil, err
+		}
+		switch r.Method {
+		case http.MethodGet:
+			return listMessages(br, channelID, r.URL.Query().Get("limit"))
+		case http.MethodPost:
+			return sendMessage(br, channelID, r)
+		}
+		return nil, errorf(http.StatusMethodNotAllowed, "use GET or POST")
+	case len(path) == 1 && path[0] == "reload":
+		if err := method(http.MethodPost); err != nil {
+			return nil, err
+		}
+		if irckit.ReloadConfig == nil {
+			return nil, errorf(http.StatusConflict, "no config file to reload")
+		}
+		if err := irckit.ReloadConfig(); err != nil {
+			return nil, errorf(http.StatusUnprocessableEntity, "%v", err)
+		}
+		return map[string]bool{"ok": true}, nil
+	}
+	return nil, errorf(http.StatusNotFound, "not found")
+}
+
+type session struct {
+	ID          int       `json:"id"`
+	Nick        string    `json:"nick"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Account     string    `json:"account,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+func listSessions() []session {
+	sessions := []session{}
+	for _, u := range irckit.Sessions() {
+		s := session{
+			ID:          u.SessionID(),
+			Nick:        u.Nick,
+			Account:     u.Account(),
+			ConnectedAt: u.ConnectedAt(),
+		}
+		if addr := u.RemoteAddr(); addr != nil {
+			s.RemoteAddr = addr.String()
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func logoutSession(id string) (interface{}, error) {
+	for _, u := range irckit.Sessions() {
+		if strconv.Itoa(u.SessionID()) != id {
+			continue
+		}
+		if u.Bridge() == nil {
+			return nil, errorf(http.StatusConflict, "session %s is not logged in", id)
+		}
+		Logger.Infof("api: logging out session %s (%s)", id, u.Nick)
+		if err := u.Logout(); err != nil {
+			return nil, err
+		}
+		return map[string]bool{"ok": true}, nil
+	}
+	return nil, errorf(http.StatusNotFound, "no session %s", id)
+}
+
+type account struct {
+	Address      string `json:"address"`
+	Sessions     []int  `json:"sessions"`
+	Connectivity string `json:"connectivity"`
+}
+
+func listAccounts() []*account {
+	accounts := []*account{}
+	byAddress := make(map[string]*account)
+	for _, u := range irckit.Sessions() {
+		address := u.Account()
+		if address == "" {
+			continue
+		}
+		acc, ok := byAddress[address]
+		if !ok {
+			acc = &account{Address: address}
+			if connectivity, err := u.Bridge().Connectivity(); err == nil {
+				acc.Connectivity = connectivity
+			}
+			byAddress[address] = acc
+			accounts = append(accounts, acc)
+		}
+		acc.Sessions = append(acc.Sessions, u.SessionID())
+	}
+	return accounts
+}
+
+// findAccount returns the bridge of the first session logged in to the
+// account.
+func findAccount(address string) (bridge.Bridger, error) {
+	for _, u := range irckit.Sessions() {
+		if address != "" && strings.EqualFold(u.Account(), address) {
+			return u.Bridge(), nil
+		}
+	}
+	return nil, errorf(http.StatusNotFound, "no session is logged in to %s", address)
+}
+
+func findChat(br bridge.Bridger, chat string) (string, error) {
+	channelID := chat
+	if _, err := strconv.ParseUint(chat, 10, 32); err != nil {
+		channelID = br.GetChannelID(strings.TrimPrefix(chat, "#"), br.GetMe().TeamID)
+	}
+	if _, err := br.GetChannel(channelID); err != nil {
+		return "", errorf(http.StatusNotFound, "no chat %s", chat)
+	}
+	return channelID, nil
+}
+
+type chat struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	DM       bool   `json:"dm"`
+	ReadOnly bool   `json:"read_only"`
+	Muted    bool   `json:"muted"`
+	Archived bool   `json:"archived"`
+}
+
+func listChats(br bridge.Bridger) []chat {
+	chats := []chat{}
+	for _, info := range br.GetChannels() {
+		chats = append(chats, chat{
+			ID:       info.ID,
+			Name:     br.GetChannelName(info.ID),
+			DM:       info.DM,
+			ReadOnly: info.ReadOnly,
+			Muted:    info.Muted,
+			Archived: info.Archived,
+		})
+	}
+	return chats
+}
+
+type message struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	From    string    `json:"from"`
+	Nick    string    `json:"nick"`
+	Text    string    `json:"text"`
+	File    string    `json:"file,omitempty"`
+	ReplyTo string    `json:"reply_to,omitempty"`
+	Info    bool      `json:"info,omitempty"`
+}
+
+func listMessages(br bridge.Bridger, channelID, limitParam string) (interface{}, error) {
+	limit := defaultLimit
+	if limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 1 || limit > maxLimit {
+			return nil, errorf(http.StatusBadRequest, "limit must be between 1 and %d", maxLimit)
+		}
+	}
+
+	messages := []message{}
+	posts, _ := br.GetPosts(channelID, limit).([]*deltachat.Message)
+	for _, post := range posts {
+		msgData, err := post.Snapshot()
+		if err != nil {
+			continue
+		}
+		msg := message{
+			ID:   strconv.FormatUint(uint64(msgData.Id), 10),
+			Time: msgData.Timestamp.Time,
+			Text: msgData.Text,
+			File: msgData.File,
+			Info: msgData.IsInfo,
+		}
+		if msgData.Sender != nil {
+			msg.From = msgData.Sender.Address
+			if user := br.GetUser(msgData.Sender); user != nil {
+				msg.Nick = user.Nick
+			}
+		}
+		if msgData.Quote != nil && msgData.Quote.MessageId != 0 {
+			msg.ReplyTo = strconv.FormatUint(uint64(msgData.Quote.MessageId), 10)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+type sendRequest struct {
+	Text    string `json:"text"`
+	ReplyTo string `json:"reply_to"`
+}
+
+func sendMessage(br bridge.Bridger, channelID string, r *http.Request) (interface{}, error) {
+	var req sendRequest
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20)).Decode(&req); err != nil {
+		return nil, errorf(http.StatusBadRequest, "invalid request: %v", err)
+	}
+	if req.Text == "" {
+		return nil, errorf(http.StatusBadRequest, "text is empty")
+	}
+
+	var msgID string
+	var err error
+	if req.ReplyTo != "" {
+		msgID, err = br.MsgChannelThread(channelID, req.ReplyTo, req.Text)
+	} else {
+		msgID, err = br.MsgChannel(channelID, req.Text)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"id": msgID}, nil
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/deltachat/deltaircd/config"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	Logger = logrus.NewEntry(logrus.New())
+	v := viper.New()
+	v.Set("apitoken", "secret")
+	h := NewHandler(config.NewConfig(v))
+
+	tests := []struct {
+		method, path, token string
+		status              int
+		body                string
+	}{
+		{"GET", "/api/sessions", "", http.StatusUnauthorized, `{"error":"invalid token"}`},
+		{"GET", "/api/sessions", "wrong", http.StatusUnauthorized, `{"error":"invalid token"}`},
+		{"GET", "/api/sessions", "secret", http.StatusOK, `[]`},
+		{"POST", "/api/sessions", "secret", http.StatusMethodNotAllowed, `{"error":"use GET"}`},
+		{"GET", "/api/accounts", "secret", http.StatusOK, `[]`},
+		{"GET", "/api/accounts/alice@example.org/chats", "secret", http.StatusNotFound, `{"error":"no session is logged in to alice@example.org"}`},
+		{"POST", "/api/sessions/1/logout", "secret", http.StatusNotFound, `{"error":"no session 1"}`},
+		{"POST", "/api/reload", "secret", http.StatusConflict, `{"error":"no config file to reload"}`},
+		{"GET", "/metrics", "secret", http.StatusNotFound, `{"error":"not found"}`},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, tt.status, rec.Code, "%s %s", tt.method, tt.path)
+		assert.JSONEq(t, tt.body, rec.Body.String(), "%s %s", tt.method, tt.path)
+	}
+
+	// without a token in the config every request is refused
+	v.Set("apitoken", "")
+	req := httptest.NewRequest("GET", "/api/sessions", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
@@ -10,6 +10,11 @@ type Bridger interface {
 	List() (map[string]string, error)
 	Part(channel string) error
 	SetTopic(channelID, text string) error
+	SetChannelMuted(channelID string, muted bool) error
+	SetChannelPinned(channelID string, pinned bool) error
+	SetChannelArchived(channelID string, archived bool) error
+	SetChannelEphemeralTimer(channelID string, seconds uint) error
+	SetChannelAlias(channelID, alias string) error
 	Topic(channelID string) string
 	Kick(channelID, username string) error
 	Nick(name string) error
@@ -17,11 +22,15 @@ type Bridger interface {
 	UpdateChannels() error
 	Logout() error
 	Connected() bool
+	// Connectivity returns "not connected", "connecting", "working" or
+	// "connected".
+	Connectivity() (string, error)
 
 	MsgUser(userID, text string) (string, error)
 	MsgUserThread(userID, parentID, text string) (string, error)
 	MsgChannel(channelID, text string) (string, error)
 	MsgChannelThread(channelID, parentID, text string) (string, error)
+	MsgChannelLocation(channelID string, latitude, longitude float64) (string, error)
 
 	AddReaction(msgID, emoji string) error
 	RemoveReaction(msgID, emoji string) error
@@ -31,6 +40,13 @@ type Bridger interface {
 	SetStatus(status string) error
 
 	Protocol() string
+	// AccountID returns the ID of the account, it doesn't identify the user
+	// outside of this server.
+	AccountID() string
+
+	// GetSettings returns the settings of the user stored with the account.
+	GetSettings() (map[string]string, error)
+	SaveSettings(settings map[string]string) error
 
 	GetChannels() []*ChannelInfo
 	GetChannel(channelID string) (*ChannelInfo, error)
@@ -43,23 +59,38 @@ type Bridger interface {
 	GetUser(userID interface{}) *UserInfo
 	GetMe() *UserInfo
 	GetUserByUsername(username string) *UserInfo
+	GetUserDetails(userID string) (*UserDetails, error)
 	SearchUsers(query string) ([]*UserInfo, error)
 
 	GetTeamName(teamID string) string
 
 	GetPostsSince(channelID string, since int64) interface{}
 	GetPosts(channelID string, limit int) interface{}
-	SearchPosts(search string) interface{}
+	SearchPosts(channelID, search string) interface{}
+	GetPostHTML(msgID string) (string, error)
+	// DeletedMessages returns the messages of msgIDs that no longer exist in
+	// the channel.
+	DeletedMessages(channelID string, msgIDs []string) ([]string, error)
 	ModifyPost(msgID, text string) error
+	SendWebxdcUpdate(msgID, update string) error
 	GetFileLinks(fileIDs []string) []string
 }
 
 type ChannelInfo struct {
-	Name    string
-	ID      string
-	TeamID  string
-	DM      bool
-	Private bool
+	Name        string
+	ID          string
+	TeamID      string
+	DM          bool
+	Private     bool
+	ReadOnly    bool // messages can't be sent to the channel
+	MailingList bool
+	Broadcast   bool
+
+	Muted          bool
+	Pinned         bool
+	Archived       bool
+	Protected      bool
+	EphemeralTimer uint // in seconds, 0 if disabled
 }
 
 type UserInfo struct {
@@ -79,6 +110,20 @@ type UserInfo struct {
 	MentionKeys []string
 }
 
+// UserDetails is the information about a user shown in WHOIS.
+type UserDetails struct {
+	Address     string
+	DisplayName string
+	Status      string    // the status text (signature) of the user
+	Online      bool      // the user was seen recently
+	LastSeen    time.Time // zero if never seen
+	Verified    bool
+	VerifiedBy  string
+	Encryption  string // e.g. "End-to-end encryption preferred."
+	Fingerprint string
+	ChannelIDs  []string // groups shared with the user
+}
+
 type Credentials struct {
 	Login    string
 	Team     string
@@ -86,6 +131,7 @@ type Credentials struct {
 	Server   string
 	Token    string
 	MFAToken string
+	CertFP   string // the account must have this client certificate registered
 }
 
 type Event struct {
@@ -113,6 +159,18 @@ type ChannelDeleteEvent struct {
 	ChannelID string
 }
 
+// ChannelRenameEvent is sent when the channel name of a chat changed, e.g.
+// after setting an alias.
+type ChannelRenameEvent struct {
+	ChannelID string
+	Name      string
+}
+
+// MessageRef in the text of a ChannelMessageEvent or DirectMessageEvent is
+// replaced by the context ID of the message, so service commands can refer to
+// it.
+const MessageRef = "\x00msgref\x00"
+
 type ChannelMessageEvent struct {
 	Text        string
 	ChannelID   string
@@ -125,6 +183,20 @@ type ChannelMessageEvent struct {
 	ParentID    string
 }
 
+// ChannelModeEvent is sent when the properties of a channel may have changed,
+// Info contains the current state.
+type ChannelModeEvent struct {
+	ChannelID string
+	Info      *ChannelInfo
+}
+
+// MessagesDeletedEvent is sent when messages of a chat may have been deleted,
+// e.g. because their ephemeral timer expired. UserID is set for direct chats.
+type MessagesDeletedEvent struct {
+	ChannelID string
+	UserID    string
+}
+
 type ChannelTopicEvent struct {
 	Text      string
 	ChannelID string
@@ -2,14 +2,17 @@
 package deltachat
 
 import (
+	"encoding/json"
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
-	"fmt"
 
 	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
 	"github.com/enescakir/emoji"
 	"github.com/deltachat/deltaircd/bridge"
+	"github.com/deltachat/deltaircd/metrics"
 )
 
 func (self *DeltaChat) GetMe() *bridge.UserInfo {
@@ -21,30 +24,97 @@ func (self *DeltaChat) Connected() bool {
 	return self.connected
 }
 
-func (self *DeltaChat) Logout() error {
-	err := self.account.StopIO()
+func (self *DeltaChat) AccountID() string {
+	return strconv.FormatUint(uint64(self.account.Id), 10)
+}
+
+func (self *DeltaChat) Connectivity() (string, error) {
+	connectivity, err := self.account.Connectivity()
 	if err != nil {
-		logger.Error("logout failed", err)
-		return err
+		return "", err
 	}
-	logger.Info("logout succeeded")
-
-	self.eventChan <- &bridge.Event{
-		Type: "logout",
-		Data: &bridge.LogoutEvent{},
+	// see dc_get_connectivity() of the core
+	switch {
+	case connectivity >= 4000:
+		return "connected", nil
+	case connectivity >= 3000:
+		return "working", nil
+	case connectivity >= 2000:
+		return "connecting", nil
+	default:
+		return "not connected", nil
 	}
+}
 
-	self.connected = false
-	return nil
+// Logout stops the account, only the first call does, e.g. QUIT and the API
+// may both log out a session.
+func (self *DeltaChat) Logout() error {
+	var err error
+	self.logoutOnce.Do(func() {
+		close(self.stopPoll)
+		if err = self.account.StopIO(); err != nil {
+			logger.Error("logout failed", err)
+		} else {
+			logger.Info("logout succeeded")
+		}
+
+		self.eventChan <- &bridge.Event{
+			Type: "logout",
+			Data: &bridge.LogoutEvent{},
+		}
+		self.connected = false
+	})
+	return err
 }
 
 func (self *DeltaChat) Protocol() string {
 	return "deltachat"
 }
 
+// settingsKey is the UI config key of the IRC settings of the user.
+const settingsKey = "deltaircd.settings"
+
+func (self *DeltaChat) GetSettings() (map[string]string, error) {
+	value, err := self.account.GetUiConfig(settingsKey)
+	if err != nil || value == "" {
+		return nil, err
+	}
+	var settings map[string]string
+	if err := json.Unmarshal([]byte(value), &settings); err != nil {
+		return nil, fmt.Errorf("invalid settings: %w", err)
+	}
+	return settings, nil
+}
+
+func (self *DeltaChat) SaveSettings(settings map[string]string) error {
+	value, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return self.account.SetUiConfig(settingsKey, string(value))
+}
+
+// certFPRegistered returns whether the client certificate was registered
+// with the certfp command, the fingerprints are stored with the settings.
+func (self *DeltaChat) certFPRegistered(fp string) bool {
+	settings, err := self.GetSettings()
+	if err != nil {
+		logger.Errorf("failed to load settings: %v", err)
+		return false
+	}
+	for _, registered := range strings.Fields(settings["certfp"]) {
+		if strings.EqualFold(registered, fp) {
+			return true
+		}
+	}
+	return false
+}
+
 func (self *DeltaChat) GetChannels() []*bridge.ChannelInfo {
 	var channels []*bridge.ChannelInfo
 	chatlistItems, _ := self.account.ChatListItems()
+	archived, _ := self.account.QueryChatListItems("", nil, uint(deltachat.ChatListFlagArchivedOnly))
+	chatlistItems = append(chatlistItems, archived...)
 	logger.Debugf("Chatlist has %v items", len(chatlistItems))
 	count := 0
 	for _, item := range chatlistItems {
@@ -52,7 +122,14 @@ func (self *DeltaChat) GetChannels() []*bridge.ChannelInfo {
 		if item.Error != "" || !item.IsSelfInGroup || isDM {
 			continue
 		}
-		channel := self.createChannelInfo(item.Id, isDM, item.Name)
+		chat := deltachat.Chat{self.account, item.Id}
+		snapshot, err := chat.FullSnapshot()
+		if err != nil {
+			logger.Errorf("failed to get chat %v: %v", item.Id, err)
+			continue
+		}
+		channel := self.createChannelInfo(snapshot)
+		channel.Pinned = item.IsPinned
 		channels = append(channels, channel)
 		count++
 	}
@@ -65,12 +142,13 @@ func (self *DeltaChat) GetChannel(channelID string) (*bridge.ChannelInfo, error)
 		return nil, err
 	}
 	chat := deltachat.Chat{self.account, deltachat.ChatId(id)}
-	snapshot, err := chat.BasicSnapshot()
+	snapshot, err := chat.FullSnapshot()
 	if err != nil {
 		return nil, err
 	}
-	isDM := snapshot.ChatType == deltachat.ChatSingle
-	return self.createChannelInfo(chat.Id, isDM, snapshot.Name), nil
+	channel := self.createChannelInfo(snapshot)
+	channel.Pinned = self.isPinned(chat.Id)
+	return channel, nil
 }
 
 func (self *DeltaChat) GetChannelName(channelID string) string {
@@ -83,7 +161,7 @@ func (self *DeltaChat) GetChannelName(channelID string) string {
 	if err != nil {
 		return channelID
 	}
-	return getChanName(chat.Id, snapshot.Name)
+	return self.chanName(chat.Id, snapshot.Name)
 }
 
 func (self *DeltaChat) GetChannelUsers(channelID string) ([]*bridge.UserInfo, error) {
@@ -114,15 +192,14 @@ func (self *DeltaChat) List() (map[string]string, error) {
 		if item.Error != "" || item.DmChatContact != 0 {
 			continue
 		}
-		channelInfo[getChanName(item.Id, item.Name)] = ":" + item.Name
+		channelInfo[self.chanName(item.Id, item.Name)] = ":" + item.Name
 	}
 
 	return channelInfo, nil
 }
 
 func (self *DeltaChat) Join(channelName string) (string, string, error) {
-	parts := strings.Split(channelName, "|")
-	channelID := strings.TrimSpace(parts[len(parts)-1])
+	channelID := self.GetChannelID(channelName, "")
 	id, err := strconv.ParseUint(channelID, 10, 0)
 	if err != nil {
 		return "", "", err
@@ -141,11 +218,11 @@ func (self *DeltaChat) Topic(channelID string) string {
 		return ""
 	}
 	chat := deltachat.Chat{self.account, deltachat.ChatId(id)}
-	snapshot, err := chat.BasicSnapshot()
+	snapshot, err := chat.FullSnapshot()
 	if err != nil {
 		return ""
 	}
-	return snapshot.Name
+	return snapshot.Name + chatTopicSuffix(snapshot)
 }
 
 func (self *DeltaChat) SetTopic(channelID, text string) error {
@@ -154,9 +231,53 @@ func (self *DeltaChat) SetTopic(channelID, text string) error {
 		return err
 	}
 	chat := deltachat.Chat{self.account, deltachat.ChatId(id)}
+	if snapshot, err := chat.FullSnapshot(); err == nil {
+		text = strings.TrimSuffix(text, chatTopicSuffix(snapshot))
+	}
 	return chat.SetName(text)
 }
 
+func (self *DeltaChat) SetChannelMuted(channelID string, muted bool) error {
+	chat, err := self.getChat(channelID)
+	if err != nil {
+		return err
+	}
+	if muted {
+		return chat.SetMuteDuration(-1)
+	}
+	return chat.SetMuteDuration(0)
+}
+
+func (self *DeltaChat) SetChannelPinned(channelID string, pinned bool) error {
+	chat, err := self.getChat(channelID)
+	if err != nil {
+		return err
+	}
+	if pinned {
+		return chat.Pin()
+	}
+	return chat.Unpin()
+}
+
+func (self *DeltaChat) SetChannelArchived(channelID string, archived bool) error {
+	chat, err := self.getChat(channelID)
+	if err != nil {
+		return err
+	}
+	if archived {
+		return chat.Archive()
+	}
+	return chat.Unarchive()
+}
+
+func (self *DeltaChat) SetChannelEphemeralTimer(channelID string, seconds uint) error {
+	chat, err := self.getChat(channelID)
+	if err != nil {
+		return err
+	}
+	return chat.SetEphemeralTimer(seconds)
+}
+
 func (self *DeltaChat) GetUsers() []*bridge.UserInfo {
 	contacts, _ := self.account.Contacts()
 	users := make([]*bridge.UserInfo, len(contacts))
@@ -180,7 +301,7 @@ func (self *DeltaChat) MsgChannelThread(channelID, parentID, text string) (strin
 	if err != nil {
 		return "", err
 	}
-	msgData := deltachat.MsgData{Text: text}
+	msgData := deltachat.MsgData{Text: self.translateMentions(text)}
 	quoteId, err := strconv.ParseUint(parentID, 10, 0)
 	if err == nil {
 		msgData.QuotedMessageId = deltachat.MsgId(quoteId)
@@ -191,6 +312,27 @@ func (self *DeltaChat) MsgChannelThread(channelID, parentID, text string) (strin
 	if err != nil {
 		return "", err
 	}
+	metrics.MessagesSent.Inc()
+	return strconv.FormatUint(uint64(msg.Id), 10), nil
+}
+
+// MsgChannelLocation sends a message with the given position to a chat.
+func (self *DeltaChat) MsgChannelLocation(channelID string, latitude, longitude float64) (string, error) {
+	chatId, err := strconv.ParseUint(channelID, 10, 0)
+	if err != nil {
+		return "", err
+	}
+	msgData := deltachat.MsgData{
+		Text:     formatLocation(latitude, longitude),
+		Location: &[2]float64{latitude, longitude},
+	}
+
+	chat := deltachat.Chat{self.account, deltachat.ChatId(chatId)}
+	msg, err := chat.SendMsg(msgData)
+	if err != nil {
+		return "", err
+	}
+	metrics.MessagesSent.Inc()
 	return strconv.FormatUint(uint64(msg.Id), 10), nil
 }
 
@@ -199,7 +341,7 @@ func (self *DeltaChat) MsgUserThread(userID, parentID, text string) (string, err
 	if err != nil {
 		return "", err
 	}
-	msgData := deltachat.MsgData{Text: text}
+	msgData := deltachat.MsgData{Text: self.translateMentions(text)}
 	quoteId, err := strconv.ParseUint(parentID, 10, 0)
 	if err == nil {
 		msgData.QuotedMessageId = deltachat.MsgId(quoteId)
@@ -214,6 +356,7 @@ func (self *DeltaChat) MsgUserThread(userID, parentID, text string) (string, err
 	if err != nil {
 		return "", err
 	}
+	metrics.MessagesSent.Inc()
 	return strconv.FormatUint(uint64(msg.Id), 10), nil
 }
 
@@ -281,6 +424,10 @@ func (self *DeltaChat) Kick(channelID, userID string) error {
 }
 
 func (self *DeltaChat) GetChannelID(name, teamID string) string {
+	if chatId, ok := self.lookupChanName(name); ok {
+		return strconv.FormatUint(uint64(chatId), 10)
+	}
+	// the "#<name>|<chat id>" form of older versions
 	parts := strings.Split(name, "|")
 	channelID := strings.TrimSpace(parts[len(parts)-1])
 	_, err := strconv.ParseUint(channelID, 10, 0)
@@ -346,11 +493,51 @@ func (self *DeltaChat) GetUser(userID interface{}) *bridge.UserInfo
 	return self.getUserInfo(contact)
 }
 
-func (self *DeltaChat) SearchPosts(search string) interface{} {
-	msgs, _ := self.account.SearchMessages(search)
+// SearchPosts searches messages in the chat with the given channelID, or in
+// all chats if channelID is empty. Most recent messages are returned first.
+func (self *DeltaChat) SearchPosts(channelID, search string) interface{} {
+	var chatId uint64
+	if channelID != "" {
+		id, err := strconv.ParseUint(channelID, 10, 0)
+		if err != nil {
+			return nil
+		}
+		chatId = id
+	}
+	chat := &deltachat.Chat{self.account, deltachat.ChatId(chatId)}
+	results, err := chat.SearchMessages(search)
+	if err != nil {
+		logger.Errorf("search failed: %v", err)
+		return nil
+	}
+	msgs := make([]*deltachat.Message, 0, len(results))
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		msgs = append(msgs, &deltachat.Message{self.account, result.Id})
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Id > msgs[j].Id })
 	return msgs
 }
 
+// GetPostHTML returns the full HTML part of a message converted to plain text.
+func (self *DeltaChat) GetPostHTML(msgID string) (string, error) {
+	id, err := strconv.ParseUint(msgID, 10, 0)
+	if err != nil {
+		return "", err
+	}
+	msg := &deltachat.Message{self.account, deltachat.MsgId(id)}
+	doc, err := msg.Html()
+	if err != nil {
+		return "", err
+	}
+	if doc == "" {
+		return "", fmt.Errorf("message %v has no HTML part", msgID)
+	}
+	return htmlToText(doc), nil
+}
+
 func (self *DeltaChat) AddReaction(msgID, reaction string) error    {
 	logger.Debugf("sending reaction %#v, %#v", msgID, reaction)
 	id, err := strconv.ParseUint(msgID, 10, 0)
@@ -372,8 +559,16 @@ func (self *DeltaChat) GetTeamName(teamID string) string {
 	return ""
 }
 
+// StatusUsers returns "online" or "away" for the known contacts.
 func (self *DeltaChat) StatusUsers() (map[string]string, error) {
-	return make(map[string]string), nil
+	self.stateMutex.Lock()
+	defer self.stateMutex.Unlock()
+
+	statuses := make(map[string]string, len(self.presence))
+	for id, online := range self.presence {
+		statuses[strconv.FormatUint(uint64(id), 10)] = presenceStatus(online)
+	}
+	return statuses, nil
 }
 
 func (self *DeltaChat) UpdateChannels() error {
@@ -406,6 +601,107 @@ func (self *DeltaChat) GetPostsSince(channelID string, since int64) interface{}
 	return nil
 }
 
+// GetUserByUsername returns the contact with the given address, the nick form
+// with "|" instead of "@" is accepted too.
 func (self *DeltaChat) GetUserByUsername(username string) *bridge.UserInfo {
-	return nil
+	addr := username
+	if !strings.Contains(addr, "@") {
+		addr = strings.Replace(addr, "|", "@", 1)
+	}
+	contact, err := self.account.GetContactByAddr(addr)
+	if err != nil || contact == nil {
+		return nil
+	}
+	snapshot, err := contact.Snapshot()
+	if err != nil {
+		return nil
+	}
+	return self.getUserInfo(snapshot)
+}
+
+func (self *DeltaChat) GetUserDetails(userID string) (*bridge.UserDetails, error) {
+	id, err := strconv.ParseUint(userID, 10, 0)
+	if err != nil {
+		return nil, err
+	}
+	contact := &deltachat.Contact{self.account, deltachat.ContactId(id)}
+	snapshot, err := contact.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	details := &bridge.UserDetails{
+		Address:     snapshot.Address,
+		DisplayName: snapshot.DisplayName,
+		Status:      snapshot.Status,
+		Online:      snapshot.WasSeenRecently,
+		Verified:    snapshot.IsVerified,
+		VerifiedBy:  snapshot.VerifierAddr,
+	}
+	if snapshot.LastSeen.Unix() > 0 {
+		details.LastSeen = snapshot.LastSeen.Time
+	}
+	if info, err := contact.EncryptionInfo(); err == nil {
+		details.Encryption, details.Fingerprint = parseEncryptionInfo(info, snapshot.Address)
+	}
+
+	for _, flags := range []uint{0, uint(deltachat.ChatListFlagArchivedOnly)} {
+		items, err := self.account.QueryChatListItems("", contact, flags)
+		if err != nil {
+			continue
+		}
+		for _, item := range items {
+			if item != nil && item.Error == "" && item.IsGroup {
+				details.ChannelIDs = append(details.ChannelIDs, strconv.FormatUint(uint64(item.Id), 10))
+			}
+		}
+	}
+
+	return details, nil
+}
+
+// DeletedMessages returns the messages of msgIDs that are no longer in the chat
+// with the given channelID.
+func (self *DeltaChat) DeletedMessages(channelID string, msgIDs []string) ([]string, error) {
+	if len(msgIDs) == 0 {
+		return nil, nil
+	}
+	chat, err := self.getChat(channelID)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := chat.Messages(false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	exists := make(map[string]bool, len(msgs))
+	for _, msg := range msgs {
+		exists[strconv.FormatUint(uint64(msg.Id), 10)] = true
+	}
+	var deleted []string
+	for _, id := range msgIDs {
+		if !exists[id] {
+			deleted = append(deleted, id)
+		}
+	}
+	return deleted, nil
+}
+
+// SendWebxdcUpdate sends a status update to the webxdc app of message msgID.
+// update is wrapped in a {"payload": ...} object if it isn't one already.
+func (self *DeltaChat) SendWebxdcUpdate(msgID, update string) error {
+	id, err := strconv.ParseUint(msgID, 10, 0)
+	if err != nil {
+		return err
+	}
+	if !json.Valid([]byte(update)) {
+		return fmt.Errorf("invalid JSON: %s", update)
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(update), &obj); err != nil || obj["payload"] == nil {
+		update = `{"payload":` + update + `}`
+	}
+	msg := &deltachat.Message{self.account, deltachat.MsgId(id)}
+	return msg.SendStatusUpdate(update, "")
 }
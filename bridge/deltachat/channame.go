@@ -0,0 +1,354 @@
+package deltachat
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
+	"github.com/deltachat/deltaircd/bridge"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// chanNameMaxLen is the maximum length in bytes of a channel name, including
+// the "#".
+const chanNameMaxLen = 50
+
+// UI config keys of the channel names, followed by the chat ID.
+const (
+	chanNameKey  = "deltaircd.channame."  // the name given when the chat was first seen
+	chanAliasKey = "deltaircd.chanalias." // the name set with the alias command
+)
+
+var (
+	dashesRe = regexp.MustCompile("-{2,}")
+
+	// letters that don't decompose into an ASCII letter and accents
+	translitReplacer = strings.NewReplacer(
+		"ß", "ss", "æ", "ae", "Æ", "AE", "œ", "oe", "Œ", "OE", "ø", "o", "Ø", "O",
+		"ł", "l", "Ł", "L", "đ", "d", "Đ", "D", "ð", "d", "Ð", "D", "þ", "th", "Þ", "TH",
+		"ı", "i",
+	)
+
+	// cyrillic and greek letters, other scripts are dropped
+	translitTable = map[rune]string{
+		'а': "a", 'б': "b", 'в': "v", 'г': "g", 'ґ': "g", 'д': "d", 'ђ': "dj", 'е': "e",
+		'ё': "e", 'є': "ye", 'ж': "zh", 'з': "z", 'ѕ': "dz", 'и': "i", 'і': "i", 'ї': "yi",
+		'й': "y", 'ј': "j", 'к': "k", 'л': "l", 'љ': "lj", 'м': "m", 'н': "n", 'њ': "nj",
+		'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'ћ': "c", 'у': "u", 'ў': "u",
+		'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'џ': "dz", 'ш': "sh", 'щ': "shch",
+		'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+		'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i", 'θ': "th",
+		'ι': "i", 'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p",
+		'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t", 'υ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps",
+		'ω': "o",
+	}
+)
+
+// chanIndex keeps the channel names of the chats, they don't change when the
+// group is renamed unless RenameChannels is enabled.
+type chanIndex struct {
+	names    map[deltachat.ChatId]string // lowercased channel name of a chat
+	chats    map[string]deltachat.ChatId // channel name to its chat
+	previous map[string]deltachat.ChatId // names chats had before, still resolved
+	aliases  map[deltachat.ChatId]bool   // the name was set with the alias command
+	bases    map[deltachat.ChatId]string // channel name derived from the chat name
+}
+
+func newChanIndex() *chanIndex {
+	return &chanIndex{
+		names:    make(map[deltachat.ChatId]string),
+		chats:    make(map[string]deltachat.ChatId),
+		previous: make(map[string]deltachat.ChatId),
+		aliases:  make(map[deltachat.ChatId]bool),
+		bases:    make(map[deltachat.ChatId]string),
+	}
+}
+
+// transliterate removes accents and replaces other latin, cyrillic and greek
+// letters by ASCII, e.g. "Größe" becomes "Grosse" and "Привет" "Privet".
+// Letters of other scripts are kept.
+func transliterate(s string) string {
+	// before removing accents, "й" isn't "и"
+	s = translitReplacer.Replace(translitScripts(s))
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	out, _, err := transform.String(t, s)
+	if err != nil {
+		return s
+	}
+	return translitScripts(out)
+}
+
+// translitScripts replaces the letters in translitTable.
+func translitScripts(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		ascii, ok := translitTable[unicode.ToLower(r)]
+		switch {
+		case !ok:
+			b.WriteRune(r)
+		case unicode.IsUpper(r) && ascii != "":
+			b.WriteString(strings.ToUpper(ascii[:1]) + ascii[1:])
+		default:
+			b.WriteString(ascii)
+		}
+	}
+	return b.String()
+}
+
+// truncateName cuts a name to at most max bytes without splitting runes.
+func truncateName(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	for max > 0 && !utf8.RuneStart(name[max]) {
+		max--
+	}
+	return name[:max]
+}
+
+func isChanNameRune(r rune) bool {
+	return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_.", r))
+}
+
+// formatChanName returns the channel name for a chat name before collisions
+// are resolved: transliterated, lowercased and with "-" instead of spaces,
+// symbols and letters that have no ASCII transliteration.
+func formatChanName(chatName string) string {
+	name := strings.Map(func(r rune) rune {
+		if isChanNameRune(r) {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(transliterate(chatName)))
+	name = strings.Trim(dashesRe.ReplaceAllString(name, "-"), "-")
+	if name == "" {
+		name = "chat"
+	}
+	return truncateName("#"+name, chanNameMaxLen)
+}
+
+// validateAlias returns the lowercased channel name for an alias.
+func validateAlias(alias string) (string, error) {
+	name := "#" + strings.ToLower(strings.TrimPrefix(alias, "#"))
+	if name == "#" || len(name) > chanNameMaxLen {
+		return "", fmt.Errorf("the alias must have 1 to %d characters", chanNameMaxLen-1)
+	}
+	for _, r := range name[1:] {
+		if !isChanNameRune(r) {
+			return "", fmt.Errorf("the alias can only contain ASCII letters, digits, \"-\", \"_\" and \".\"")
+		}
+	}
+	return name, nil
+}
+
+// autoName returns the channel name for a chat: the formatted chat name, with
+// "|<chat id>" appended if another chat already uses it.
+func (index *chanIndex) autoName(chatId deltachat.ChatId, chatName string) string {
+	name := formatChanName(chatName)
+	if owner, taken := index.chats[name]; !taken || owner == chatId {
+		return name
+	}
+	suffix := "|" + strconv.FormatUint(uint64(chatId), 10)
+	return truncateName(name, chanNameMaxLen-len(suffix)) + suffix
+}
+
+// set gives a chat a new channel name, the old one is still resolved.
+func (index *chanIndex) set(chatId deltachat.ChatId, name string) {
+	if old, ok := index.names[chatId]; ok && old != name {
+		delete(index.chats, old)
+		index.previous[old] = chatId
+	}
+	delete(index.previous, name)
+	index.names[chatId] = name
+	index.chats[name] = chatId
+}
+
+// available returns whether a chat can use a channel name.
+func (index *chanIndex) available(chatId deltachat.ChatId, name string) bool {
+	owner, taken := index.chats[name]
+	return !taken || owner == chatId
+}
+
+// loadChanName adds the stored name of a chat to the index, returns false if
+// there is none. The caller holds chanMutex.
+func (self *DeltaChat) loadChanName(chatId deltachat.ChatId) bool {
+	key := strconv.FormatUint(uint64(chatId), 10)
+	index := self.chanNames
+	if alias, _ := self.account.GetUiConfig(chanAliasKey + key); alias != "" && index.available(chatId, alias) {
+		index.aliases[chatId] = true
+		index.set(chatId, alias)
+		return true
+	}
+	if name, _ := self.account.GetUiConfig(chanNameKey + key); name != "" && index.available(chatId, name) {
+		index.set(chatId, name)
+		return true
+	}
+	return false
+}
+
+// chanName returns the channel name of a chat, new chats get a name from
+// their chat name that is stored, so it stays the same across renames.
+func (self *DeltaChat) chanName(chatId deltachat.ChatId, chatName string) string {
+	self.chanMutex.Lock()
+	defer self.chanMutex.Unlock()
+
+	index := self.chanNames
+	if name, ok := index.names[chatId]; ok {
+		return name
+	}
+	if _, ok := index.bases[chatId]; !ok {
+		index.bases[chatId] = formatChanName(chatName)
+	}
+	if self.loadChanName(chatId) {
+		return index.names[chatId]
+	}
+
+	name := index.autoName(chatId, chatName)
+	index.set(chatId, name)
+	if err := self.account.SetUiConfig(chanNameKey+strconv.FormatUint(uint64(chatId), 10), name); err != nil {
+		logger.Errorf("failed to store channel name %s: %v", name, err)
+	}
+	return name
+}
+
+// loadChanNames registers the stored names of all groups before new groups
+// get a name, so the names don't depend on the order chats are seen in.
+func (self *DeltaChat) loadChanNames() {
+	items, err := self.account.ChatListItems()
+	if err != nil {
+		logger.Errorf("failed to get chat list: %v", err)
+		return
+	}
+	archived, _ := self.account.QueryChatListItems("", nil, uint(deltachat.ChatListFlagArchivedOnly))
+	items = append(items, archived...)
+
+	var chats []*deltachat.ChatListItem
+	for _, item := range items {
+		if item != nil && item.Error == "" && item.DmChatContact == 0 {
+			chats = append(chats, item)
+		}
+	}
+	sort.Slice(chats, func(i, j int) bool { return chats[i].Id < chats[j].Id })
+
+	self.chanMutex.Lock()
+	for _, item := range chats {
+		self.chanNames.bases[item.Id] = formatChanName(item.Name)
+		self.loadChanName(item.Id)
+	}
+	self.chanMutex.Unlock()
+
+	for _, item := range chats {
+		self.chanName(item.Id, item.Name)
+	}
+}
+
+// lookupChanName returns the chat of a current or previous channel name.
+func (self *DeltaChat) lookupChanName(name string) (deltachat.ChatId, bool) {
+	name = "#" + strings.ToLower(strings.TrimPrefix(name, "#"))
+
+	self.chanMutex.Lock()
+	defer self.chanMutex.Unlock()
+
+	if chatId, ok := self.chanNames.chats[name]; ok {
+		return chatId, true
+	}
+	chatId, ok := self.chanNames.previous[name]
+	return chatId, ok
+}
+
+// followRename gives a chat a new channel name after the group was renamed,
+// if RenameChannels is enabled and the name isn't an alias.
+func (self *DeltaChat) followRename(chatId deltachat.ChatId, chatName string) {
+	base := formatChanName(chatName)
+
+	self.chanMutex.Lock()
+	index := self.chanNames
+	_, known := index.names[chatId]
+	old := index.bases[chatId]
+	index.bases[chatId] = base
+	if !known || old == base || index.aliases[chatId] || !self.cfg.Viper().GetBool(self.Protocol()+".renamechannels") {
+		self.chanMutex.Unlock()
+		return
+	}
+	name := index.autoName(chatId, chatName)
+	changed := name != index.names[chatId]
+	if changed {
+		index.set(chatId, name)
+		if err := self.account.SetUiConfig(chanNameKey+strconv.FormatUint(uint64(chatId), 10), name); err != nil {
+			logger.Errorf("failed to store channel name %s: %v", name, err)
+		}
+	}
+	self.chanMutex.Unlock()
+
+	if changed {
+		self.sendChannelRename(chatId, name)
+	}
+}
+
+func (self *DeltaChat) SetChannelAlias(channelID, alias string) error {
+	id, err := strconv.ParseUint(channelID, 10, 0)
+	if err != nil {
+		return err
+	}
+	chat := &deltachat.Chat{self.account, deltachat.ChatId(id)}
+	snapshot, err := chat.BasicSnapshot()
+	if err != nil {
+		return err
+	}
+
+	name := ""
+	if alias != "" {
+		if name, err = validateAlias(alias); err != nil {
+			return err
+		}
+	}
+
+	self.chanMutex.Lock()
+	index := self.chanNames
+	if name != "" && !index.available(chat.Id, name) {
+		self.chanMutex.Unlock()
+		return fmt.Errorf("%s is already used by another chat", name)
+	}
+	if err := self.account.SetUiConfig(chanAliasKey+channelID, name); err != nil {
+		self.chanMutex.Unlock()
+		return err
+	}
+	if name != "" {
+		index.aliases[chat.Id] = true
+	} else {
+		// back to the automatic name, which may have been taken meanwhile
+		delete(index.aliases, chat.Id)
+		stored, _ := self.account.GetUiConfig(chanNameKey + channelID)
+		name = stored
+		if name == "" || !index.available(chat.Id, name) {
+			name = index.autoName(chat.Id, snapshot.Name)
+			self.account.SetUiConfig(chanNameKey+channelID, name) //nolint:errcheck
+		}
+	}
+	changed := name != index.names[chat.Id]
+	index.set(chat.Id, name)
+	self.chanMutex.Unlock()
+
+	if changed {
+		self.sendChannelRename(chat.Id, name)
+	}
+	return nil
+}
+
+func (self *DeltaChat) sendChannelRename(chatId deltachat.ChatId, name string) {
+	logger.Debugf("chat %v is now %s", chatId, name)
+	self.sendEvent(&bridge.Event{
+		Type: "channel_renamed",
+		Data: &bridge.ChannelRenameEvent{
+			ChannelID: strconv.FormatUint(uint64(chatId), 10),
+			Name:      name,
+		},
+	})
+}
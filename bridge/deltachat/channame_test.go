@@ -0,0 +1,55 @@
+package deltachat
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatChanName(t *testing.T) {
+	assert.Equal(t, "#grosse-familie", formatChanName("Größe Familie"))
+	assert.Equal(t, "#cafe-creme", formatChanName("  Café / Crème! "))
+	assert.Equal(t, "#privet-mir", formatChanName("Привет, мир"))
+	assert.Equal(t, "#shchuka-ezh-yoga", formatChanName("Щука Ёж Йога"))
+	assert.Equal(t, "#kalimera", formatChanName("Καλημέρα"))
+	assert.Equal(t, "#team", formatChanName("日本 team"))
+	assert.Equal(t, "#party", formatChanName("🎉 Party 🎉"))
+	assert.Equal(t, "#chat", formatChanName("🎉"))
+
+	long := formatChanName(strings.Repeat("ä", 60))
+	assert.Equal(t, "#"+strings.Repeat("a", chanNameMaxLen-1), long)
+
+	long = formatChanName(strings.Repeat("ж", 60))
+	assert.Equal(t, "#"+strings.Repeat("zh", 24)+"z", long)
+	assert.True(t, utf8.ValidString(long))
+}
+
+func TestChanIndexAutoName(t *testing.T) {
+	index := newChanIndex()
+	index.set(10, index.autoName(10, "Family"))
+	index.set(12, index.autoName(12, "family"))
+	assert.Equal(t, "#family", index.names[10])
+	assert.Equal(t, "#family|12", index.names[12])
+	assert.Equal(t, "#family", index.autoName(10, "Family"))
+
+	index.set(10, "#relatives")
+	assert.Equal(t, deltachat.ChatId(10), index.previous["#family"])
+	assert.True(t, index.available(12, "#family"))
+	assert.False(t, index.available(12, "#relatives"))
+}
+
+func TestValidateAlias(t *testing.T) {
+	name, err := validateAlias("#Family")
+	assert.NoError(t, err)
+	assert.Equal(t, "#family", name)
+
+	_, err = validateAlias("family|12")
+	assert.Error(t, err)
+	_, err = validateAlias("#")
+	assert.Error(t, err)
+	_, err = validateAlias("#семья")
+	assert.Error(t, err)
+}
@@ -1,12 +1,17 @@
 package deltachat
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
 	"github.com/deltachat/deltaircd/bridge"
+	"github.com/deltachat/deltaircd/config"
+	"github.com/deltachat/deltaircd/metrics"
 	"github.com/forPelevin/gomoji"
 	prefixed "github.com/matterbridge/logrus-prefixed-formatter"
 	homedir "github.com/mitchellh/go-homedir"
@@ -18,36 +23,65 @@ type DeltaChat struct {
 	account     *deltachat.Account
 	credentials bridge.Credentials
 	eventChan   chan<- *bridge.Event
-	cfg         *viper.Viper
+	cfg         *config.Config
 	onConnect   func()
 	connected   bool
+
+	// last live location shown per contact, used for throttling
+	locationShown map[deltachat.ContactId]shownLocation
+
+	stopPoll   chan struct{} // closed on logout
+	logoutOnce sync.Once
+
+	nickMutex sync.Mutex
+	nicks     *nickIndex
+
+	chanMutex sync.Mutex
+	chanNames *chanIndex
+
+	// chats with pending checks for deleted messages
+	msgsChangedMutex sync.Mutex
+	msgsChanged      map[deltachat.ChatId]bool
+
+	// known presence, contacts and joined groups, used to detect changes
+	stateMutex sync.Mutex
+	presence   map[deltachat.ContactId]bool // contact was seen recently
+	contacts   map[deltachat.ContactId]string
+	chats      map[deltachat.ChatId]bool
 }
 
+// msgsDeletedDelay is how long changes to a chat are collected before IRC is
+// told that messages may have been deleted.
+const msgsDeletedDelay = 2 * time.Second
+
 var (
-	logger *logrus.Entry
+	logger = newLogger()
 	rpc    *deltachat.RpcIO
 )
 
-func New(cfg *viper.Viper, cred bridge.Credentials, eventChan chan<- *bridge.Event, onConnect func()) (bridge.Bridger, error) {
-	dc := &DeltaChat{
-		credentials: cred,
-		eventChan:   eventChan,
-		cfg:         cfg,
-		onConnect:   onConnect,
-	}
-
+func newLogger() *logrus.Entry {
 	ourlog := logrus.New()
 	ourlog.SetFormatter(&prefixed.TextFormatter{
 		PrefixPadding: 17,
 		FullTimestamp: true,
 	})
-	logger = ourlog.WithFields(logrus.Fields{"prefix": "bridge/deltachat"})
-	if cfg.GetBool("debug") {
-		ourlog.SetLevel(logrus.DebugLevel)
-	}
+	return ourlog.WithFields(logrus.Fields{"prefix": "bridge/deltachat"})
+}
+
+func New(cfg *config.Config, cred bridge.Credentials, eventChan chan<- *bridge.Event, onConnect func()) (bridge.Bridger, error) {
+	dc := &DeltaChat{
+		credentials: cred,
+		eventChan:   eventChan,
+		cfg:         cfg,
+		onConnect:   onConnect,
 
-	if cfg.GetBool("trace") {
-		ourlog.SetLevel(logrus.TraceLevel)
+		locationShown: make(map[deltachat.ContactId]shownLocation),
+		presence:      make(map[deltachat.ContactId]bool),
+		stopPoll:      make(chan struct{}),
+		contacts:      make(map[deltachat.ContactId]string),
+		msgsChanged:   make(map[deltachat.ChatId]bool),
+		nicks:         newNickIndex(),
+		chanNames:     newChanIndex(),
 	}
 
 	if err := dc.loginToDeltaChat(); err != nil {
@@ -56,10 +90,28 @@ func New(cfg *viper.Viper, cred bridge.Credentials, eventChan chan<- *bridge.Eve
 	return dc, nil
 }
 
+// SetLogLevel changes the log level of the bridge.
+func SetLogLevel(level logrus.Level) {
+	logger.Logger.SetLevel(level)
+}
+
+// Shutdown stops the RPC server, the accounts must be logged out.
+func Shutdown() {
+	if rpc != nil {
+		rpc.Stop()
+		rpc = nil
+	}
+}
+
+// AccountsDir returns the Delta Chat accounts folder from the config.
+func AccountsDir(cfg *viper.Viper) (string, error) {
+	return homedir.Expand(cfg.GetString("deltachat.accounts"))
+}
+
 func (self *DeltaChat) loginToDeltaChat() error {
 	if rpc == nil {
 		rpc = deltachat.NewRpcIO()
-		path, err := homedir.Expand(self.cfg.GetString(self.Protocol() + ".accounts"))
+		path, err := AccountsDir(self.cfg.Viper())
 		if err != nil {
 			return err
 		}
@@ -67,7 +119,7 @@ func (self *DeltaChat) loginToDeltaChat() error {
 		rpc.Start()
 	}
 
-	manager := deltachat.AccountManager{rpc}
+	manager := deltachat.AccountManager{&timedRpc{rpc}}
 	accounts, _ := manager.Accounts()
 
 	isBackupLink := strings.HasPrefix(self.credentials.Login, "DCBACKUP:")
@@ -112,12 +164,18 @@ func (self *DeltaChat) loginToDeltaChat() error {
 			return err
 		}
 	} else if configured, _ := self.account.IsConfigured(); configured {
+		if fp := self.credentials.CertFP; fp != "" && !self.certFPRegistered(fp) {
+			return fmt.Errorf("the certificate %s is not registered for %s", fp, self.credentials.Login)
+		}
 		self.account.StartIO()
 	} else {
 		return fmt.Errorf("need LOGIN <email> <pass>")
 	}
 
+	self.loadNicks()
+	self.loadChanNames()
 	go self.onConnect()
+	go self.poll()
 	go func() {
 		self.processMessages() // process old messages
 		self.handleEvents()
@@ -187,11 +245,28 @@ func (self *DeltaChat) handleEvent(event deltachat.Event) {
 				ChannelType: channelType,
 			},
 		}
-		self.eventChan <- bridgeEvent
+		self.sendEvent(bridgeEvent)
+	case deltachat.EventLocationChanged:
+		if ev.ContactId != 0 && ev.ContactId != deltachat.ContactSelf {
+			self.processLiveLocation(ev.ContactId)
+		}
+	case deltachat.EventWebxdcStatusUpdate:
+		self.processWebxdcUpdate(ev.MsgId, ev.StatusUpdateSerial)
 	case deltachat.EventIncomingMsg:
+		// fresh messages of muted chats are not listed by get_fresh_msgs
 		chat := &deltachat.Chat{self.account, ev.ChatId}
-		chat.SetMuteDuration(0) // TODO: remove this when there is a way to get fresh messages from muted chats
-		self.processMessages()
+		if chatData, err := chat.BasicSnapshot(); err == nil && chatData.IsMuted {
+			self.processFreshMsg(&deltachat.Message{self.account, ev.MsgId})
+		} else {
+			self.processMessages()
+		}
+	case deltachat.EventContactsChanged:
+		self.refreshContacts(ev.ContactId)
+	case deltachat.EventChatModified:
+		self.processChatChanged(ev.ChatId)
+		self.processChatModified(ev.ChatId)
+	case deltachat.EventChatEphemeralTimerModified:
+		self.processChatModified(ev.ChatId)
 	case deltachat.EventMsgsChanged:
 		if ev.MsgId != 0 {
 			msg := &deltachat.Message{self.account, ev.MsgId}
@@ -200,8 +275,58 @@ func (self *DeltaChat) handleEvent(event deltachat.Event) {
 				self.processInfoMsg(msgData)
 			}
 
+		} else if ev.ChatId != 0 {
+			self.processMsgsDeleted(ev.ChatId)
+		}
+	}
+}
+
+// processMsgsDeleted tells IRC that messages of a chat may have been deleted,
+// e.g. expired ephemeral messages, so references to them can be dropped.
+// Bursts of changes to the same chat result in a single event.
+func (self *DeltaChat) processMsgsDeleted(chatId deltachat.ChatId) {
+	self.msgsChangedMutex.Lock()
+	defer self.msgsChangedMutex.Unlock()
+	if self.msgsChanged[chatId] {
+		return
+	}
+	self.msgsChanged[chatId] = true
+
+	time.AfterFunc(msgsDeletedDelay, func() {
+		self.msgsChangedMutex.Lock()
+		delete(self.msgsChanged, chatId)
+		self.msgsChangedMutex.Unlock()
+
+		select {
+		case <-self.stopPoll:
+			return
+		default:
+		}
+		self.sendMsgsDeleted(chatId)
+	})
+}
+
+func (self *DeltaChat) sendMsgsDeleted(chatId deltachat.ChatId) {
+	chat := &deltachat.Chat{self.account, chatId}
+	chatData, err := chat.BasicSnapshot()
+	if err != nil {
+		return
+	}
+
+	event := &bridge.MessagesDeletedEvent{
+		ChannelID: strconv.FormatUint(uint64(chatId), 10),
+	}
+	if chatData.ChatType == deltachat.ChatSingle {
+		contacts, _ := chat.Contacts()
+		if len(contacts) == 0 {
+			return
 		}
+		event.UserID = strconv.FormatUint(uint64(contacts[0].Id), 10)
 	}
+	self.sendEvent(&bridge.Event{
+		Type: "messages_deleted",
+		Data: event,
+	})
 }
 
 func (self *DeltaChat) processInfoMsg(msgData *deltachat.MsgSnapshot) bool {
@@ -229,7 +354,7 @@ func (self *DeltaChat) processInfoMsg(msgData *deltachat.MsgSnapshot) bool {
 				ChannelID: strconv.FormatUint(uint64(msgData.ChatId), 10),
 			},
 		}
-		self.eventChan <- event
+		self.sendEvent(event)
 		return true
 	case deltachat.SysmsgMemberRemovedFromGroup:
 		actor, target, err := msgData.ParseMemberRemoved()
@@ -261,26 +386,45 @@ func (self *DeltaChat) processInfoMsg(msgData *deltachat.MsgSnapshot) bool {
 				ChannelID: strconv.FormatUint(uint64(msgData.ChatId), 10),
 			},
 		}
-		self.eventChan <- event
+		self.sendEvent(event)
 		return true
 	case deltachat.SysmsgGroupNameChanged:
 		if msgData.FromId == deltachat.ContactSelf {
 			return false
 		}
-		chat := &deltachat.Chat{msgData.Account, msgData.ChatId}
-		chatData, err := chat.BasicSnapshot()
-		if err != nil {
-			return false
-		}
+		channelID := strconv.FormatUint(uint64(msgData.ChatId), 10)
 		event := &bridge.Event{
 			Type: "channel_topic",
 			Data: &bridge.ChannelTopicEvent{
-				Text:      chatData.Name,
-				ChannelID: strconv.FormatUint(uint64(msgData.ChatId), 10),
+				Text:      self.Topic(channelID),
+				ChannelID: channelID,
 				UserID:    strconv.FormatUint(uint64(msgData.FromId), 10),
 			},
 		}
-		self.eventChan <- event
+		self.sendEvent(event)
+		self.sendNotice(msgData, msgData.Text)
+		return true
+	case deltachat.SysmsgGroupImageChanged:
+		if msgData.FromId == deltachat.ContactSelf {
+			return false
+		}
+		text := msgData.Text
+		chat := &deltachat.Chat{msgData.Account, msgData.ChatId}
+		if chatData, err := chat.BasicSnapshot(); err == nil && chatData.ProfileImage != "" {
+			text = joinLines(text, "file://"+chatData.ProfileImage)
+		}
+		self.sendNotice(msgData, text)
+		return true
+	case deltachat.SysmsgEphemeralTimerChanged:
+		chat := &deltachat.Chat{msgData.Account, msgData.ChatId}
+		chatData, err := chat.BasicSnapshot()
+		if err != nil || chatData.ChatType == deltachat.ChatSingle {
+			return false
+		}
+		self.sendNotice(msgData, msgData.Text)
+		return true
+	case deltachat.SysmsgWebxdcInfoMessage:
+		// shown as a notice on the webxdc message by processWebxdcUpdate()
 		return true
 	default:
 		return false
@@ -291,29 +435,52 @@ func (self *DeltaChat) processMessages() {
 	msgs, _ := self.account.FreshMsgsInArrivalOrder()
 	logger.Debugf("Processing %v messages", len(msgs))
 	for _, msg := range msgs {
-		msgData, _ := msg.Snapshot()
-		if !msgData.IsInfo || !self.processInfoMsg(msgData) {
-			self.processMsg(msgData)
-		}
-		msg.MarkSeen()
+		self.processFreshMsg(msg)
 	}
 }
 
+func (self *DeltaChat) processFreshMsg(msg *deltachat.Message) {
+	msgData, err := msg.Snapshot()
+	if err != nil {
+		logger.Errorf("failed to get message %v: %v", msg.Id, err)
+		return
+	}
+	if !msgData.IsInfo || !self.processInfoMsg(msgData) {
+		self.processMsg(msgData)
+	}
+	msg.MarkSeen()
+}
+
 func (self *DeltaChat) processMsg(msgData *deltachat.MsgSnapshot) {
 	logger.Debugf("Processing message (id=%v)", msgData.Id)
 
 	ghost := self.getUserInfo(msgData.Sender)
+	self.updatePresence(msgData.Sender)
 
 	chat := deltachat.Chat{self.account, msgData.ChatId}
 	chatData, _ := chat.BasicSnapshot()
 	channelID := strconv.FormatUint(uint64(chat.Id), 10)
 
 	text := msgData.Text
-	if msgData.File != "" {
-		if text != "" {
-			text = "file://" + msgData.File + "\n" + text
-		} else {
-			text = "file://" + msgData.File
+	classic := isClassicEmail(msgData, chatData)
+	if classic && self.cfg.Viper().GetBool(self.Protocol()+".stripquotes") {
+		text = stripQuotedReply(text)
+	}
+	if msgData.HasHtml {
+		text = joinLines(text, "[full message: html "+bridge.MessageRef+"]")
+	}
+	if classic && msgData.Subject != "" {
+		text = joinLines("Subject: "+msgData.Subject, text)
+	}
+	switch {
+	case msgData.ViewType == deltachat.MsgWebxdc:
+		text = joinLines(self.formatWebxdc(msgData), text)
+	case msgData.File != "":
+		text = joinLines("file://"+msgData.File, text)
+	}
+	if msgData.HasLocation {
+		if loc := self.msgLocation(msgData); loc != nil {
+			text = joinLines(text, "location: "+formatLocation(loc.Latitude, loc.Longitude))
 		}
 	}
 	if msgData.OverrideSenderName != "" {
@@ -333,6 +500,144 @@ func (self *DeltaChat) processMsg(msgData *deltachat.MsgSnapshot) {
 	}
 }
 
+// isClassicEmail returns true for mailing list posts and for messages with an
+// HTML part that were not sent end-to-end encrypted by a chat client.
+func isClassicEmail(msgData *deltachat.MsgSnapshot, chatData *deltachat.BasicChatSnapshot) bool {
+	if chatData != nil && chatData.ChatType == deltachat.ChatMailinglist {
+		return true
+	}
+	return msgData.HasHtml && !msgData.ShowPadlock
+}
+
+// formatWebxdc returns a one-line description of a webxdc app message, the
+// context ID of the message is shown so status updates can be sent with the
+// xdc command.
+func (self *DeltaChat) formatWebxdc(msgData *deltachat.MsgSnapshot) string {
+	info := msgData.WebxdcInfo
+	if info == nil {
+		msg := &deltachat.Message{self.account, msgData.Id}
+		var err error
+		if info, err = msg.WebxdcInfo(); err != nil {
+			return "file://" + msgData.File
+		}
+	}
+
+	text := "[webxdc " + bridge.MessageRef + "] " + info.Name
+	if info.Document != "" {
+		text += " - " + info.Document
+	}
+	if info.Summary != "" {
+		text += ": " + info.Summary
+	}
+	return text
+}
+
+type webxdcStatusUpdate struct {
+	Info     string
+	Summary  string
+	Document string
+	Serial   uint
+}
+
+// processWebxdcUpdate shows the info or summary of a webxdc status update, e.g.
+// a poll vote, as a notice on the thread of the webxdc message it belongs to.
+// Delta Chat doesn't tell who sent an update, so it isn't attributed to a
+// contact. Updates with only a payload, e.g. moves of a game, aren't shown.
+func (self *DeltaChat) processWebxdcUpdate(msgId deltachat.MsgId, serial uint) {
+	if serial == 0 {
+		return
+	}
+	msg := &deltachat.Message{self.account, msgId}
+	data, err := msg.StatusUpdates(serial - 1)
+	if err != nil {
+		logger.Errorf("failed to get webxdc status updates of message %v: %v", msgId, err)
+		return
+	}
+	var updates []webxdcStatusUpdate
+	if err := json.Unmarshal([]byte(data), &updates); err != nil {
+		logger.Errorf("failed to parse webxdc status updates of message %v: %v", msgId, err)
+		return
+	}
+	msgData, err := msg.Snapshot()
+	if err != nil {
+		return
+	}
+
+	chat := &deltachat.Chat{self.account, msgData.ChatId}
+	chatData, err := chat.BasicSnapshot()
+	if err != nil {
+		return
+	}
+	channelID := strconv.FormatUint(uint64(msgData.ChatId), 10)
+	msgID := strconv.FormatUint(uint64(msgId), 10)
+
+	for _, update := range updates {
+		if update.Serial != serial {
+			continue
+		}
+		var text string
+		switch {
+		case update.Info != "":
+			text = update.Info
+		case update.Summary != "":
+			text = "summary: " + update.Summary
+		default:
+			continue
+		}
+		text = "webxdc update: " + strings.ReplaceAll(text, "\n", " ")
+
+		if chatData.ChatType == deltachat.ChatSingle {
+			contacts, _ := chat.Contacts()
+			if len(contacts) == 0 {
+				return
+			}
+			contact, _ := contacts[0].Snapshot()
+			self.sendEvent(&bridge.Event{
+				Type: "direct_message",
+				Data: &bridge.DirectMessageEvent{
+					Text:      text,
+					Sender:    self.GetMe(),
+					Receiver:  self.getUserInfo(contact),
+					ChannelID: channelID,
+					MessageID: msgID,
+					Event:     "webxdc",
+					ParentID:  msgID,
+				},
+			})
+		} else {
+			self.sendEvent(&bridge.Event{
+				Type: "channel_message",
+				Data: &bridge.ChannelMessageEvent{
+					Text:        text,
+					ChannelID:   channelID,
+					Sender:      self.GetMe(),
+					MessageType: "notice",
+					MessageID:   msgID,
+					Event:       "webxdc",
+					ParentID:    msgID,
+				},
+			})
+		}
+	}
+}
+
+// sendEvent queues event for IRC. Events that can't be delivered because the
+// account logged out, e.g. while waiting for room in a full queue, are dropped.
+func (self *DeltaChat) sendEvent(event *bridge.Event) {
+	select {
+	case <-self.stopPoll:
+		metrics.EventsDropped.Inc()
+		return
+	default:
+	}
+
+	select {
+	case self.eventChan <- event:
+	case <-self.stopPoll:
+		metrics.EventsDropped.Inc()
+	}
+}
+
 func (self *DeltaChat) sendDirectMessage(sender, receiver *bridge.UserInfo, channelID, msgID, parentID, text string) {
 	for _, line := range strings.Split(text, "\n") {
 		event := &bridge.Event{
@@ -346,7 +651,23 @@ func (self *DeltaChat) sendDirectMessage(sender, receiver *bridge.UserInfo, chan
 				ParentID:  parentID,
 			},
 		}
-		self.eventChan <- event
+		self.sendEvent(event)
+	}
+}
+
+// sendNotice sends text as a notice from the sender of msgData to its group.
+func (self *DeltaChat) sendNotice(msgData *deltachat.MsgSnapshot, text string) {
+	for _, line := range strings.Split(text, "\n") {
+		self.sendEvent(&bridge.Event{
+			Type: "channel_message",
+			Data: &bridge.ChannelMessageEvent{
+				Text:        line,
+				ChannelID:   strconv.FormatUint(uint64(msgData.ChatId), 10),
+				Sender:      self.getUserInfo(msgData.Sender),
+				MessageType: "notice",
+				MessageID:   strconv.FormatUint(uint64(msgData.Id), 10),
+			},
+		})
 	}
 }
 
@@ -362,7 +683,7 @@ func (self *DeltaChat) sendPublicMessage(ghost *bridge.UserInfo, channelID, msgI
 				ParentID:  parentID,
 			},
 		}
-		self.eventChan <- event
+		self.sendEvent(event)
 	}
 }
 
@@ -372,6 +693,9 @@ func (self *DeltaChat) getUserInfo(dcuser *deltachat.ContactSnapshot) *bridge.Us
 	}
 
 	nick := strings.ReplaceAll(dcuser.Address, "@", "|")
+	if dcuser.Id != deltachat.ContactSelf {
+		nick = self.nick(dcuser)
+	}
 
 	return &bridge.UserInfo{
 		Nick:        nick,
@@ -386,26 +710,106 @@ func (self *DeltaChat) getUserInfo(dcuser *deltachat.ContactSnapshot) *bridge.Us
 	}
 }
 
-func (self *DeltaChat) createChannelInfo(chatId deltachat.ChatId, isDM bool, chatName string) *bridge.ChannelInfo {
+func (self *DeltaChat) createChannelInfo(snapshot *deltachat.FullChatSnapshot) *bridge.ChannelInfo {
 	return &bridge.ChannelInfo{
-		Name:    getChanName(chatId, chatName),
-		ID:      strconv.FormatUint(uint64(chatId), 10),
-		TeamID:  self.Protocol(),
-		DM:      isDM,
-		Private: false,
+		Name:        self.chanName(snapshot.Id, snapshot.Name),
+		ID:          strconv.FormatUint(uint64(snapshot.Id), 10),
+		TeamID:      self.Protocol(),
+		DM:          snapshot.ChatType == deltachat.ChatSingle,
+		Private:     false,
+		ReadOnly:    !snapshot.CanSend,
+		MailingList: snapshot.ChatType == deltachat.ChatMailinglist,
+		Broadcast:   snapshot.ChatType == deltachat.ChatBroadcast,
+
+		Muted:          snapshot.IsMuted,
+		Archived:       snapshot.Archived,
+		Protected:      snapshot.IsProtected,
+		EphemeralTimer: snapshot.EphemeralTimer,
 	}
 }
 
-func getChanName(chatId deltachat.ChatId, chatName string) string {
-	prefix := "#"
-	suffix := fmt.Sprintf("|%v", chatId)
-	name := sanitizeNick(chatName)
-	maxSize := 50 - len(prefix) - len(suffix)
-	if len(name) > maxSize {
-		name = name[:maxSize-1]
+func (self *DeltaChat) getChat(channelID string) (*deltachat.Chat, error) {
+	id, err := strconv.ParseUint(channelID, 10, 0)
+	if err != nil {
+		return nil, err
 	}
+	return &deltachat.Chat{self.account, deltachat.ChatId(id)}, nil
+}
 
-	return strings.ToLower(fmt.Sprintf("%s%s%s", prefix, name, suffix))
+// isPinned returns whether the chat is pinned, this is only part of the chat
+// list item and not of the chat snapshot.
+func (self *DeltaChat) isPinned(chatId deltachat.ChatId) bool {
+	var items map[uint64]*deltachat.ChatListItem
+	entries := [][]uint64{{uint64(chatId), 0}}
+	err := self.account.Manager.Rpc.CallResult(&items, "get_chatlist_items_by_entries", self.account.Id, entries)
+	if err != nil || items[uint64(chatId)] == nil {
+		return false
+	}
+	return items[uint64(chatId)].IsPinned
+}
+
+// processChatModified sends the current chat properties so they can be shown
+// as channel modes.
+func (self *DeltaChat) processChatModified(chatId deltachat.ChatId) {
+	channelID := strconv.FormatUint(uint64(chatId), 10)
+	info, err := self.GetChannel(channelID)
+	if err != nil || info.DM {
+		return
+	}
+	self.sendEvent(&bridge.Event{
+		Type: "channel_mode",
+		Data: &bridge.ChannelModeEvent{
+			ChannelID: channelID,
+			Info:      info,
+		},
+	})
+}
+
+// chatTopicSuffix returns what is added to the chat name in the topic of
+// mailing lists and broadcast lists.
+func chatTopicSuffix(snapshot *deltachat.FullChatSnapshot) string {
+	switch snapshot.ChatType {
+	case deltachat.ChatMailinglist:
+		if snapshot.MailingListAddress != "" {
+			return " [mailing list: " + snapshot.MailingListAddress + "]"
+		}
+		return " [mailing list]"
+	case deltachat.ChatBroadcast:
+		return " [broadcast list]"
+	}
+	return ""
+}
+
+// parseEncryptionInfo returns the first line of the encryption info of a
+// contact, e.g. "End-to-end encryption preferred.", and the fingerprint listed
+// for addr.
+func parseEncryptionInfo(info, addr string) (string, string) {
+	lines := strings.Split(strings.TrimSpace(info), "\n")
+	var fingerprint []string
+	for i, line := range lines {
+		if !strings.HasSuffix(strings.TrimSpace(line), "("+addr+"):") {
+			continue
+		}
+		for _, line := range lines[i+1:] {
+			if line = strings.TrimSpace(line); line == "" {
+				break
+			}
+			fingerprint = append(fingerprint, line)
+		}
+		break
+	}
+	return strings.TrimSpace(lines[0]), strings.Join(fingerprint, " ")
+}
+
+// joinLines joins the non-empty strings with a newline.
+func joinLines(lines ...string) string {
+	var nonEmpty []string
+	for _, line := range lines {
+		if line != "" {
+			nonEmpty = append(nonEmpty, line)
+		}
+	}
+	return strings.Join(nonEmpty, "\n")
 }
 
 func sanitizeNick(nick string) string {
@@ -0,0 +1,317 @@
+package deltachat
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	hrefRe = regexp.MustCompile(`(?is)\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+	altRe  = regexp.MustCompile(`(?is)\balt\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+)
+
+// htmlTextWriter builds the plain text version of an HTML document.
+type htmlTextWriter struct {
+	out       strings.Builder
+	quote     int  // blockquote depth, every line gets a "> " per level
+	pre       int  // <pre> depth, whitespace is kept as is
+	lineStart bool // nothing was written on the current line yet
+	space     bool // a space is pending before the next word
+	newlines  int  // number of newlines at the end of out
+}
+
+func (w *htmlTextWriter) startLine() {
+	if w.lineStart {
+		w.out.WriteString(strings.Repeat("> ", w.quote))
+		w.lineStart = false
+	}
+}
+
+func (w *htmlTextWriter) write(s string) {
+	if s == "" {
+		return
+	}
+	w.startLine()
+	w.out.WriteString(s)
+	w.newlines = 0
+}
+
+func (w *htmlTextWriter) newline() {
+	w.out.WriteString("\n")
+	w.newlines++
+	w.lineStart = true
+	w.space = false
+}
+
+// block makes sure the next text starts on a new line.
+func (w *htmlTextWriter) block() {
+	if !w.lineStart {
+		w.newline()
+	}
+	w.space = false
+}
+
+// paragraph makes sure the next text is separated by an empty line.
+func (w *htmlTextWriter) paragraph() {
+	w.block()
+	if w.newlines < 2 && w.out.Len() > 0 {
+		w.newline()
+	}
+}
+
+func (w *htmlTextWriter) text(s string) {
+	if s == "" {
+		return
+	}
+	if w.pre > 0 {
+		for i, line := range strings.Split(s, "\n") {
+			if i > 0 {
+				w.newline()
+			}
+			w.write(strings.TrimRight(line, "\r"))
+		}
+		return
+	}
+
+	first, _ := utf8.DecodeRuneInString(s)
+	last, _ := utf8.DecodeLastRuneInString(s)
+	if unicode.IsSpace(first) {
+		w.space = true
+	}
+	words := strings.Fields(s)
+	for _, word := range words {
+		if w.space && !w.lineStart {
+			w.write(" ")
+		}
+		w.write(word)
+		w.space = true
+	}
+	w.space = len(words) == 0 && w.space || unicode.IsSpace(last)
+}
+
+// attr returns the value of an attribute matched by re in a tag.
+// indexClosingTag returns the index of the first closing tag name in doc, the
+// name is compared ignoring case.
+func indexClosingTag(doc, name string) int {
+	for i := 0; ; {
+		j := strings.Index(doc[i:], "</")
+		if j < 0 {
+			return -1
+		}
+		i += j
+		if end := i + 2 + len(name); end <= len(doc) && strings.EqualFold(doc[i+2:end], name) {
+			return i
+		}
+		i += 2
+	}
+}
+
+func attr(re *regexp.Regexp, tag string) string {
+	m := re.FindStringSubmatch(tag)
+	if m == nil {
+		return ""
+	}
+	return html.UnescapeString(m[1] + m[2] + m[3])
+}
+
+// htmlToText converts an HTML document to readable plain text. Links are
+// shown after their text, list items are prefixed with "- " (or their number)
+// and quotes with "> ".
+//
+//nolint:funlen,gocognit,gocyclo,cyclop
+func htmlToText(doc string) string {
+	w := &htmlTextWriter{lineStart: true}
+
+	type link struct {
+		href  string
+		start int
+	}
+	var links []link
+	var lists []int // -1 for unordered lists, otherwise the next item number
+
+	for len(doc) > 0 {
+		lt := strings.IndexByte(doc, '<')
+		if lt < 0 {
+			w.text(html.UnescapeString(doc))
+			break
+		}
+		w.text(html.UnescapeString(doc[:lt]))
+		doc = doc[lt:]
+
+		if strings.HasPrefix(doc, "<!--") {
+			end := strings.Index(doc, "-->")
+			if end < 0 {
+				break
+			}
+			doc = doc[end+3:]
+			continue
+		}
+
+		// find the end of the tag, skipping quoted attribute values
+		end, quote := -1, byte(0)
+		for i := 1; i < len(doc) && end < 0; i++ {
+			switch {
+			case quote != 0:
+				if doc[i] == quote {
+					quote = 0
+				}
+			case doc[i] == '"' || doc[i] == '\'':
+				quote = doc[i]
+			case doc[i] == '>':
+				end = i
+			}
+		}
+		if end < 0 {
+			break
+		}
+		tag := doc[1:end]
+		doc = doc[end+1:]
+
+		closing := strings.HasPrefix(tag, "/")
+		name := strings.ToLower(strings.TrimLeft(tag, "/"))
+		if i := strings.IndexFunc(name, func(r rune) bool { return unicode.IsSpace(r) || r == '/' }); i >= 0 {
+			name = name[:i]
+		}
+
+		switch name {
+		case "script", "style", "head", "title":
+			if !closing {
+				if i := indexClosingTag(doc, name); i >= 0 {
+					doc = doc[i:]
+				} else {
+					doc = ""
+				}
+			}
+		case "br":
+			w.newline()
+		case "p", "div", "table", "h1", "h2", "h3", "h4", "h5", "h6", "section", "article", "header", "footer":
+			w.paragraph()
+		case "tr", "dt", "dd":
+			w.block()
+		case "td", "th":
+			w.space = true
+		case "hr":
+			w.block()
+			w.write("----")
+			w.newline()
+		case "pre":
+			w.paragraph()
+			switch {
+			case !closing:
+				w.pre++
+			case w.pre > 0:
+				w.pre--
+			}
+		case "blockquote":
+			w.block()
+			switch {
+			case !closing:
+				w.quote++
+			case w.quote > 0:
+				w.quote--
+			}
+		case "ul", "ol":
+			w.block()
+			switch {
+			case closing && len(lists) > 0:
+				lists = lists[:len(lists)-1]
+			case !closing && name == "ol":
+				lists = append(lists, 1)
+			case !closing:
+				lists = append(lists, -1)
+			}
+		case "li":
+			if closing {
+				break
+			}
+			w.block()
+			marker := "- "
+			depth := len(lists)
+			if depth > 0 && lists[depth-1] > 0 {
+				marker = strconv.Itoa(lists[depth-1]) + ". "
+				lists[depth-1]++
+			}
+			if depth > 1 {
+				marker = strings.Repeat("  ", depth-1) + marker
+			}
+			w.write(marker)
+		case "img":
+			if alt := strings.TrimSpace(attr(altRe, tag)); alt != "" {
+				w.text(" [" + alt + "] ")
+			}
+		case "a":
+			if !closing {
+				links = append(links, link{href: attr(hrefRe, tag), start: w.out.Len()})
+				break
+			}
+			if len(links) == 0 {
+				break
+			}
+			l := links[len(links)-1]
+			links = links[:len(links)-1]
+			text := strings.TrimSpace(w.out.String()[l.start:])
+			href := strings.TrimSpace(l.href)
+			if href == "" || strings.HasPrefix(href, "#") || strings.TrimPrefix(href, "mailto:") == text {
+				break
+			}
+			if text == "" {
+				w.text(href)
+			} else {
+				w.write(" (" + href + ")")
+			}
+			w.space = false
+		}
+	}
+
+	// drop trailing spaces and repeated empty lines
+	var lines []string
+	empty := true
+	for _, line := range strings.Split(w.out.String(), "\n") {
+		line = strings.TrimRightFunc(line, unicode.IsSpace)
+		if strings.TrimSpace(strings.ReplaceAll(line, ">", "")) == "" {
+			if empty {
+				continue
+			}
+			empty = true
+			line = ""
+		} else {
+			empty = false
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// stripQuotedReply removes quoted text, the "On ... wrote:" line introducing
+// it and the signature after the "-- " separator from a classic email.
+func stripQuotedReply(text string) string {
+	lines := strings.Split(text, "\n")
+	var out []string
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.TrimRight(line, "\r") == "-- " || strings.HasPrefix(trimmed, "-----Original Message-----") {
+			break
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		if strings.HasSuffix(trimmed, "wrote:") {
+			quoted := false
+			for _, next := range lines[i+1:] {
+				if next = strings.TrimSpace(next); next != "" {
+					quoted = strings.HasPrefix(next, ">")
+					break
+				}
+			}
+			if quoted {
+				continue
+			}
+		}
+		out = append(out, line)
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
@@ -0,0 +1,51 @@
+package deltachat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTMLToText(t *testing.T) {
+	doc := `<html><head><title>News</title><style>p { color: red; }</style></head>
+<body>
+<p>Hello <b>world</b>&nbsp;&amp; friends,</p>
+<p>read <a href="https://example.org/post">the post</a> or mail <a href="mailto:bob@example.org">bob@example.org</a></p>
+<ul><li>one</li><li>two<ol><li>a</li><li>b</li></ol></li></ul>
+<blockquote>quoted<br>text</blockquote>
+<script>alert("x")</script>
+</body></html>`
+
+	expected := "Hello world & friends,\n" +
+		"\n" +
+		"read the post (https://example.org/post) or mail bob@example.org\n" +
+		"\n" +
+		"- one\n" +
+		"- two\n" +
+		"  1. a\n" +
+		"  2. b\n" +
+		"> quoted\n" +
+		"> text"
+	assert.Equal(t, expected, htmlToText(doc))
+}
+
+func TestStripQuotedReply(t *testing.T) {
+	text := "Sounds good.\n\nOn Mon, 1 Jan 2024, Bob wrote:\n> shall we meet?\n> \n\n-- \nAlice\nExample Inc."
+	assert.Equal(t, "Sounds good.", stripQuotedReply(text))
+
+	assert.Equal(t, "I wrote:\nsomething", stripQuotedReply("I wrote:\nsomething"))
+
+	// only "-- " separates the signature
+	assert.Equal(t, "a\n--\nb", stripQuotedReply("a\n--\nb"))
+	assert.Equal(t, "a", stripQuotedReply("a\r\n-- \r\nsig"))
+}
+
+func TestHTMLToTextUnbalanced(t *testing.T) {
+	assert.Equal(t, "hi\nthere", htmlToText("hi</blockquote>there"))
+	assert.Equal(t, "hi\n\nthere", htmlToText("hi</pre>there"))
+	assert.Equal(t, "> a\n\nb", htmlToText("<blockquote>a</blockquote></blockquote><p>b"))
+	// runes that change their length when lowercased
+	assert.Equal(t, "a", htmlToText("<style>"+strings.Repeat("Ⱥ", 20)+"</style>a"))
+	assert.Equal(t, "a", htmlToText("<STYLE>"+strings.Repeat("İ", 20)+"</Style>a"))
+}
@@ -0,0 +1,132 @@
+package deltachat
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
+	"github.com/deltachat/deltaircd/bridge"
+)
+
+// location as returned by the get_locations RPC call.
+type location struct {
+	LocationId    uint64
+	IsIndependent bool
+	Latitude      float64
+	Longitude     float64
+	Accuracy      float64
+	Timestamp     deltachat.Timestamp
+	ContactId     deltachat.ContactId
+	MsgId         deltachat.MsgId
+	ChatId        deltachat.ChatId
+	Marker        string
+}
+
+// shownLocation is the last live location shown for a contact.
+type shownLocation struct {
+	id uint64
+	at time.Time
+}
+
+// getLocations returns the locations recorded since begin, optionally
+// filtered by chat and contact (0 means no filter).
+func (self *DeltaChat) getLocations(chatId deltachat.ChatId, contactId deltachat.ContactId, begin time.Time) ([]location, error) {
+	var chat, contact interface{}
+	if chatId != 0 {
+		chat = chatId
+	}
+	if contactId != 0 {
+		contact = contactId
+	}
+	var locations []location
+	err := self.account.Manager.Rpc.CallResult(&locations, "get_locations", self.account.Id, chat, contact, begin.Unix(), 0)
+	return locations, err
+}
+
+// msgLocation returns the location attached to a message, or nil.
+func (self *DeltaChat) msgLocation(msgData *deltachat.MsgSnapshot) *location {
+	locations, err := self.getLocations(msgData.ChatId, msgData.FromId, msgData.Timestamp.Add(-time.Hour))
+	if err != nil {
+		logger.Errorf("failed to get location of message %v: %v", msgData.Id, err)
+		return nil
+	}
+	for i := range locations {
+		if locations[i].MsgId == msgData.Id {
+			return &locations[i]
+		}
+	}
+	return nil
+}
+
+// processLiveLocation shows the latest streamed location of a contact, at
+// most once per deltachat.LocationInterval seconds.
+func (self *DeltaChat) processLiveLocation(contactId deltachat.ContactId) {
+	interval := time.Duration(self.cfg.Viper().GetInt(self.Protocol()+".locationinterval")) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	last, shown := self.locationShown[contactId]
+	if shown && time.Since(last.at) < interval {
+		return
+	}
+
+	locations, err := self.getLocations(0, contactId, time.Now().Add(-interval))
+	if err != nil {
+		logger.Errorf("failed to get locations of contact %v: %v", contactId, err)
+		return
+	}
+
+	var latest *location
+	for i := range locations {
+		loc := &locations[i]
+		// independent locations belong to a message and are shown with it
+		if loc.IsIndependent || loc.ChatId == 0 {
+			continue
+		}
+		if latest == nil || loc.Timestamp.After(latest.Timestamp.Time) {
+			latest = loc
+		}
+	}
+	if latest == nil || (shown && latest.LocationId == last.id) {
+		return
+	}
+	self.locationShown[contactId] = shownLocation{id: latest.LocationId, at: time.Now()}
+
+	contact := &deltachat.Contact{self.account, contactId}
+	contactData, err := contact.Snapshot()
+	if err != nil {
+		return
+	}
+	chat := &deltachat.Chat{self.account, latest.ChatId}
+	chatData, err := chat.BasicSnapshot()
+	if err != nil {
+		return
+	}
+
+	ghost := self.getUserInfo(contactData)
+	channelID := strconv.FormatUint(uint64(latest.ChatId), 10)
+	text := "live location: " + formatLocation(latest.Latitude, latest.Longitude)
+
+	if chatData.ChatType == deltachat.ChatSingle {
+		self.sendDirectMessage(ghost, ghost, channelID, "", "", text)
+		return
+	}
+	self.sendEvent(&bridge.Event{
+		Type: "channel_message",
+		Data: &bridge.ChannelMessageEvent{
+			Text:        text,
+			ChannelID:   channelID,
+			Sender:      ghost,
+			MessageType: "notice",
+		},
+	})
+}
+
+// formatLocation returns a geo URI and an OpenStreetMap link for a position.
+func formatLocation(latitude, longitude float64) string {
+	lat := strconv.FormatFloat(latitude, 'f', 6, 64)
+	lon := strconv.FormatFloat(longitude, 'f', 6, 64)
+	return fmt.Sprintf("geo:%s,%s https://www.openstreetmap.org/?mlat=%s&mlon=%s#map=16/%s/%s", lat, lon, lat, lon, lat, lon)
+}
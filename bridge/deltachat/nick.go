@@ -0,0 +1,221 @@
+package deltachat
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
+)
+
+// defaultNickFormat keeps the address as nick, with "|" instead of "@".
+const defaultNickFormat = "{address}"
+
+const nickChars = "[\\w|.\\-\\[\\]\\\\^{}`]+"
+
+var (
+	// mentionRe matches "@nick" in outgoing messages.
+	mentionRe = regexp.MustCompile("(^|\\s)@(" + nickChars + ")")
+	// addressedRe matches "nick:" starting an outgoing message, as IRC
+	// clients complete nicks.
+	addressedRe = regexp.MustCompile("^(" + nickChars + "):(?:\\s|$)")
+)
+
+// reservedNicks are used by deltaircd, contacts with these nicks get their
+// ID appended.
+var reservedNicks = []string{"deltachat", "deltaircd", "system"}
+
+// nickIndex keeps the nicks of the contacts, so contacts that map to the same
+// nick get distinct ones.
+type nickIndex struct {
+	base     map[deltachat.ContactId]string   // lowercased base nick of a contact
+	owners   map[string][]deltachat.ContactId // contacts using a base nick, sorted
+	current  map[deltachat.ContactId]string   // lowercased nick of a contact
+	names    map[string]nickOwner             // lowercased nick to its contact
+	reserved map[string]bool                  // lowercased nicks no contact gets
+}
+
+type nickOwner struct {
+	id          deltachat.ContactId
+	displayName string
+}
+
+func newNickIndex() *nickIndex {
+	index := &nickIndex{
+		base:     make(map[deltachat.ContactId]string),
+		owners:   make(map[string][]deltachat.ContactId),
+		current:  make(map[deltachat.ContactId]string),
+		names:    make(map[string]nickOwner),
+		reserved: make(map[string]bool),
+	}
+	for _, nick := range reservedNicks {
+		index.reserved[nick] = true
+	}
+	return index
+}
+
+// formatNick returns the nick of a contact from the NickFormat template
+// before collisions are resolved.
+func formatNick(format string, contact *deltachat.ContactSnapshot) string {
+	localpart, domain := contact.Address, ""
+	if i := strings.LastIndex(contact.Address, "@"); i >= 0 {
+		localpart, domain = contact.Address[:i], contact.Address[i+1:]
+	}
+	address := strings.ReplaceAll(contact.Address, "@", "|")
+
+	nick := strings.NewReplacer(
+		"{displayname}", contact.DisplayName,
+		"{localpart}", localpart,
+		"{domain}", domain,
+		"{address}", address,
+	).Replace(format)
+	nick = sanitizeNick(strings.Join(strings.Fields(nick), "-"))
+	if strings.Trim(nick, "-") == "" {
+		return address
+	}
+	return nick
+}
+
+// nick returns the nick of a contact: the contact with the lowest ID keeps the
+// formatted nick, others with the same one get their ID appended. Contacts
+// whose nick changes because of this one get a UserUpdateEvent.
+func (self *DeltaChat) nick(contact *deltachat.ContactSnapshot) string {
+	format := self.cfg.Viper().GetString(self.Protocol() + ".nickformat")
+	if format == "" {
+		format = defaultNickFormat
+	}
+
+	self.nickMutex.Lock()
+	nick, changed := self.nicks.add(contact, formatNick(format, contact))
+	self.nickMutex.Unlock()
+
+	for _, id := range changed {
+		other := &deltachat.Contact{self.account, id}
+		if snapshot, err := other.Snapshot(); err == nil {
+			self.updateContact(snapshot)
+		}
+	}
+	return nick
+}
+
+// add registers the contact with its formatted nick and returns its nick and
+// the other contacts whose nick changes. Contacts with a reserved nick or one
+// a contact with a lower ID has get their ID appended, as do contacts whose
+// nick is already used by another contact, e.g. with "bob|20" as display name.
+func (index *nickIndex) add(contact *deltachat.ContactSnapshot, base string) (string, []deltachat.ContactId) {
+	var changed []deltachat.ContactId
+
+	key := strings.ToLower(base)
+	if old, ok := index.base[contact.Id]; ok && old != key {
+		// the next contact with the old nick may get it without ID
+		if owners := index.owners[old]; len(owners) > 1 && owners[0] == contact.Id {
+			changed = append(changed, owners[1])
+		}
+		index.remove(contact.Id, old)
+	}
+	index.base[contact.Id] = key
+	owners := index.owners[key]
+	if i := sort.Search(len(owners), func(i int) bool { return owners[i] >= contact.Id }); i == len(owners) || owners[i] != contact.Id {
+		owners = append(owners, 0)
+		copy(owners[i+1:], owners[i:])
+		owners[i] = contact.Id
+		index.owners[key] = owners
+	}
+
+	nick := base
+	if owners[0] != contact.Id || index.reserved[key] {
+		nick = base + "|" + strconv.FormatUint(uint64(contact.Id), 10)
+	}
+	lower := strings.ToLower(nick)
+	for {
+		owner, ok := index.names[lower]
+		if !ok || owner.id == contact.Id {
+			break
+		}
+		if lower == key && index.base[owner.id] == key {
+			// a contact with a higher ID had the nick, it gets its ID
+			// appended now
+			changed = append(changed, owner.id)
+			break
+		}
+		nick += "|" + strconv.FormatUint(uint64(contact.Id), 10)
+		lower = strings.ToLower(nick)
+	}
+
+	if old, ok := index.current[contact.Id]; ok && old != lower && index.names[old].id == contact.Id {
+		delete(index.names, old)
+	}
+	index.current[contact.Id] = lower
+	index.names[lower] = nickOwner{contact.Id, contact.DisplayName}
+	return nick, changed
+}
+
+func (index *nickIndex) remove(id deltachat.ContactId, key string) {
+	owners := index.owners[key]
+	for i, owner := range owners {
+		if owner == id {
+			owners = append(owners[:i], owners[i+1:]...)
+			break
+		}
+	}
+	if len(owners) == 0 {
+		delete(index.owners, key)
+	} else {
+		index.owners[key] = owners
+	}
+}
+
+// loadNicks registers all contacts, so the nicks don't depend on the order
+// contacts are seen in.
+func (self *DeltaChat) loadNicks() {
+	// the nick of the user, see getUserInfo
+	if addr, err := self.account.GetConfig("addr"); err == nil && addr != "" {
+		self.nickMutex.Lock()
+		self.nicks.reserved[strings.ToLower(strings.ReplaceAll(addr, "@", "|"))] = true
+		self.nickMutex.Unlock()
+	}
+
+	var contacts []*deltachat.ContactSnapshot
+	err := self.account.Manager.Rpc.CallResult(&contacts, "get_contacts", self.account.Id, 0, nil)
+	if err != nil {
+		logger.Errorf("failed to get contacts: %v", err)
+		return
+	}
+	sort.Slice(contacts, func(i, j int) bool { return contacts[i].Id < contacts[j].Id })
+	for _, contact := range contacts {
+		if contact.Id != deltachat.ContactSelf {
+			self.nick(contact)
+		}
+	}
+}
+
+// translateMentions replaces the nicks of contacts mentioned in an outgoing
+// message by their display names, as Delta Chat users don't see the nicks.
+// Only "@nick" and "nick:" starting the message are mentions, other words
+// aren't changed even if they are nicks.
+func (self *DeltaChat) translateMentions(text string) string {
+	self.nickMutex.Lock()
+	defer self.nickMutex.Unlock()
+	return self.nicks.translateMentions(text)
+}
+
+func (index *nickIndex) translateMentions(text string) string {
+	displayName := func(token string) string {
+		// the token may include the full stop ending a sentence
+		nick := strings.TrimRight(token, ".-")
+		owner, ok := index.names[strings.ToLower(nick)]
+		if !ok || owner.displayName == "" {
+			return token
+		}
+		return owner.displayName + token[len(nick):]
+	}
+
+	if m := addressedRe.FindStringSubmatchIndex(text); m != nil {
+		text = displayName(text[m[2]:m[3]]) + text[m[3]:]
+	}
+	return mentionRe.ReplaceAllStringFunc(text, func(mention string) string {
+		at := strings.IndexByte(mention, '@')
+		return mention[:at+1] + displayName(mention[at+1:])
+	})
+}
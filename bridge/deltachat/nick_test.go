@@ -0,0 +1,104 @@
+package deltachat
+
+import (
+	"testing"
+
+	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatNick(t *testing.T) {
+	contact := &deltachat.ContactSnapshot{Address: "alice@example.org", DisplayName: "Alice Smith"}
+	tests := map[string]string{
+		"{address}":              "alice|example.org",
+		"{localpart}":            "alice",
+		"{displayname}":          "Alice-Smith",
+		"{displayname}@{domain}": "Alice-Smith-example.org",
+		"{nothing}":              "{nothing}",
+	}
+	for format, nick := range tests {
+		assert.Equal(t, nick, formatNick(format, contact), format)
+	}
+
+	// an empty nick falls back to the address
+	contact.DisplayName = "@@"
+	assert.Equal(t, "alice|example.org", formatNick("{displayname}", contact))
+}
+
+func TestNickCollisions(t *testing.T) {
+	index := newNickIndex()
+	add := func(contact *deltachat.ContactSnapshot, base string) string {
+		nick, _ := index.add(contact, base)
+		return nick
+	}
+	alice := &deltachat.ContactSnapshot{Id: 12, DisplayName: "Alice"}
+	alice2 := &deltachat.ContactSnapshot{Id: 10, DisplayName: "Alice B."}
+	assert.Equal(t, "alice", add(alice, "alice"))
+	assert.Equal(t, "Alice", add(alice2, "Alice"), "the lowest ID keeps the nick")
+	assert.Equal(t, "alice|12", add(alice, "alice"))
+
+	// a renamed contact frees its nick
+	assert.Equal(t, "ally", add(alice2, "ally"))
+	assert.Equal(t, "alice", add(alice, "alice"))
+
+	// nicks of deltaircd and the user are never given to contacts
+	index.reserved["me|example.org"] = true
+	for _, nick := range []string{"deltachat", "DeltaIRCd", "system", "me|example.org"} {
+		assert.Equal(t, nick+"|20", add(&deltachat.ContactSnapshot{Id: 20}, nick))
+	}
+}
+
+func TestNickChanges(t *testing.T) {
+	index := newNickIndex()
+	bob := &deltachat.ContactSnapshot{Id: 20, DisplayName: "Bob"}
+	other := &deltachat.ContactSnapshot{Id: 10, DisplayName: "Other"}
+	index.add(bob, "bob")
+	index.add(other, "other")
+
+	// a contact with a lower ID renamed to the nick of another contact
+	// takes it, the other one gets its ID appended
+	nick, changed := index.add(other, "bob")
+	assert.Equal(t, "bob", nick)
+	assert.Equal(t, []deltachat.ContactId{20}, changed)
+	nick, changed = index.add(bob, "bob")
+	assert.Equal(t, "bob|20", nick)
+	assert.Empty(t, changed)
+	assert.Equal(t, deltachat.ContactId(10), index.names["bob"].id)
+	assert.Equal(t, deltachat.ContactId(20), index.names["bob|20"].id)
+
+	// renamed again, the nick goes back to the next contact
+	nick, changed = index.add(other, "other")
+	assert.Equal(t, "other", nick)
+	assert.Equal(t, []deltachat.ContactId{20}, changed)
+	nick, _ = index.add(bob, "bob")
+	assert.Equal(t, "bob", nick)
+
+	// a display name that looks like a nick with an ID appended
+	index.add(other, "bob")
+	index.add(bob, "bob")
+	nick, changed = index.add(&deltachat.ContactSnapshot{Id: 5}, "bob|20")
+	assert.Equal(t, "bob|20|5", nick)
+	assert.Empty(t, changed)
+	assert.Equal(t, deltachat.ContactId(20), index.names["bob|20"].id)
+}
+
+func TestTranslateMentions(t *testing.T) {
+	index := newNickIndex()
+	index.add(&deltachat.ContactSnapshot{Id: 10, DisplayName: "Alice Smith"}, "alice")
+	index.add(&deltachat.ContactSnapshot{Id: 11, DisplayName: "Info Desk"}, "info")
+	index.add(&deltachat.ContactSnapshot{Id: 12}, "nodisplay")
+
+	tests := map[string]string{
+		"alice: see you":             "Alice Smith: see you",
+		"ALICE:":                     "Alice Smith:",
+		"thanks @alice.":             "thanks @Alice Smith.",
+		"@info and @alice":           "@Info Desk and @Alice Smith",
+		"for more info ask alice":    "for more info ask alice",
+		"info:tel:123":               "info:tel:123",
+		"mail alice@example.org":     "mail alice@example.org",
+		"@nodisplay hi, @unknown hi": "@nodisplay hi, @unknown hi",
+	}
+	for text, expected := range tests {
+		assert.Equal(t, expected, index.translateMentions(text), text)
+	}
+}
@@ -0,0 +1,34 @@
+package deltachat
+
+import (
+	"time"
+
+	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
+	"github.com/deltachat/deltaircd/metrics"
+)
+
+// timedRpc records the latency and errors of the calls to the RPC server.
+type timedRpc struct {
+	deltachat.Rpc
+}
+
+func (r *timedRpc) Call(method string, params ...interface{}) error {
+	start := time.Now()
+	err := r.Rpc.Call(method, params...)
+	observe(method, start, err)
+	return err
+}
+
+func (r *timedRpc) CallResult(result interface{}, method string, params ...interface{}) error {
+	start := time.Now()
+	err := r.Rpc.CallResult(result, method, params...)
+	observe(method, start, err)
+	return err
+}
+
+func observe(method string, start time.Time, err error) {
+	metrics.RPCLatency.With(method).Observe(time.Since(start))
+	if err != nil {
+		metrics.RPCErrors.Inc()
+	}
+}
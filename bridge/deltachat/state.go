@@ -0,0 +1,215 @@
+package deltachat
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
+	"github.com/deltachat/deltaircd/bridge"
+)
+
+const (
+	// presencePollInterval is how often all contacts are checked, there is
+	// no event when "seen recently" expires.
+	presencePollInterval = time.Minute
+	// reconcileInterval is how often the chat list is compared with the
+	// joined channels, to catch changes we missed events for.
+	reconcileInterval = 5 * time.Minute
+)
+
+// poll keeps the contacts and chats up to date until logout.
+func (self *DeltaChat) poll() {
+	presenceTicker := time.NewTicker(presencePollInterval)
+	defer presenceTicker.Stop()
+	reconcileTicker := time.NewTicker(reconcileInterval)
+	defer reconcileTicker.Stop()
+
+	self.refreshContacts(0)
+	self.reconcileChats()
+	for {
+		select {
+		case <-self.stopPoll:
+			return
+		case <-presenceTicker.C:
+			self.refreshContacts(0)
+		case <-reconcileTicker.C:
+			self.reconcileChats()
+		}
+	}
+}
+
+func presenceStatus(online bool) string {
+	if online {
+		return "online"
+	}
+	return "away"
+}
+
+// refreshContacts updates the online state and the user info of a contact,
+// or of all contacts if contactId is 0.
+func (self *DeltaChat) refreshContacts(contactId deltachat.ContactId) {
+	var contacts []*deltachat.ContactSnapshot
+	if contactId == 0 {
+		err := self.account.Manager.Rpc.CallResult(&contacts, "get_contacts", self.account.Id, 0, nil)
+		if err != nil {
+			logger.Errorf("failed to get contacts: %v", err)
+			return
+		}
+	} else {
+		contact := &deltachat.Contact{self.account, contactId}
+		snapshot, err := contact.Snapshot()
+		if err != nil {
+			return
+		}
+		contacts = append(contacts, snapshot)
+	}
+
+	for _, contact := range contacts {
+		self.updatePresence(contact)
+		self.updateContact(contact)
+	}
+}
+
+// updatePresence stores the online state of a contact and sends a
+// StatusChangeEvent if it changed.
+func (self *DeltaChat) updatePresence(contact *deltachat.ContactSnapshot) {
+	if contact == nil || contact.Id == deltachat.ContactSelf {
+		return
+	}
+
+	self.stateMutex.Lock()
+	online, known := self.presence[contact.Id]
+	self.presence[contact.Id] = contact.WasSeenRecently
+	self.stateMutex.Unlock()
+
+	if !known || online == contact.WasSeenRecently {
+		return
+	}
+	self.sendEvent(&bridge.Event{
+		Type: "status_change",
+		Data: &bridge.StatusChangeEvent{
+			UserID: strconv.FormatUint(uint64(contact.Id), 10),
+			Status: presenceStatus(contact.WasSeenRecently),
+		},
+	})
+}
+
+// updateContact sends a UserUpdateEvent if the user info of a known contact
+// changed, e.g. its display name.
+func (self *DeltaChat) updateContact(contact *deltachat.ContactSnapshot) {
+	if contact == nil || contact.Id == deltachat.ContactSelf {
+		return
+	}
+
+	info := self.getUserInfo(contact)
+	state := info.Nick + "\x00" + info.DisplayName + "\x00" + contact.Address
+
+	self.stateMutex.Lock()
+	old, known := self.contacts[contact.Id]
+	self.contacts[contact.Id] = state
+	self.stateMutex.Unlock()
+
+	if !known || old == state {
+		return
+	}
+	self.sendEvent(&bridge.Event{
+		Type: "user_updated",
+		Data: &bridge.UserUpdateEvent{
+			User: info,
+		},
+	})
+}
+
+// reconcileChats compares the groups we are in with the known ones and sends
+// ChannelCreateEvents and ChannelDeleteEvents for the differences.
+func (self *DeltaChat) reconcileChats() {
+	items, err := self.account.ChatListItems()
+	if err != nil {
+		logger.Errorf("failed to get chat list: %v", err)
+		return
+	}
+	archived, _ := self.account.QueryChatListItems("", nil, uint(deltachat.ChatListFlagArchivedOnly))
+	items = append(items, archived...)
+
+	current := make(map[deltachat.ChatId]bool)
+	for _, item := range items {
+		if item != nil && item.Error == "" && item.IsSelfInGroup && item.DmChatContact == 0 {
+			current[item.Id] = true
+		}
+	}
+
+	self.stateMutex.Lock()
+	initialized := self.chats != nil
+	old := self.chats
+	self.chats = current
+	self.stateMutex.Unlock()
+
+	// the channels of the first chat list are joined on connect
+	if !initialized {
+		return
+	}
+	for id := range current {
+		if !old[id] {
+			self.sendChannelChange(id, true)
+		}
+	}
+	for id := range old {
+		if !current[id] {
+			self.sendChannelChange(id, false)
+		}
+	}
+}
+
+// processChatChanged checks whether we were added to or removed from a group
+// and updates the topic.
+func (self *DeltaChat) processChatChanged(chatId deltachat.ChatId) {
+	chat := &deltachat.Chat{self.account, chatId}
+	snapshot, err := chat.FullSnapshot()
+	inGroup := err == nil && snapshot.ChatType != deltachat.ChatSingle && snapshot.SelfInGroup
+
+	self.stateMutex.Lock()
+	initialized := self.chats != nil
+	known := self.chats[chatId]
+	if initialized {
+		if inGroup {
+			self.chats[chatId] = true
+		} else {
+			delete(self.chats, chatId)
+		}
+	}
+	self.stateMutex.Unlock()
+
+	if initialized && inGroup != known {
+		self.sendChannelChange(chatId, inGroup)
+		return
+	}
+	if inGroup {
+		self.followRename(chatId, snapshot.Name)
+		channelID := strconv.FormatUint(uint64(chatId), 10)
+		self.sendEvent(&bridge.Event{
+			Type: "channel_topic",
+			Data: &bridge.ChannelTopicEvent{
+				Text:      snapshot.Name + chatTopicSuffix(snapshot),
+				ChannelID: channelID,
+				UserID:    self.Protocol(),
+			},
+		})
+	}
+}
+
+func (self *DeltaChat) sendChannelChange(chatId deltachat.ChatId, created bool) {
+	channelID := strconv.FormatUint(uint64(chatId), 10)
+	if created {
+		logger.Debugf("joined chat %v", chatId)
+		self.sendEvent(&bridge.Event{
+			Type: "channel_created",
+			Data: &bridge.ChannelCreateEvent{ChannelID: channelID},
+		})
+		return
+	}
+	logger.Debugf("left chat %v", chatId)
+	self.sendEvent(&bridge.Event{
+		Type: "channel_deleted",
+		Data: &bridge.ChannelDeleteEvent{ChannelID: channelID},
+	})
+}
@@ -2,32 +2,62 @@ package config
 
 import (
 	"fmt"
-	"runtime"
 	"strings"
+	"sync/atomic"
 
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 var Logger *logrus.Entry
 
-func LoadConfig(cfgfile string) (*viper.Viper, error) {
-	v := viper.New()
-	v.SetConfigFile(cfgfile)
+// Config holds the running config. A reload replaces the viper instance as a
+// whole instead of changing it, so it can be read without locking.
+type Config struct {
+	v     atomic.Value // *viper.Viper
+	flags *pflag.FlagSet
+}
+
+func NewConfig(v *viper.Viper) *Config {
+	c := &Config{}
+	c.v.Store(v)
+	return c
+}
+
+// Viper returns the current config, callers must not change it.
+func (c *Config) Viper() *viper.Viper {
+	return c.v.Load().(*viper.Viper)
+}
+
+// BindPFlags binds the command line flags to the config and to the configs
+// loaded by a reload.
+func (c *Config) BindPFlags(flags *pflag.FlagSet) error {
+	c.flags = flags
+	return c.Viper().BindPFlags(flags)
+}
 
+func (c *Config) set(v *viper.Viper) {
+	c.v.Store(v)
+}
+
+// newViper returns a viper instance that reads the environment.
+func newViper() *viper.Viper {
+	v := viper.New()
 	v.SetEnvPrefix("deltaircd")
 	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
 	// use environment variables
 	v.AutomaticEnv()
+	return v
+}
+
+func LoadConfig(cfgfile string) (*viper.Viper, error) {
+	v := newViper()
+	v.SetConfigFile(cfgfile)
 
 	if err := v.ReadInConfig(); err != nil {
 		return nil, fmt.Errorf("error reading config file %s", err)
 	}
 
-	// reload config on file changes
-	if runtime.GOOS != "illumos" {
-		v.WatchConfig()
-	}
-
 	return v, nil
 }
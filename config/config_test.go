@@ -0,0 +1,106 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFileExample(t *testing.T) {
+	// the example config has a .example extension, so copy it
+	raw, err := os.ReadFile("../deltaircd.toml.example")
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "deltaircd.toml")
+	require.NoError(t, os.WriteFile(file, raw, 0o600))
+
+	assert.NoError(t, CheckFile(file))
+}
+
+func TestValidate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "deltaircd.toml")
+	require.NoError(t, os.WriteFile(file, []byte(`bind = "localhost"
+HandshakeTimeout = -1
+[deltachat]
+PartFak = true
+PrefixContext = "yes"
+JoinExclude = ["#ok", "#bad("]
+JoinOnly = "#chan"
+`), 0o600))
+
+	err := CheckFile(file)
+	require.Error(t, err)
+	assert.Equal(t, ValidationError{
+		"bind: address localhost: missing port in address",
+		"deltachat.joinexclude: error parsing regexp: missing closing ): `#bad(`",
+		"deltachat.joinonly: must be an array of strings",
+		"unknown key deltachat.partfak (did you mean deltachat.partfake?)",
+		"deltachat.prefixcontext: must be a bool",
+		"handshaketimeout: must not be negative",
+	}, err)
+}
+
+func TestValidateListeners(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "deltaircd.toml")
+	require.NoError(t, os.WriteFile(file, []byte(`[[listener]]
+address = "/run/deltaircd/irc.sock"
+mode = "0660"
+auth = ["account"]
+
+[[listener]]
+name = "deltaircd.socket"
+
+[[listener]]
+adress = "127.0.0.1:6667"
+mode = "rw"
+auth = ["password", "token"]
+`), 0o600))
+
+	err := CheckFile(file)
+	require.Error(t, err)
+	assert.Equal(t, ValidationError{
+		"listener[2]: unknown key adress (did you mean address?)",
+		`listener[2].auth: unknown auth method "token", use password, account, backup, certfp`,
+		`listener[2].mode: must be an octal file mode like "0660"`,
+		"listener[2]: needs an address, or a name for socket activation",
+	}, err)
+}
+
+func TestValidateWebirc(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "deltaircd.toml")
+	require.NoError(t, os.WriteFile(file, []byte(`[[webirc]]
+name = "kiwiirc"
+password = "secret"
+hosts = ["192.0.2.1", "2001:db8::/32"]
+
+[[webirc]]
+hosts = ["gateway.example.org"]
+`), 0o600))
+
+	err := CheckFile(file)
+	require.Error(t, err)
+	assert.Equal(t, ValidationError{
+		`webirc[1].hosts: "gateway.example.org" is not an IP or CIDR`,
+		"webirc[1]: needs a password",
+	}, err)
+
+	v, err := LoadConfig(file)
+	require.NoError(t, err)
+	out, err := PrintConfig(v)
+	require.NoError(t, err)
+	assert.NotContains(t, out, "secret")
+}
+
+func TestPrintConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "deltaircd.toml")
+	require.NoError(t, os.WriteFile(file, []byte("[deltachat]\nJoinExclude = [\"#a\"]\n"), 0o600))
+	v, err := LoadConfig(file)
+	require.NoError(t, err)
+
+	out, err := PrintConfig(v)
+	require.NoError(t, err)
+	assert.Contains(t, out, "joinexclude = ['#a']")
+	assert.Contains(t, out, "nickformat = '{address}'")
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// Reloader re-reads the config file when it changes or Reload is called. A
+// valid config replaces the running one and the change handlers are called,
+// an invalid one is logged and ignored.
+type Reloader struct {
+	cfg  *Config
+	file string
+
+	mu       sync.Mutex
+	handlers []func(changed []string) error
+}
+
+// NewReloader returns a Reloader for the config file cfg was loaded from.
+func NewReloader(cfg *Config, cfgfile string) *Reloader {
+	return &Reloader{
+		cfg:  cfg,
+		file: cfgfile,
+	}
+}
+
+// OnConfigChange adds a function that is called with the lowercased keys
+// that changed after a new config was applied. If it returns an error the
+// previous config is restored and the handlers are called again.
+func (r *Reloader) OnConfigChange(fn func(changed []string) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers = append(r.handlers, fn)
+}
+
+func readConfigFile(v *viper.Viper, cfgfile string) error {
+	raw, err := os.ReadFile(cfgfile)
+	if err != nil {
+		return err
+	}
+	v.SetConfigType(strings.TrimPrefix(filepath.Ext(cfgfile), "."))
+	if err := v.ReadConfig(bytes.NewReader(raw)); err != nil {
+		return fmt.Errorf("error reading config file %s", err)
+	}
+	return nil
+}
+
+// load returns a new viper instance with the config file, the environment
+// and the command line flags, like the running config. The config file is
+// validated before the flags are added.
+func (r *Reloader) load() (*viper.Viper, error) {
+	v := newViper()
+	if err := readConfigFile(v, r.file); err != nil {
+		return nil, err
+	}
+	if err := Validate(v); err != nil {
+		return nil, err
+	}
+	if r.cfg.flags != nil {
+		if err := v.BindPFlags(r.cfg.flags); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// changedKeys returns the keys that were added, removed or changed.
+func changedKeys(old, next *viper.Viper) []string {
+	keys := make(map[string]bool)
+	for _, key := range append(old.AllKeys(), next.AllKeys()...) {
+		keys[key] = true
+	}
+	var changed []string
+	for key := range keys {
+		if !reflect.DeepEqual(old.Get(key), next.Get(key)) {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Reload reads the config file and applies it if it is valid.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := r.load()
+	if err != nil {
+		Logger.Errorf("keeping the current config, %s is invalid: %v", r.file, err)
+		return err
+	}
+
+	prev := r.cfg.Viper()
+	changed := changedKeys(prev, next)
+	if len(changed) == 0 {
+		return nil
+	}
+	r.cfg.set(next)
+	Logger.Infof("config reloaded, changed: %s", strings.Join(changed, ", "))
+
+	if err := r.runHandlers(changed); err != nil {
+		Logger.Errorf("rolling back the config, it could not be applied: %v", err)
+		r.cfg.set(prev)
+		if err := r.runHandlers(changed); err != nil {
+			Logger.Errorf("failed to restore the previous config: %v", err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *Reloader) runHandlers(changed []string) error {
+	for _, fn := range r.handlers {
+		if err := fn(changed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Watch reloads the config when the file changes.
+func (r *Reloader) Watch() error {
+	if runtime.GOOS == "illumos" {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// watch the directory, editors often replace the file
+	file := filepath.Clean(r.file)
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == file && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					r.Reload() //nolint:errcheck
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				Logger.Errorf("config watcher error: %v", err)
+			}
+		}
+	}()
+	return nil
+}
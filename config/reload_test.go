@@ -0,0 +1,83 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReload(t *testing.T) {
+	Logger = logrus.NewEntry(logrus.New())
+	file := filepath.Join(t.TempDir(), "deltaircd.toml")
+	write := func(content string) {
+		require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+	}
+
+	write("bind = \"127.0.0.1:6667\"\n[deltachat]\nJoinExclude = [\"#a\"]\n")
+	v, err := LoadConfig(file)
+	require.NoError(t, err)
+	cfg := NewConfig(v)
+	r := NewReloader(cfg, file)
+
+	var changed []string
+	r.OnConfigChange(func(keys []string) error {
+		changed = keys
+		return nil
+	})
+
+	write("bind = \"127.0.0.1:6668\"\n[deltachat]\nJoinExclude = [\"#a\"]\nPartFake = true\n")
+	require.NoError(t, r.Reload())
+	assert.Equal(t, []string{"bind", "deltachat.partfake"}, changed)
+	assert.Equal(t, "127.0.0.1:6668", cfg.Viper().GetString("bind"))
+	// the previous config is not changed
+	assert.Equal(t, "127.0.0.1:6667", v.GetString("bind"))
+
+	// invalid configs are not applied
+	changed = nil
+	write("bind = \"127.0.0.1:6669\"\n[deltachat]\nJoinExclude = [\"#a(\"]\n")
+	assert.Error(t, r.Reload())
+	assert.Nil(t, changed)
+	assert.Equal(t, "127.0.0.1:6668", cfg.Viper().GetString("bind"))
+
+	// configs that can't be applied are rolled back
+	r.OnConfigChange(func(keys []string) error {
+		if cfg.Viper().GetString("bind") == "127.0.0.1:6670" {
+			return errors.New("address in use")
+		}
+		return nil
+	})
+	write("bind = \"127.0.0.1:6670\"\n")
+	assert.Error(t, r.Reload())
+	assert.Equal(t, "127.0.0.1:6668", cfg.Viper().GetString("bind"))
+	assert.True(t, cfg.Viper().GetBool("deltachat.partfake"))
+}
+
+func TestReloadWhileReading(t *testing.T) {
+	Logger = logrus.NewEntry(logrus.New())
+	file := filepath.Join(t.TempDir(), "deltaircd.toml")
+	require.NoError(t, os.WriteFile(file, []byte("bind = \"127.0.0.1:6667\"\n"), 0o600))
+	v, err := LoadConfig(file)
+	require.NoError(t, err)
+	cfg := NewConfig(v)
+	r := NewReloader(cfg, file)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			cfg.Viper().GetString("bind")
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, os.WriteFile(file, []byte(fmt.Sprintf("bind = \"127.0.0.1:%d\"\n", 7000+i)), 0o600))
+		require.NoError(t, r.Reload())
+	}
+	<-done
+	assert.Equal(t, "127.0.0.1:7019", cfg.Viper().GetString("bind"))
+}
@@ -0,0 +1,418 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/spf13/viper"
+)
+
+// OptionType is the type of the value of a config key.
+type OptionType int
+
+const (
+	Bool OptionType = iota
+	String
+	Int
+	StringList
+	TableList // an array of tables, e.g. [[listener]]
+)
+
+func (t OptionType) String() string {
+	switch t {
+	case Bool:
+		return "a bool"
+	case String:
+		return "a string"
+	case Int:
+		return "an integer"
+	case TableList:
+		return "an array of tables"
+	default:
+		return "an array of strings"
+	}
+}
+
+// Option describes a config key.
+type Option struct {
+	Type    OptionType
+	Secret  bool                          // masked by --print-config
+	Default interface{}                   // used when the key is not set, if not the zero value
+	Check   func(value interface{}) error // called with the value converted to Type
+	Fields  map[string]Option             // the keys of the tables of a TableList
+}
+
+// Schema are the known config keys, lowercased as viper uses them. Keys of a
+// section are prefixed with its name, e.g. "deltachat.partfake".
+var Schema = map[string]Option{
+	"bind":               {Type: String, Check: checkAddress},
+	"debug":              {Type: Bool},
+	"trace":              {Type: Bool},
+	"gops":               {Type: Bool},
+	"tlsbind":            {Type: String, Check: checkAddress},
+	"tlsdir":             {Type: String},
+	"tlscert":            {Type: String},
+	"tlskey":             {Type: String},
+	"tlsselfsigned":      {Type: Bool},
+	"stsduration":        {Type: Int, Check: checkNotNegative},
+	"stsport":            {Type: Int, Check: checkPort},
+	"handshaketimeout":   {Type: Int, Check: checkNotNegative, Default: int64(10)},
+	"clienttimeout":      {Type: Int, Check: checkNotNegative, Default: int64(60)},
+	"pinginterval":       {Type: Int, Check: checkNotNegative, Default: int64(90)},
+	"sendqueue":          {Type: Int, Check: checkNotNegative, Default: int64(4 << 20)},
+	"writetimeout":       {Type: Int, Check: checkNotNegative, Default: int64(30)},
+	"pastebuffertimeout": {Type: Int, Check: checkNotNegative},
+	"admins":             {Type: StringList},
+	"apibind":            {Type: String, Check: checkAddress},
+	"apitoken":           {Type: String, Secret: true},
+	"metricsbind":        {Type: String, Check: checkAddress},
+	"metricsaddresses":   {Type: Bool},
+
+	"maxconnectionsperip": {Type: Int, Check: checkNotNegative},
+	"maxloginfailures":    {Type: Int, Check: checkNotNegative, Default: int64(5)},
+	"loginlockout":        {Type: Int, Check: checkNotNegative, Default: int64(900)},
+	"floodrate":           {Type: Int, Check: checkNotNegative},
+	"floodburst":          {Type: Int, Check: checkNotNegative, Default: int64(10)},
+
+	"listener": {Type: TableList, Check: checkListeners, Fields: listenerFields},
+	"webirc":   {Type: TableList, Check: checkWebirc, Fields: webircFields},
+
+	"deltachat.accounts":           {Type: String},
+	"deltachat.skipjoinonstart":    {Type: Bool},
+	"deltachat.joinonly":           {Type: StringList, Check: checkRegexps},
+	"deltachat.joininclude":        {Type: StringList, Check: checkRegexps},
+	"deltachat.joinexclude":        {Type: StringList, Check: checkRegexps},
+	"deltachat.restrict":           {Type: StringList},
+	"deltachat.prefixcontext":      {Type: Bool},
+	"deltachat.suffixcontext":      {Type: Bool},
+	"deltachat.showcontextmulti":   {Type: Bool},
+	"deltachat.showmentions":       {Type: Bool},
+	"deltachat.partfake":           {Type: Bool},
+	"deltachat.hidereplies":        {Type: Bool},
+	"deltachat.hidereactions":      {Type: Bool},
+	"deltachat.syntaxhighlighting": {Type: String},
+	"deltachat.locationinterval":   {Type: Int, Check: checkNotNegative, Default: int64(60)},
+	"deltachat.stripquotes":        {Type: Bool},
+	"deltachat.nickformat":         {Type: String, Default: "{address}"},
+	"deltachat.renamechannels":     {Type: Bool},
+}
+
+// listenerFields are the keys of a [[listener]].
+var listenerFields = map[string]Option{
+	"name":    {Type: String}, // the FileDescriptorName with socket activation
+	"address": {Type: String, Check: checkAddress},
+	"tls":     {Type: Bool},
+	"mode":    {Type: String, Check: checkFileMode}, // of a unix socket
+	"owner":   {Type: String},
+	"group":   {Type: String},
+	"auth":    {Type: StringList, Check: checkAuthMethods},
+	"proxy":   {Type: Bool}, // expect a PROXY protocol header
+}
+
+// webircFields are the keys of a [[webirc]] gateway.
+var webircFields = map[string]Option{
+	"name":     {Type: String},
+	"password": {Type: String, Secret: true},
+	"hosts":    {Type: StringList, Check: checkHosts},
+}
+
+func checkAddress(value interface{}) error {
+	addr := value.(string)
+	if addr == "" || strings.ContainsRune(addr, os.PathSeparator) {
+		return nil
+	}
+	_, _, err := net.SplitHostPort(addr)
+	return err
+}
+
+func checkNotNegative(value interface{}) error {
+	if value.(int64) < 0 {
+		return fmt.Errorf("must not be negative")
+	}
+	return nil
+}
+
+func checkPort(value interface{}) error {
+	if port := value.(int64); port < 0 || port > 65535 {
+		return fmt.Errorf("must be a port between 1 and 65535")
+	}
+	return nil
+}
+
+func checkFileMode(value interface{}) error {
+	if value.(string) == "" {
+		return nil
+	}
+	if _, err := strconv.ParseUint(value.(string), 8, 32); err != nil {
+		return fmt.Errorf("must be an octal file mode like \"0660\"")
+	}
+	return nil
+}
+
+// AuthMethods are the ways a listener can allow to log in: with an address
+// and password, to an existing account without a password, by adding a
+// second device with a backup link, or to an existing account with a TLS
+// client certificate registered with the certfp command.
+var AuthMethods = []string{"password", "account", "backup", "certfp"}
+
+func checkAuthMethods(value interface{}) error {
+	for _, method := range value.([]string) {
+		known := false
+		for _, m := range AuthMethods {
+			known = known || m == method
+		}
+		if !known {
+			return fmt.Errorf("unknown auth method %q, use %s", method, strings.Join(AuthMethods, ", "))
+		}
+	}
+	return nil
+}
+
+// checkListeners checks the keys of each [[listener]] against its Fields.
+func checkListeners(value interface{}) error {
+	var errs ValidationError
+	for i, table := range value.([]map[string]interface{}) {
+		prefix := fmt.Sprintf("[%d]", i)
+		errs = append(errs, checkTable(prefix, table, listenerFields)...)
+		if table["address"] == nil && table["name"] == nil {
+			errs = append(errs, prefix+": needs an address, or a name for socket activation")
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkWebirc checks the keys of each [[webirc]], a gateway needs a password.
+func checkWebirc(value interface{}) error {
+	var errs ValidationError
+	for i, table := range value.([]map[string]interface{}) {
+		prefix := fmt.Sprintf("[%d]", i)
+		errs = append(errs, checkTable(prefix, table, webircFields)...)
+		if password, _ := table["password"].(string); password == "" {
+			errs = append(errs, prefix+": needs a password")
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func checkHosts(value interface{}) error {
+	for _, host := range value.([]string) {
+		if _, _, err := net.ParseCIDR(host); err != nil && net.ParseIP(host) == nil {
+			return fmt.Errorf("%q is not an IP or CIDR", host)
+		}
+	}
+	return nil
+}
+
+func checkTable(prefix string, table map[string]interface{}, fields map[string]Option) ValidationError {
+	keys := make([]string, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs ValidationError
+	for _, key := range keys {
+		opt, ok := fields[key]
+		if !ok {
+			msg := fmt.Sprintf("%s: unknown key %s", prefix, key)
+			if suggestion := suggestKey(key, fields); suggestion != "" {
+				msg += fmt.Sprintf(" (did you mean %s?)", suggestion)
+			}
+			errs = append(errs, msg)
+			continue
+		}
+		value, err := opt.Type.convert(table[key])
+		if err == nil && opt.Check != nil {
+			err = opt.Check(value)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s.%s: %v", prefix, key, err))
+		}
+	}
+	return errs
+}
+
+// maskSecrets returns a copy of the tables with the secret fields masked.
+func maskSecrets(tables []map[string]interface{}, fields map[string]Option) []map[string]interface{} {
+	masked := make([]map[string]interface{}, len(tables))
+	for i, table := range tables {
+		masked[i] = make(map[string]interface{}, len(table))
+		for key, value := range table {
+			if fields[key].Secret && value != "" {
+				value = "********"
+			}
+			masked[i][key] = value
+		}
+	}
+	return masked
+}
+
+func checkRegexps(value interface{}) error {
+	for _, entry := range value.([]string) {
+		if _, err := regexp.Compile(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convert returns the value as bool, string, int64 or []string.
+func (t OptionType) convert(value interface{}) (interface{}, error) {
+	switch t {
+	case Bool:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	case String:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	case Int:
+		switch i := value.(type) {
+		case int:
+			return int64(i), nil
+		case int64:
+			return i, nil
+		}
+	case StringList:
+		switch list := value.(type) {
+		case []string:
+			return list, nil
+		case []interface{}:
+			strs := make([]string, 0, len(list))
+			for _, entry := range list {
+				s, ok := entry.(string)
+				if !ok {
+					return nil, fmt.Errorf("must be %s", t)
+				}
+				strs = append(strs, s)
+			}
+			return strs, nil
+		}
+	case TableList:
+		list, ok := value.([]interface{})
+		if !ok {
+			if tables, ok := value.([]map[string]interface{}); ok {
+				return tables, nil
+			}
+			break
+		}
+		tables := make([]map[string]interface{}, 0, len(list))
+		for _, entry := range list {
+			table, ok := entry.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("must be %s", t)
+			}
+			tables = append(tables, table)
+		}
+		return tables, nil
+	}
+	return nil, fmt.Errorf("must be %s", t)
+}
+
+// suggestKey returns the known key closest to an unknown one, or "" if none
+// is similar.
+func suggestKey(key string, schema map[string]Option) string {
+	best, bestDistance := "", 3
+	for known := range schema {
+		if d := editDistance(key, known); d < bestDistance || d == bestDistance && known < best {
+			best, bestDistance = known, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance of two strings.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// PrintConfig returns the effective config as TOML, secrets are masked.
+func PrintConfig(v *viper.Viper) (string, error) {
+	keys := make([]string, 0, len(Schema))
+	for key := range Schema {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	root := make(map[string]interface{})
+	for _, key := range keys {
+		opt := Schema[key]
+		var value interface{}
+		switch opt.Type {
+		case Bool:
+			value = v.GetBool(key)
+		case String:
+			value = v.GetString(key)
+		case Int:
+			value = v.GetInt64(key)
+		case StringList:
+			value = v.GetStringSlice(key)
+		case TableList:
+			tables, _ := opt.Type.convert(v.Get(key))
+			if tables == nil {
+				tables = []map[string]interface{}{}
+			}
+			value = maskSecrets(tables.([]map[string]interface{}), opt.Fields)
+		}
+		if !v.IsSet(key) && opt.Default != nil {
+			value = opt.Default
+		}
+		if opt.Secret && v.GetString(key) != "" {
+			value = "********"
+		}
+
+		section := root
+		parts := strings.Split(key, ".")
+		for _, part := range parts[:len(parts)-1] {
+			next, ok := section[part].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				section[part] = next
+			}
+			section = next
+		}
+		section[parts[len(parts)-1]] = value
+	}
+
+	out, err := toml.Marshal(root)
+	return string(out), err
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// ValidationError lists the problems found in a config.
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// Validate checks a config against the Schema: unknown keys, values of the
+// wrong type and values that can't be used, e.g. invalid regular expressions.
+func Validate(v *viper.Viper) error {
+	var errs ValidationError
+
+	keys := v.AllKeys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		opt, ok := Schema[key]
+		if !ok {
+			msg := "unknown key " + key
+			if suggestion := suggestKey(key, Schema); suggestion != "" {
+				msg += fmt.Sprintf(" (did you mean %s?)", suggestion)
+			}
+			errs = append(errs, msg)
+			continue
+		}
+		value, err := opt.Type.convert(v.Get(key))
+		if err == nil && opt.Check != nil {
+			err = opt.Check(value)
+		}
+		var nested ValidationError
+		switch {
+		case errors.As(err, &nested):
+			for _, msg := range nested {
+				errs = append(errs, key+msg)
+			}
+		case err != nil:
+			errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+
+	if v.GetString("apibind") != "" && v.GetString("apitoken") == "" {
+		errs = append(errs, "apitoken: required when apibind is set")
+	}
+
+	if v.GetString("tlsbind") != "" || hasTLSListener(v) {
+		certPath, keyPath := TLSPaths(v)
+		// TLSSelfSigned generates them on start
+		generate := v.GetBool("tlsselfsigned") && missing(certPath) && missing(keyPath)
+		if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil && !generate {
+			errs = append(errs, fmt.Sprintf("tls: %v", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func missing(path string) bool {
+	_, err := os.Stat(path)
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+func hasTLSListener(v *viper.Viper) bool {
+	tables, _ := TableList.convert(v.Get("listener"))
+	listeners, _ := tables.([]map[string]interface{})
+	for _, listener := range listeners {
+		if tls, _ := listener["tls"].(bool); tls {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckFile reads and validates a config file.
+func CheckFile(cfgfile string) error {
+	v := viper.New()
+	if err := readConfigFile(v, cfgfile); err != nil {
+		return err
+	}
+	return Validate(v)
+}
+
+// TLSPaths returns the certificate and key files from TLSDir, TLSCert and
+// TLSKey.
+func TLSPaths(v *viper.Viper) (string, string) {
+	dir := v.GetString("tlsdir")
+	if dir == "" {
+		dir = "."
+	}
+	certPath := dir + "/cert.pem"
+	keyPath := dir + "/key.pem"
+
+	if v.GetString("tlscert") != "" {
+		certPath = v.GetString("tlscert")
+	}
+
+	if v.GetString("tlskey") != "" {
+		keyPath = v.GetString("tlskey")
+	}
+	return certPath, keyPath
+}
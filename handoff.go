@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	dcbridge "github.com/deltachat/deltaircd/bridge/deltachat"
+	irckit "github.com/deltachat/deltaircd/mm-go-irckit"
+)
+
+// shutdownTimeout is how long the sessions get to flush and log out.
+const shutdownTimeout = 10 * time.Second
+
+// tlsListener is a TLS listener that keeps its socket for the hand-off and
+// for reading a PROXY protocol header before the TLS handshake.
+type tlsListener struct {
+	net.Listener
+	raw    net.Listener
+	config *tls.Config
+}
+
+func newTLSListener(raw net.Listener, config *tls.Config) net.Listener {
+	return &tlsListener{Listener: tls.NewListener(raw, config), raw: raw, config: config}
+}
+
+// inherited are the listeners handed off by the previous process by their
+// listeners key, they are used instead of listening again.
+var inherited = make(map[string]net.Listener)
+
+// inheritListeners takes the listeners passed with DELTAIRCD_LISTEN_FDS and
+// DELTAIRCD_LISTEN_KEYS, the file descriptors start at 3.
+func inheritListeners() error {
+	defer func() {
+		os.Unsetenv("DELTAIRCD_LISTEN_FDS")
+		os.Unsetenv("DELTAIRCD_LISTEN_KEYS")
+	}()
+
+	count, err := strconv.Atoi(os.Getenv("DELTAIRCD_LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil
+	}
+	keys := strings.Split(os.Getenv("DELTAIRCD_LISTEN_KEYS"), ":")
+	if len(keys) != count {
+		return fmt.Errorf("got %d sockets for %d listeners", count, len(keys))
+	}
+	for i, key := range keys {
+		socket, err := fileListener(3+i, key)
+		if err != nil {
+			return fmt.Errorf("socket of %s: %w", key, err)
+		}
+		inherited[key] = socket
+	}
+	return nil
+}
+
+// netListen returns the inherited listener for the key, or listens on the
+// address.
+func netListen(key, network, address string) (net.Listener, error) {
+	if socket, ok := inherited[key]; ok && sameAddress(socket.Addr(), address) {
+		delete(inherited, key)
+		return socket, nil
+	}
+	return net.Listen(network, address)
+}
+
+// sameAddress reports whether a listener is bound to the configured address,
+// "0.0.0.0:6667" is the same as ":6667".
+func sameAddress(addr net.Addr, address string) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr.String() == address
+	}
+	want, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil || want.Port != tcpAddr.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return tcpAddr.IP.IsUnspecified()
+	}
+	return want.IP.Equal(tcpAddr.IP)
+}
+
+// takeInherited removes the inherited listeners with the key prefix.
+func takeInherited(prefix string) map[string]net.Listener {
+	sockets := make(map[string]net.Listener)
+	for key, socket := range inherited {
+		if strings.HasPrefix(key, prefix) {
+			sockets[key] = socket
+			delete(inherited, key)
+		}
+	}
+	return sockets
+}
+
+// closeInherited closes the inherited listeners the config doesn't use
+// anymore.
+func closeInherited() {
+	for key, socket := range inherited {
+		logger.Infof("Closing %s from the previous process, it is not configured anymore", socket.Addr())
+		socket.Close()
+		delete(inherited, key)
+	}
+}
+
+// listenerFile returns a duplicate of the socket of a listener. A unix socket
+// is not removed when the listener is closed afterwards.
+func listenerFile(socket net.Listener) (*os.File, error) {
+	if t, ok := socket.(*tlsListener); ok {
+		socket = t.raw
+	}
+	switch l := socket.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		l.SetUnlinkOnClose(false)
+		return l.File()
+	}
+	return nil, fmt.Errorf("can not hand off a %T", socket)
+}
+
+// stopListening closes all listeners.
+func stopListening() {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	for key, socket := range listeners {
+		socket.Close()
+		delete(listeners, key)
+	}
+}
+
+// shutdown stops accepting connections, closes the sessions after telling
+// the clients and stops the Delta Chat RPC server.
+func shutdown(reason string) {
+	logger.Infof("Shutting down: %s", reason)
+	stopListening()
+	irckit.Shutdown(reason, shutdownTimeout)
+	dcbridge.Shutdown()
+}
+
+// handOff restarts deltaircd, e.g. after an upgrade. Only the listening
+// sockets are passed to the new process: new connections wait in their
+// backlog instead of being refused, but connected clients are disconnected
+// and have to reconnect. The new process starts accepting connections after
+// this one closed the sessions, only one process can use the accounts.
+func handOff() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	listenersMu.Lock()
+	var files []*os.File
+	var keys []string
+	for key, socket := range listeners {
+		file, err := listenerFile(socket)
+		if err != nil {
+			listenersMu.Unlock()
+			closeFiles(files)
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		files = append(files, file)
+		keys = append(keys, key)
+	}
+	listenersMu.Unlock()
+	defer closeFiles(files)
+
+	// the new process waits until the write end is closed
+	wait, done, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer done.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, wait)
+	cmd.Env = append(os.Environ(),
+		"DELTAIRCD_LISTEN_FDS="+strconv.Itoa(len(files)),
+		"DELTAIRCD_LISTEN_KEYS="+strings.Join(keys, ":"),
+		"DELTAIRCD_PARENT_FD="+strconv.Itoa(3+len(files)),
+	)
+	err = cmd.Start()
+	wait.Close()
+	if err != nil {
+		// nothing was stopped yet, keep running
+		return fmt.Errorf("starting %s: %w", exe, err)
+	}
+	logger.Infof("Handing off %d listeners to process %d", len(files), cmd.Process.Pid)
+	sdNotify("MAINPID=" + strconv.Itoa(cmd.Process.Pid))
+
+	shutdown("Server is restarting, please reconnect")
+	return nil
+}
+
+// waitForParent waits until the process that handed off its listeners closed
+// its sessions. Connections wait in the backlog of the inherited sockets
+// meanwhile.
+func waitForParent() {
+	defer os.Unsetenv("DELTAIRCD_PARENT_FD")
+	fd, err := strconv.Atoi(os.Getenv("DELTAIRCD_PARENT_FD"))
+	if err != nil {
+		return
+	}
+	parent := os.NewFile(uintptr(fd), "parent")
+	defer parent.Close()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, parent) //nolint:errcheck
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * shutdownTimeout):
+		logger.Errorf("The previous process didn't stop in %s, starting anyway", 2*shutdownTimeout)
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// handOffSignals restart deltaircd with the same listening sockets.
+var handOffSignals = []os.Signal{syscall.SIGUSR2}
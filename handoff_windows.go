@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// handOffSignals are not supported on windows, sockets can't be inherited.
+var handOffSignals []os.Signal
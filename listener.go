@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/deltachat/deltaircd/config"
+)
+
+// listenerConfig is a [[listener]] of the config.
+type listenerConfig struct {
+	Name    string // FileDescriptorName of a socket passed by systemd
+	Address string
+	TLS     bool
+	Mode    string // of a unix socket, octal
+	Owner   string
+	Group   string
+	Auth    []string // allowed auth methods, all if empty
+	Proxy   bool     // expect a PROXY protocol header
+}
+
+func listenerConfigs() []listenerConfig {
+	var cfgs []listenerConfig
+	if err := conf.Viper().UnmarshalKey("listener", &cfgs); err != nil {
+		logger.Errorf("Invalid listener config: %v", err)
+	}
+	return cfgs
+}
+
+// authMethods returns the auth methods of the [[listener]] with the name,
+// nil allows all.
+func authMethods(name string) []string {
+	for _, cfg := range listenerConfigs() {
+		if cfg.Name == name && len(cfg.Auth) > 0 {
+			return cfg.Auth
+		}
+	}
+	return nil
+}
+
+// listenConfigured starts listening on the addresses of the [[listener]]
+// entries, the listeners of the previous config are closed.
+func listenConfigured() error {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	for key, socket := range listeners {
+		if strings.HasPrefix(key, "listener.") {
+			socket.Close()
+			delete(listeners, key)
+		}
+	}
+
+	for i, cfg := range listenerConfigs() {
+		if cfg.Address == "" || activated[cfg.Name] {
+			// a socket passed by systemd is used instead
+			continue
+		}
+		key := fmt.Sprintf("listener.%d", i)
+		socket, err := listenOn(key, cfg)
+		if err != nil {
+			return fmt.Errorf("can not listen on %s: %w", cfg.Address, err)
+		}
+		listeners[key] = socket
+
+		auth := cfg.Auth
+		if len(auth) == 0 {
+			auth = nil
+		}
+		go start(socket, cfg.Proxy, func() []string { return auth })
+	}
+	return nil
+}
+
+func listenOn(key string, cfg listenerConfig) (net.Listener, error) {
+	network := "tcp"
+	if strings.ContainsRune(cfg.Address, os.PathSeparator) {
+		network = "unix"
+	}
+
+	socket, err := netListen(key, network, cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if err := setSocketPermissions(cfg); err != nil {
+			socket.Close()
+			return nil, err
+		}
+	}
+	if cfg.TLS {
+		tlsConfig, err := serverTLSConfig()
+		if err != nil {
+			socket.Close()
+			return nil, err
+		}
+		socket = newTLSListener(socket, tlsConfig)
+	}
+
+	logger.Infof("Listening on %s (tls: %t, proxy: %t, auth: %s)", cfg.Address, cfg.TLS, cfg.Proxy, describeAuth(cfg.Auth))
+	return socket, nil
+}
+
+func describeAuth(methods []string) string {
+	if len(methods) == 0 {
+		return strings.Join(config.AuthMethods, ", ")
+	}
+	return strings.Join(methods, ", ")
+}
+
+// setSocketPermissions changes the mode and owner of a unix socket.
+func setSocketPermissions(cfg listenerConfig) error {
+	if cfg.Mode != "" {
+		mode, err := strconv.ParseUint(cfg.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid mode %q", cfg.Mode)
+		}
+		if err := os.Chmod(cfg.Address, os.FileMode(mode)); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Owner == "" && cfg.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if cfg.Owner != "" {
+		u, err := user.Lookup(cfg.Owner)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+	}
+	if cfg.Group != "" {
+		g, err := user.LookupGroup(cfg.Group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+	return os.Chown(cfg.Address, uid, gid)
+}
+
+// sdNotify sends a state change to systemd for a Type=notify service, see
+// sd_notify(3).
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		logger.Errorf("Can not notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		logger.Errorf("Can not notify systemd: %v", err)
+	}
+}
+
+// activated are the names of the sockets passed by systemd.
+var activated = make(map[string]bool)
+
+// systemdSockets returns the sockets passed by systemd (LISTEN_FDS) by their
+// listeners key "systemd.<n>.<FileDescriptorName>".
+func systemdSockets() (map[string]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// the passed sockets start at file descriptor 3
+	const listenFdsStart = 3
+	sockets := make(map[string]net.Listener, count)
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		socket, err := fileListener(listenFdsStart+i, name)
+		if err != nil {
+			return sockets, fmt.Errorf("socket %s from systemd: %w", name, err)
+		}
+		sockets[fmt.Sprintf("systemd.%d.%s", i, name)] = socket
+	}
+	return sockets, nil
+}
+
+func fileListener(fd int, name string) (net.Listener, error) {
+	file := os.NewFile(uintptr(fd), name)
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// startActivated accepts connections on the sockets passed by systemd, also
+// when they were handed off by the previous process. The [[listener]] with
+// the same name sets TLS and the auth methods, reloads change the auth
+// methods but the sockets stay open.
+func startActivated() error {
+	sockets, err := systemdSockets()
+	if err != nil {
+		return err
+	}
+	if sockets == nil {
+		sockets = make(map[string]net.Listener)
+	}
+	for key, socket := range takeInherited("systemd.") {
+		sockets[key] = socket
+	}
+
+	for key, socket := range sockets {
+		name := strings.SplitN(key, ".", 3)[2]
+		useTLS, proxy := false, false
+		for _, cfg := range listenerConfigs() {
+			if cfg.Name == name {
+				useTLS, proxy = cfg.TLS, cfg.Proxy
+			}
+		}
+		if useTLS {
+			tlsConfig, err := serverTLSConfig()
+			if err != nil {
+				return err
+			}
+			socket = newTLSListener(socket, tlsConfig)
+		}
+
+		listenersMu.Lock()
+		listeners[key] = socket
+		activated[name] = true
+		listenersMu.Unlock()
+
+		logger.Infof("Listening on %s from systemd (%s, tls: %t, proxy: %t, auth: %s)", socket.Addr(), name, useTLS, proxy, describeAuth(authMethods(name)))
+		go start(socket, proxy, func() []string { return authMethods(name) })
+	}
+	return nil
+}
@@ -2,14 +2,23 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/deltachat/deltaircd/api"
+	dcbridge "github.com/deltachat/deltaircd/bridge/deltachat"
 	"github.com/deltachat/deltaircd/config"
+	"github.com/deltachat/deltaircd/metrics"
 	irckit "github.com/deltachat/deltaircd/mm-go-irckit"
 	"github.com/google/gops/agent"
 	prefixed "github.com/matterbridge/logrus-prefixed-formatter"
@@ -22,17 +31,31 @@ var (
 	version = "0.27.1-dev"
 	githash string
 	logger  *logrus.Entry
-	v       *viper.Viper
+	ourlog  *logrus.Logger
+	conf    *config.Config // replaced as a whole on reload
+
+	reloader *config.Reloader
+	keypair  *keypairReloader
+
+	// running listeners by config key, "bind" or "tlsbind"
+	listenersMu sync.Mutex
+	listeners   = make(map[string]net.Listener)
 )
 
 func main() {
-	ourlog := logrus.New()
+	ourlog = logrus.New()
 	ourlog.Formatter = &prefixed.TextFormatter{
 		PrefixPadding: 10,
 		FullTimestamp: true,
 	}
 	logger = ourlog.WithFields(logrus.Fields{"prefix": "deltaircd"})
 	config.Logger = logger
+	api.Logger = logger
+
+	// offline administration, e.g. "deltaircd account list"
+	if len(os.Args) > 1 && os.Args[1] == "account" {
+		os.Exit(accountCommand(os.Args[2:]))
+	}
 
 	// config related. instantiate a new config.Config to store flags
 	flagConfig := flag.String("conf", "deltaircd.toml", "config file")
@@ -41,6 +64,9 @@ func main() {
 	flag.Bool("version", false, "show version")
 	flag.Bool("debug", false, "enable debug logging")
 
+	flag.Bool("check-config", false, "check the config file and exit")
+	flag.Bool("print-config", false, "print the effective config (secrets masked) and exit")
+
 	// bind related cfg
 	flag.String("bind", "127.0.0.1:6667", "interface:port to bind to, or a path to bind to a Unix socket.")
 
@@ -52,28 +78,54 @@ func main() {
 	pflag.Parse()
 
 	// Attempt to load values from the config file
-	if _, err := os.Stat(*flagConfig); err == nil {
+	v := viper.New()
+	_, err := os.Stat(*flagConfig)
+	hasConfig := err == nil
+	if hasConfig {
 		v, err = config.LoadConfig(*flagConfig)
 		if err != nil {
 			log.Fatal(err)
 		}
-	} else {
-		v = viper.New()
+	}
+	conf = config.NewConfig(v)
+	conf.BindPFlags(pflag.CommandLine)
+	if hasConfig {
+		reloader = config.NewReloader(conf, *flagConfig)
+	}
+
+	if v.GetBool("check-config") {
+		if err := config.CheckFile(*flagConfig); err != nil {
+			printConfigErrors(*flagConfig, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: ok\n", *flagConfig)
+		return
+	}
+
+	if v.GetBool("print-config") {
+		out, err := config.PrintConfig(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(out)
+		return
 	}
 
-	v.BindPFlags(pflag.CommandLine)
+	if reloader != nil {
+		if err := config.CheckFile(*flagConfig); err != nil {
+			printConfigErrors(*flagConfig, err)
+			os.Exit(1)
+		}
+	}
 
 	if v.GetBool("debug") {
 		logger.Info("enabling debug")
-		ourlog.Level = logrus.DebugLevel
-		irckit.SetLogLevel("debug")
 	}
 
 	if v.GetBool("trace") {
 		logger.Info("enabling trace")
-		ourlog.Level = logrus.TraceLevel
-		irckit.SetLogLevel("trace")
 	}
+	setLogLevel()
 
 	if v.GetBool("gops") {
 		if err := agent.Listen(agent.Options{}); err != nil {
@@ -93,90 +145,333 @@ func main() {
 		logger.Infof("WARNING: THIS IS A DEVELOPMENT VERSION. Things may break.")
 	}
 
-	if v.GetString("tlsbind") != "" {
-		go func() {
-			logger.Infof("Listening on %s (TLS)", v.GetString("tlsbind"))
-			socket := tlsbind()
-			defer socket.Close()
-			start(socket)
-		}()
+	if err := inheritListeners(); err != nil {
+		logger.Errorf("Can not use the sockets of the previous process: %v", err)
+	}
+	waitForParent()
+	if err := listenAll(); err != nil {
+		logger.Error(err)
+		os.Exit(1)
+	}
+	sdNotify("READY=1")
+
+	irckit.ChangeLogLevel = changeLogLevel
+	if reloader != nil {
+		irckit.ReloadConfig = reloader.Reload
+		reloader.OnConfigChange(applyConfig)
+		if err := reloader.Watch(); err != nil {
+			logger.Errorf("Can not watch %s for changes: %v", *flagConfig, err)
+		}
+	}
+
+	// reload the config and the TLS certificate on SIGHUP, hand off the
+	// listeners to a new process on SIGUSR2
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	signal.Notify(sigs, handOffSignals...)
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGHUP:
+			logger.Info("Received SIGHUP, reloading config")
+			if reloader != nil {
+				reloader.Reload() //nolint:errcheck
+			}
+			if keypair != nil {
+				if err := keypair.maybeReload(); err != nil {
+					logger.Errorf("Keeping old TLS certificate because the new one could not be loaded: %v", err)
+				}
+			}
+		case syscall.SIGTERM, os.Interrupt:
+			shutdown("Server is shutting down")
+			return
+		default:
+			logger.Infof("Received %s, restarting", sig)
+			if err := handOff(); err != nil {
+				logger.Errorf("Restart failed, keep running: %v", err)
+				continue
+			}
+			return
+		}
 	}
+}
 
-	// backwards compatible
+// listenAll starts all listeners of the config and the sockets passed by
+// systemd or the previous process.
+func listenAll() error {
+	v := conf.Viper()
+	for _, key := range []string{"tlsbind", "bind", "apibind", "metricsbind"} {
+		if err := listen(key); err != nil {
+			return fmt.Errorf("can not listen on %s: %w", v.GetString(key), err)
+		}
+	}
 
-	if v.GetString("bind") != "" {
-		go func() {
-			var network string
-			if strings.ContainsRune(v.GetString("bind"), os.PathSeparator) {
-				network = "unix"
-			} else {
-				network = "tcp"
+	if err := startActivated(); err != nil {
+		return fmt.Errorf("can not use the sockets passed by systemd: %w", err)
+	}
+	if err := listenConfigured(); err != nil {
+		return err
+	}
+	closeInherited()
+	return nil
+}
+
+func printConfigErrors(cfgfile string, err error) {
+	var errs config.ValidationError
+	if !errors.As(err, &errs) {
+		errs = config.ValidationError{err.Error()}
+	}
+	for _, msg := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", cfgfile, msg)
+	}
+}
+
+// applyConfig is called after the config file changed, it updates the log
+// level, listeners and TLS certificate and the running sessions.
+func applyConfig(changed []string) error {
+	v := conf.Viper()
+	isChanged := func(keys ...string) bool {
+		for _, key := range keys {
+			for _, c := range changed {
+				if c == key {
+					return true
+				}
 			}
+		}
+		return false
+	}
 
-			socket, err := net.Listen(network, v.GetString("bind"))
-			if err != nil {
-				logger.Errorf("Can not listen on %s: %v", v.GetString("bind"), err)
-				os.Exit(1)
+	if isChanged("debug", "trace") {
+		setLogLevel()
+	}
+
+	if isChanged("tlsdir", "tlscert", "tlskey") && keypair != nil {
+		if err := keypair.setPaths(config.TLSPaths(v)); err != nil {
+			return fmt.Errorf("TLS certificate: %w", err)
+		}
+		logger.Info("TLS certificate reloaded")
+	}
+
+	for _, key := range []string{"tlsbind", "bind", "apibind", "metricsbind"} {
+		if isChanged(key) {
+			if err := listen(key); err != nil {
+				return fmt.Errorf("can not listen on %s: %w", v.GetString(key), err)
 			}
+		}
+	}
+	if isChanged("listener") {
+		if err := listenConfigured(); err != nil {
+			return err
+		}
+	}
 
-			logger.Infof("Listening on %s", v.GetString("bind"))
+	irckit.ApplyConfig(changed)
+	return nil
+}
 
-			defer socket.Close()
-			start(socket)
-		}()
+func setLogLevel() {
+	v := conf.Viper()
+	switch {
+	case v.GetBool("trace"):
+		changeLogLevel("trace") //nolint:errcheck
+	case v.GetBool("debug"):
+		changeLogLevel("debug") //nolint:errcheck
+	default:
+		changeLogLevel("info") //nolint:errcheck
 	}
+}
 
-	select {}
+// changeLogLevel switches the log level to "info", "debug" or "trace".
+func changeLogLevel(level string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	ourlog.Level = lvl
+	irckit.SetLogLevel(level)
+	dcbridge.SetLogLevel(lvl)
+	return nil
 }
 
-func tlsbind() net.Listener {
-	certPath := v.GetString("tlsdir") + "/cert.pem"
-	keyPath := v.GetString("tlsdir") + "/key.pem"
+// listen starts listening on the address of the "bind", "tlsbind", "apibind"
+// or "metricsbind" key, the listener of the previous address is closed.
+func listen(key string) error {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
 
-	if v.GetString("tlscert") != "" {
-		certPath = v.GetString("tlscert")
+	if old, ok := listeners[key]; ok {
+		old.Close()
+		delete(listeners, key)
 	}
 
-	if v.GetString("tlskey") != "" {
-		keyPath = v.GetString("tlskey")
+	addr := conf.Viper().GetString(key)
+	if addr == "" {
+		return nil
 	}
 
-	kpr, err := NewKeypairReloader(certPath, keyPath)
+	var socket net.Listener
+	var err error
+	if key == "tlsbind" {
+		socket, err = tlsbind()
+	} else {
+		socket, err = bind(key)
+	}
 	if err != nil {
-		logger.Errorf("could not load TLS, incorrect directory? Error: %s", err)
-		os.Exit(1)
+		return err
 	}
 
-	tlsConfig := tls.Config{
-		GetCertificate: kpr.GetCertificateFunc(),
+	listeners[key] = socket
+	switch key {
+	case "apibind":
+		go serveHTTP(socket, api.NewHandler(conf))
+	case "metricsbind":
+		go serveHTTP(socket, metrics.Handler())
+	default:
+		go start(socket, false, nil)
 	}
+	return nil
+}
 
-	listenerTLS, err := tls.Listen("tcp", v.GetString("tlsbind"), &tlsConfig)
+// serveHTTP answers HTTP requests until the listener is closed.
+func serveHTTP(socket net.Listener, handler http.Handler) {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err := srv.Serve(socket); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Errorf("HTTP listener on %s failed: %v", socket.Addr(), err)
+	}
+}
+
+func bind(key string) (net.Listener, error) {
+	v := conf.Viper()
+	var network string
+	if strings.ContainsRune(v.GetString(key), os.PathSeparator) {
+		network = "unix"
+	} else {
+		network = "tcp"
+	}
+
+	socket, err := netListen(key, network, v.GetString(key))
 	if err != nil {
-		logger.Errorf("Can not listen on %s: %v\n", v.GetString("tlsbind"), err)
-		os.Exit(1)
+		return nil, err
+	}
+
+	switch key {
+	case "apibind":
+		logger.Infof("API listening on %s", v.GetString(key))
+	case "metricsbind":
+		logger.Infof("Metrics listening on %s", v.GetString(key))
+	default:
+		logger.Infof("Listening on %s", v.GetString(key))
+	}
+	return socket, nil
+}
+
+// serverTLSConfig returns the TLS config of the listeners, the certificate is
+// loaded on first use.
+func serverTLSConfig() (*tls.Config, error) {
+	if keypair == nil {
+		v := conf.Viper()
+		certPath, keyPath := config.TLSPaths(v)
+		if v.GetBool("tlsselfsigned") {
+			fp, err := generateSelfSigned(certPath, keyPath)
+			if err != nil {
+				return nil, fmt.Errorf("could not generate a self-signed certificate: %w", err)
+			}
+			if fp != "" {
+				logger.Infof("Generated a self-signed certificate %s, fingerprint %s", certPath, fp)
+			}
+		}
+		kpr, err := NewKeypairReloader(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not load TLS, incorrect directory? Error: %w", err)
+		}
+		if err := kpr.watch(); err != nil {
+			logger.Errorf("Can not watch the TLS certificate for changes: %v", err)
+		}
+		keypair = kpr
+	}
+
+	return &tls.Config{
+		GetCertificate: keypair.GetCertificateFunc(),
+		// the fingerprint of a client certificate is used for certfp
+		// logins, it isn't verified against a CA
+		ClientAuth: tls.RequestClientCert,
+	}, nil
+}
+
+func tlsbind() (net.Listener, error) {
+	v := conf.Viper()
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	socket, err := netListen("tlsbind", "tcp", v.GetString("tlsbind"))
+	if err != nil {
+		return nil, err
 	}
 
 	logger.Info("TLS listening on ", v.GetString("tlsbind"))
 
-	return listenerTLS
+	return newTLSListener(socket, tlsConfig), nil
 }
 
-func start(socket net.Listener) {
+// start accepts IRC connections, proxy expects a PROXY protocol header before
+// the IRC or TLS data, auth returns the allowed auth methods of the listener,
+// nil or a nil func allows all.
+func start(socket net.Listener, proxy bool, auth func() []string) {
+	var tlsConfig *tls.Config
+	if t, ok := socket.(*tlsListener); ok && proxy {
+		// the header comes before the TLS handshake
+		socket, tlsConfig = t.raw, t.config
+	}
+
+	var delay time.Duration // after a failed accept, e.g. out of file descriptors
 	for {
 		conn, err := socket.Accept()
-		if err != nil {
-			logger.Errorf("Failed to accept connection: %v", err)
+		if errors.Is(err, net.ErrClosed) {
 			return
 		}
+		if err != nil {
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			logger.Errorf("Failed to accept connection, retrying in %s: %v", delay, err)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
 
 		go func() {
+			if proxy {
+				timeout := conf.Viper().GetInt("HandshakeTimeout")
+				if timeout == 0 {
+					timeout = 10
+				}
+				proxied, err := irckit.NewProxyConn(conn, time.Duration(timeout)*time.Second)
+				if err != nil {
+					logger.Errorf("Invalid PROXY header from %s: %v", conn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+				conn = proxied
+				if tlsConfig != nil {
+					conn = tls.Server(conn, tlsConfig)
+				}
+			}
+
 			newsrv := irckit.ServerConfig{Name: "deltaircd", Version: version}.Server()
 
 			logger.Infof("New connection: %s", conn.RemoteAddr())
 
-			user := irckit.NewUserBridge(conn, newsrv, v)
-			err = newsrv.Connect(user)
+			user := irckit.NewUserBridge(conn, newsrv, conf)
+			if auth != nil {
+				user.SetAuthMethods(auth())
+			}
+			err := newsrv.Connect(user)
 			if err != nil {
 				logger.Errorf("Failed to join: %v", err)
 				return
@@ -0,0 +1,175 @@
+// Package metrics keeps the counters and latencies of the running server.
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// MessagesReceived counts messages relayed from Delta Chat to IRC.
+	MessagesReceived = &Counter{}
+	// MessagesSent counts messages relayed from IRC to Delta Chat.
+	MessagesSent = &Counter{}
+	// EventsDropped counts bridge events that were lost because the session
+	// logged out before they could be queued.
+	EventsDropped = &Counter{}
+	// HandshakeFailures counts IRC clients that didn't complete the handshake.
+	HandshakeFailures = &Counter{}
+	// RPCErrors counts failed calls to the Delta Chat RPC server.
+	RPCErrors = &Counter{}
+	// RPCLatency is the duration of calls to the Delta Chat RPC server by
+	// method.
+	RPCLatency = NewHistogramVec(
+		time.Millisecond, 5*time.Millisecond, 10*time.Millisecond, 25*time.Millisecond,
+		50*time.Millisecond, 100*time.Millisecond, 250*time.Millisecond, 500*time.Millisecond,
+		time.Second, 2500*time.Millisecond, 5*time.Second, 10*time.Second,
+	)
+)
+
+// Counter is a value that only goes up.
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// Histogram counts durations in buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []time.Duration // upper bounds, sorted
+	counts  []uint64        // per bucket, the last one is for larger durations
+	count   uint64
+	sum     time.Duration
+}
+
+func NewHistogram(buckets ...time.Duration) *Histogram {
+	buckets = append([]time.Duration(nil), buckets...)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	i := sort.Search(len(h.buckets), func(i int) bool { return d <= h.buckets[i] })
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+// HistogramVec is a set of histograms with the same buckets, one per value
+// of a label. The values must come from a small set, e.g. method names.
+type HistogramVec struct {
+	buckets []time.Duration
+
+	mu         sync.Mutex
+	histograms map[string]*Histogram
+}
+
+func NewHistogramVec(buckets ...time.Duration) *HistogramVec {
+	return &HistogramVec{
+		buckets:    buckets,
+		histograms: make(map[string]*Histogram),
+	}
+}
+
+// With returns the histogram for a label value.
+func (v *HistogramVec) With(label string) *Histogram {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.histograms[label]
+	if !ok {
+		h = NewHistogram(v.buckets...)
+		v.histograms[label] = h
+	}
+	return h
+}
+
+// Snapshots returns the snapshots by label value.
+func (v *HistogramVec) Snapshots() map[string]HistogramSnapshot {
+	v.mu.Lock()
+	histograms := make(map[string]*Histogram, len(v.histograms))
+	for label, h := range v.histograms {
+		histograms[label] = h
+	}
+	v.mu.Unlock()
+
+	snapshots := make(map[string]HistogramSnapshot, len(histograms))
+	for label, h := range histograms {
+		snapshots[label] = h.Snapshot()
+	}
+	return snapshots
+}
+
+// Total returns the sum of all histograms.
+func (v *HistogramVec) Total() HistogramSnapshot {
+	total := NewHistogram(v.buckets...).Snapshot()
+	for _, s := range v.Snapshots() {
+		for i := range s.Counts {
+			total.Counts[i] += s.Counts[i]
+		}
+		total.Count += s.Count
+		total.Sum += s.Sum
+	}
+	return total
+}
+
+// HistogramSnapshot is the state of a Histogram at one point in time.
+type HistogramSnapshot struct {
+	Buckets []time.Duration
+	Counts  []uint64 // cumulative count of durations <= the bucket
+	Count   uint64
+	Sum     time.Duration
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := HistogramSnapshot{
+		Buckets: h.buckets,
+		Counts:  make([]uint64, len(h.buckets)),
+		Count:   h.count,
+		Sum:     h.sum,
+	}
+	var total uint64
+	for i := range h.buckets {
+		total += h.counts[i]
+		s.Counts[i] = total
+	}
+	return s
+}
+
+// Mean returns the average duration.
+func (s HistogramSnapshot) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.Count)
+}
+
+// Quantile returns the upper bound of the bucket that contains the q
+// quantile, e.g. 0.99. Durations larger than all buckets give the last one.
+func (s HistogramSnapshot) Quantile(q float64) time.Duration {
+	if s.Count == 0 || len(s.Buckets) == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(s.Count))
+	for i, count := range s.Counts {
+		if count >= rank && count > 0 {
+			return s.Buckets[i]
+		}
+	}
+	return s.Buckets[len(s.Buckets)-1]
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram(10*time.Millisecond, time.Millisecond, 100*time.Millisecond)
+	for _, d := range []time.Duration{500 * time.Microsecond, 2 * time.Millisecond, 3 * time.Millisecond, 50 * time.Millisecond, time.Second} {
+		h.Observe(d)
+	}
+
+	s := h.Snapshot()
+	assert.Equal(t, []time.Duration{time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond}, s.Buckets)
+	assert.Equal(t, []uint64{1, 3, 4}, s.Counts)
+	assert.Equal(t, uint64(5), s.Count)
+	assert.Equal(t, 211100*time.Microsecond, s.Mean())
+	assert.Equal(t, 10*time.Millisecond, s.Quantile(0.5))
+	assert.Equal(t, 100*time.Millisecond, s.Quantile(0.99))
+}
+
+func TestWritePrometheus(t *testing.T) {
+	// start with empty metrics, so the test can run more than once
+	latency, funcs := RPCLatency, gauges.funcs
+	defer func() { RPCLatency, gauges.funcs = latency, funcs }()
+	RPCLatency = NewHistogramVec(latency.buckets...)
+
+	RPCLatency.With("get_chat").Observe(3 * time.Millisecond)
+	RPCLatency.With("get_chat").Observe(2 * time.Second)
+	RegisterGaugeFunc("test_connectivity", "A test gauge.", func() []Sample {
+		return []Sample{{Labels: map[string]string{"state": "connected", "account": "a\"b"}, Value: 1}}
+	})
+
+	var out strings.Builder
+	assert.NoError(t, WritePrometheus(&out))
+	for _, line := range []string{
+		"# TYPE deltaircd_messages_relayed_total counter",
+		`deltaircd_messages_relayed_total{direction="to_irc"} 0`,
+		"# TYPE deltaircd_rpc_duration_seconds histogram",
+		`deltaircd_rpc_duration_seconds_bucket{le="0.001",method="get_chat"} 0`,
+		`deltaircd_rpc_duration_seconds_bucket{le="0.005",method="get_chat"} 1`,
+		`deltaircd_rpc_duration_seconds_bucket{le="+Inf",method="get_chat"} 2`,
+		`deltaircd_rpc_duration_seconds_sum{method="get_chat"} 2.003`,
+		`deltaircd_rpc_duration_seconds_count{method="get_chat"} 2`,
+		"# HELP test_connectivity A test gauge.",
+		`test_connectivity{account="a\"b",state="connected"} 1`,
+	} {
+		assert.Contains(t, out.String(), line+"\n")
+	}
+}
@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Sample is a value of a gauge with its labels.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+type gaugeFunc struct {
+	name, help string
+	fn         func() []Sample
+}
+
+var gauges struct {
+	sync.Mutex
+	funcs []gaugeFunc
+}
+
+// RegisterGaugeFunc adds a gauge whose samples are collected by fn for every
+// scrape. The labels must have a small set of values.
+func RegisterGaugeFunc(name, help string, fn func() []Sample) {
+	gauges.Lock()
+	defer gauges.Unlock()
+	gauges.funcs = append(gauges.funcs, gaugeFunc{name: name, help: help, fn: fn})
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WritePrometheus(w) //nolint:errcheck
+	})
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format.
+func WritePrometheus(out io.Writer) error {
+	w := bufio.NewWriter(out)
+
+	header(w, "deltaircd_messages_relayed_total", "counter", "Messages relayed between IRC and Delta Chat.")
+	sample(w, "deltaircd_messages_relayed_total", map[string]string{"direction": "to_irc"}, float64(MessagesReceived.Value()))
+	sample(w, "deltaircd_messages_relayed_total", map[string]string{"direction": "to_deltachat"}, float64(MessagesSent.Value()))
+
+	counter(w, "deltaircd_events_dropped_total", "Bridge events lost because the session logged out.", EventsDropped)
+	counter(w, "deltaircd_handshake_failures_total", "IRC clients that didn't complete the handshake.", HandshakeFailures)
+	counter(w, "deltaircd_rpc_errors_total", "Failed calls to the Delta Chat RPC server.", RPCErrors)
+
+	header(w, "deltaircd_rpc_duration_seconds", "histogram", "Duration of calls to the Delta Chat RPC server.")
+	snapshots := RPCLatency.Snapshots()
+	methods := make([]string, 0, len(snapshots))
+	for method := range snapshots {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		histogram(w, "deltaircd_rpc_duration_seconds", "method", method, snapshots[method])
+	}
+
+	gauges.Lock()
+	funcs := append([]gaugeFunc(nil), gauges.funcs...)
+	gauges.Unlock()
+	for _, g := range funcs {
+		header(w, g.name, "gauge", g.help)
+		for _, s := range g.fn() {
+			sample(w, g.name, s.Labels, s.Value)
+		}
+	}
+
+	return w.Flush()
+}
+
+func header(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func counter(w io.Writer, name, help string, c *Counter) {
+	header(w, name, "counter", help)
+	sample(w, name, nil, float64(c.Value()))
+}
+
+func histogram(w io.Writer, name, label, value string, s HistogramSnapshot) {
+	for i, bucket := range s.Buckets {
+		labels := map[string]string{label: value, "le": formatFloat(bucket.Seconds())}
+		sample(w, name+"_bucket", labels, float64(s.Counts[i]))
+	}
+	sample(w, name+"_bucket", map[string]string{label: value, "le": "+Inf"}, float64(s.Count))
+	sample(w, name+"_sum", map[string]string{label: value}, s.Sum.Seconds())
+	sample(w, name+"_count", map[string]string{label: value}, float64(s.Count))
+}
+
+func sample(w io.Writer, name string, labels map[string]string, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels), formatFloat(value))
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"="+quote(labels[name]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quote(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
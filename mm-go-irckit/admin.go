@@ -0,0 +1,151 @@
+package irckit
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deltachat/deltaircd/metrics"
+	"github.com/sorcix/irc"
+)
+
+// Hooks into the running process for the admin commands, set by main.
+var (
+	// ReloadConfig reloads the config file.
+	ReloadConfig func() error
+	// ChangeLogLevel switches the log level to "info", "debug" or "trace".
+	ChangeLogLevel func(level string) error
+)
+
+var started = time.Now()
+
+// adminCmds are the commands of the deltaircd service, only the accounts
+// listed in Admins may use them.
+var adminCmds = map[string]Command{
+	"broadcast": {handler: adminBroadcast, login: true, minParams: 1, maxParams: 1, raw: true},
+	"kill":      {handler: adminKill, login: true, minParams: 1, maxParams: 1},
+	"loglevel":  {handler: adminLogLevel, login: true, minParams: 1, maxParams: 1},
+	"reload":    {handler: adminReload, login: true, minParams: 0, maxParams: 0},
+	"stats":     {handler: adminStats, login: true, minParams: 0, maxParams: 0},
+	"version":   {handler: adminVersion, login: true, minParams: 0, maxParams: 0},
+	"who":       {handler: adminWho, login: true, minParams: 0, maxParams: 0},
+}
+
+func (u *User) isAdmin() bool {
+	address := u.Account()
+	if address == "" {
+		return false
+	}
+	for _, admin := range u.v().GetStringSlice("admins") {
+		if strings.EqualFold(admin, address) {
+			return true
+		}
+	}
+	return false
+}
+
+func adminWho(u *User, toUser *User, args []string, service string) {
+	for _, other := range Sessions() {
+		account := other.Account()
+		if account == "" {
+			account = "(not logged in)"
+		}
+		remote := "-"
+		if addr := other.RemoteAddr(); addr != nil {
+			remote = addr.String()
+		}
+		u.MsgUser(toUser, fmt.Sprintf("%d: %s from %s as %s, connected %s ago",
+			other.SessionID(), other.Nick, remote, account, time.Since(other.connectedAt).Round(time.Second)))
+	}
+}
+
+func adminKill(u *User, toUser *User, args []string, service string) {
+	id, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		u.MsgUser(toUser, "need KILL <session>, see WHO for the sessions")
+		return
+	}
+	for _, other := range Sessions() {
+		if other.SessionID() != id {
+			continue
+		}
+		logger.Infof("session %d (%s) killed by %s", id, other.Nick, u.Nick)
+		other.Encode(&irc.Message{ //nolint:errcheck
+			Command:  irc.ERROR,
+			Trailing: "Closing Link: killed by admin",
+		})
+		// the session quits when its connection is closed
+		other.Conn.Close()
+		u.MsgUser(toUser, fmt.Sprintf("session %d killed", id))
+		return
+	}
+	u.MsgUser(toUser, fmt.Sprintf("no session %d", id))
+}
+
+func adminReload(u *User, toUser *User, args []string, service string) {
+	if ReloadConfig == nil {
+		u.MsgUser(toUser, "no config file to reload")
+		return
+	}
+	if err := ReloadConfig(); err != nil {
+		u.MsgUser(toUser, "config could not be reloaded: "+err.Error())
+		return
+	}
+	u.MsgUser(toUser, "config reloaded")
+}
+
+func adminVersion(u *User, toUser *User, args []string, service string) {
+	u.MsgUser(toUser, fmt.Sprintf("deltaircd %s (%s), up %s",
+		u.Srv.Version(), runtime.Version(), time.Since(started).Round(time.Second)))
+}
+
+func adminStats(u *User, toUser *User, args []string, service string) {
+	sessions := Sessions()
+	queued := 0
+	for _, other := range sessions {
+		queued += len(other.eventChan)
+	}
+	rpc := metrics.RPCLatency.Total()
+
+	u.MsgUser(toUser, fmt.Sprintf("sessions: %d, events queued: %d", len(sessions), queued))
+	u.MsgUser(toUser, fmt.Sprintf("messages relayed: %d to IRC, %d to Delta Chat",
+		metrics.MessagesReceived.Value(), metrics.MessagesSent.Value()))
+	u.MsgUser(toUser, fmt.Sprintf("RPC calls: %d, errors: %d, latency: mean %s, p50 <= %s, p99 <= %s",
+		rpc.Count, metrics.RPCErrors.Value(), rpc.Mean().Round(time.Microsecond), rpc.Quantile(0.5), rpc.Quantile(0.99)))
+}
+
+func adminBroadcast(u *User, toUser *User, args []string, service string) {
+	sessions := Sessions()
+	for _, other := range sessions {
+		from := other.Srv.Prefix()
+		if service, ok := other.Srv.HasUser("deltaircd"); ok {
+			from = service.Prefix()
+		}
+		other.Encode(&irc.Message{ //nolint:errcheck
+			Prefix:   from,
+			Command:  irc.NOTICE,
+			Params:   []string{other.Nick},
+			Trailing: args[0],
+		})
+	}
+	u.MsgUser(toUser, fmt.Sprintf("sent to %d sessions", len(sessions)))
+}
+
+func adminLogLevel(u *User, toUser *User, args []string, service string) {
+	level := strings.ToLower(args[0])
+	switch {
+	case level != "info" && level != "debug" && level != "trace":
+		u.MsgUser(toUser, "need LOGLEVEL info|debug|trace")
+	case ChangeLogLevel == nil:
+		u.MsgUser(toUser, "the log level can not be changed")
+	default:
+		if err := ChangeLogLevel(level); err != nil {
+			u.MsgUser(toUser, "log level could not be changed: "+err.Error())
+			return
+		}
+		logger.Infof("log level changed to %s by %s", level, u.Nick)
+		u.MsgUser(toUser, "log level is now "+level)
+	}
+}
@@ -0,0 +1,85 @@
+package irckit
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// certFPKey is the setting with the registered client certificates of the
+// account, separated by spaces.
+const certFPKey = "certfp"
+
+// CertFP returns the SHA-256 fingerprint of the TLS client certificate, empty
+// if the client didn't send one.
+func (u *User) CertFP() string {
+	if u.Conn == nil {
+		return ""
+	}
+	return certFP(u.TLSState())
+}
+
+func validCertFP(fp string) bool {
+	b, err := hex.DecodeString(fp)
+	return err == nil && len(b) == 32
+}
+
+// certfp shows and changes the client certificates that may log in to the
+// account without a password: CERTFP [ADD [<fingerprint>] | DEL <fingerprint>]
+func certfp(u *User, toUser *User, args []string, service string) {
+	registered, _ := u.setting(certFPKey)
+	fps := strings.Fields(registered)
+
+	if len(args) == 0 {
+		if fp := u.CertFP(); fp != "" {
+			u.MsgUser(toUser, "this connection uses the certificate "+fp)
+		} else {
+			u.MsgUser(toUser, "this connection doesn't use a client certificate")
+		}
+		if len(fps) == 0 {
+			u.MsgUser(toUser, "no certificates are registered, use CERTFP ADD")
+		}
+		for _, fp := range fps {
+			u.MsgUser(toUser, "registered: "+fp)
+		}
+		return
+	}
+
+	fp := ""
+	if len(args) > 1 {
+		fp = strings.ToLower(strings.ReplaceAll(args[1], ":", ""))
+	}
+	switch strings.ToLower(args[0]) {
+	case "add":
+		if fp == "" {
+			fp = u.CertFP()
+		}
+		if fp == "" {
+			u.MsgUser(toUser, "this connection doesn't use a client certificate, need CERTFP ADD <fingerprint>")
+			return
+		}
+		if !validCertFP(fp) {
+			u.MsgUser(toUser, "a fingerprint is the SHA-256 hash of the certificate in hex")
+			return
+		}
+		if stringInSlice(fp, fps) {
+			u.MsgUser(toUser, fp+" is already registered")
+			return
+		}
+		fps = append(fps, fp)
+	case "del":
+		if !stringInSlice(fp, fps) {
+			u.MsgUser(toUser, "need CERTFP DEL <fingerprint> of a registered certificate")
+			return
+		}
+		fps = removeStringInSlice(fp, fps)
+	default:
+		u.MsgUser(toUser, "need CERTFP [ADD [<fingerprint>] | DEL <fingerprint>]")
+		return
+	}
+
+	if err := u.storeSetting(certFPKey, strings.Join(fps, " ")); err != nil {
+		u.MsgUser(toUser, "certificates could not be changed: "+err.Error())
+		return
+	}
+	u.MsgUser(toUser, "registered certificates: "+strings.Join(fps, " "))
+}
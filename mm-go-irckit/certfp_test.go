@@ -0,0 +1,67 @@
+package irckit
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testCertificate(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertFP(t *testing.T) {
+	serverCert := testCertificate(t, "server")
+	clientCert := testCertificate(t, "client")
+
+	for _, withCert := range []bool{true, false} {
+		clientConn, serverConn := net.Pipe()
+		server := tls.Server(serverConn, &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequestClientCert,
+		})
+		clientConfig := &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+		if withCert {
+			clientConfig.Certificates = []tls.Certificate{clientCert}
+		}
+		client := tls.Client(clientConn, clientConfig)
+		go client.Handshake() //nolint:errcheck
+		require.NoError(t, server.Handshake())
+
+		u := NewUserNet(server)
+		if withCert {
+			sum := sha256.Sum256(clientCert.Certificate[0])
+			assert.Equal(t, hex.EncodeToString(sum[:]), u.CertFP())
+		} else {
+			assert.Empty(t, u.CertFP())
+		}
+		client.Close()
+		server.Close()
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	assert.Empty(t, NewUserNet(serverConn).CertFP())
+}
@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/deltachat/deltaircd/bridge"
 	"github.com/muesli/reflow/wordwrap"
 	"github.com/sorcix/irc"
 )
@@ -65,6 +66,10 @@ type Channel interface {
 	// String returns the name of the channel
 	String() string
 
+	// Rename changes the name of the channel, use Server.RenameChannel to
+	// keep the server's storage up to date.
+	Rename(name string)
+
 	// Spoof message
 	SpoofMessage(from string, text string, maxlen ...int)
 
@@ -72,6 +77,18 @@ type Channel interface {
 	SpoofNotice(from string, text string, maxlen ...int)
 
 	IsPrivate() bool
+
+	// HasMode returns whether the given channel mode is set.
+	HasMode(mode string) bool
+
+	// Modes returns the channel modes and their parameters, e.g. "+En 1d".
+	Modes() string
+
+	// GetModes returns a copy of the set channel modes and their parameters.
+	GetModes() map[string]string
+
+	// SetModes replaces the channel modes and sends the changes as MODE.
+	SetModes(from Prefixer, modes map[string]string)
 }
 
 type channel struct {
@@ -80,7 +97,7 @@ type channel struct {
 	server  Server
 	id      string
 	service string
-	private bool
+	modes   map[string]string // set modes and their parameter
 
 	mu       sync.RWMutex
 	topic    string
@@ -88,14 +105,14 @@ type channel struct {
 }
 
 // NewChannel returns a Channel implementation for a given Server.
-func NewChannel(server Server, channelID string, name string, service string, modes map[string]bool) Channel {
+func NewChannel(server Server, channelID string, name string, service string, modes map[string]string) Channel {
 	return &channel{
 		created:  time.Now(),
 		server:   server,
 		id:       channelID,
 		name:     name,
 		service:  service,
-		private:  modes["p"],
+		modes:    modes,
 		usersIdx: make(map[string]*User),
 	}
 }
@@ -116,6 +133,60 @@ func (ch *channel) String() string {
 	return ch.name
 }
 
+// Rename changes the name of the channel. Users that requested the
+// draft/channel-rename capability get a RENAME, the others see the channel
+// being parted and joined again.
+// https://ircv3.net/specs/extensions/channel-rename
+func (ch *channel) Rename(name string) {
+	ch.mu.Lock()
+	old := ch.name
+	ch.name = name
+	topic := ch.topic
+	var users []*User
+	for _, u := range ch.usersIdx {
+		if !u.Ghost {
+			users = append(users, u)
+		}
+	}
+	ch.mu.Unlock()
+
+	if old == name {
+		return
+	}
+
+	for _, u := range users {
+		if u.HasCap("draft/channel-rename") {
+			u.Encode(&irc.Message{
+				Prefix:   ch.Prefix(),
+				Command:  "RENAME",
+				Params:   []string{old, name},
+				Trailing: "Channel renamed",
+			})
+			continue
+		}
+
+		u.Encode(&irc.Message{
+			Prefix:   u.Prefix(),
+			Command:  irc.PART,
+			Params:   []string{old},
+			Trailing: "Channel renamed to " + name,
+		}, &irc.Message{
+			Prefix:  u.Prefix(),
+			Command: irc.JOIN,
+			Params:  []string{name},
+		})
+		if topic != "" {
+			u.Encode(&irc.Message{
+				Prefix:   ch.Prefix(),
+				Command:  irc.RPL_TOPIC,
+				Params:   []string{u.Nick, name},
+				Trailing: topic,
+			})
+		}
+		ch.SendNamesResponse(u)
+	}
+}
+
 // Created returns the time when the Channel was created.
 func (ch *channel) Created() time.Time {
 	return ch.created
@@ -466,8 +537,119 @@ func (ch *channel) SpoofNotice(from string, text string, maxlen ...int) {
 }
 
 func (ch *channel) IsPrivate() bool {
+	return ch.HasMode("p")
+}
+
+func (ch *channel) HasMode(mode string) bool {
 	ch.mu.RLock()
 	defer ch.mu.RUnlock()
 
-	return ch.private
+	_, ok := ch.modes[mode]
+	return ok
+}
+
+func (ch *channel) Modes() string {
+	return formatModes(ch.GetModes())
+}
+
+func (ch *channel) GetModes() map[string]string {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	modes := make(map[string]string, len(ch.modes))
+	for mode, param := range ch.modes {
+		modes[mode] = param
+	}
+	return modes
+}
+
+func (ch *channel) SetModes(from Prefixer, modes map[string]string) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	var added, removed []string
+	var params []string
+	for _, mode := range sortedModes(modes) {
+		if param, ok := ch.modes[mode]; !ok || param != modes[mode] {
+			added = append(added, mode)
+			if modes[mode] != "" {
+				params = append(params, modes[mode])
+			}
+		}
+	}
+	for _, mode := range sortedModes(ch.modes) {
+		if _, ok := modes[mode]; !ok {
+			removed = append(removed, mode)
+		}
+	}
+	ch.modes = modes
+
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	change := ""
+	if len(added) > 0 {
+		change += "+" + strings.Join(added, "")
+	}
+	if len(removed) > 0 {
+		change += "-" + strings.Join(removed, "")
+	}
+	msg := &irc.Message{
+		Prefix:  from.Prefix(),
+		Command: irc.MODE,
+		Params:  append([]string{ch.name, change}, params...),
+	}
+
+	for _, to := range ch.usersIdx {
+		if !to.Ghost {
+			to.Encode(msg)
+		}
+	}
+}
+
+func sortedModes(modes map[string]string) []string {
+	letters := make([]string, 0, len(modes))
+	for mode := range modes {
+		letters = append(letters, mode)
+	}
+	sort.Strings(letters)
+	return letters
+}
+
+// formatModes returns the modes as sent in RPL_CHANNELMODEIS, e.g. "+En 1d".
+func formatModes(modes map[string]string) string {
+	letters := sortedModes(modes)
+	text := "+" + strings.Join(letters, "")
+	for _, mode := range letters {
+		if modes[mode] != "" {
+			text += " " + modes[mode]
+		}
+	}
+	return text
+}
+
+// channelModes returns the IRC channel modes of a bridge channel:
+// p private, m read-only, n mailing or broadcast list, M muted, P pinned,
+// A archived, V protected (verified) and E the ephemeral timer.
+func channelModes(info *bridge.ChannelInfo) map[string]string {
+	modes := make(map[string]string)
+	flags := map[string]bool{
+		"p": info.Private,
+		"m": info.ReadOnly,
+		"n": info.MailingList || info.Broadcast,
+		"M": info.Muted,
+		"P": info.Pinned,
+		"A": info.Archived,
+		"V": info.Protected,
+	}
+	for mode, set := range flags {
+		if set {
+			modes[mode] = ""
+		}
+	}
+	if info.EphemeralTimer > 0 {
+		modes["E"] = formatDuration(info.EphemeralTimer)
+	}
+	return modes
 }
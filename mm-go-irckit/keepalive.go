@@ -0,0 +1,75 @@
+package irckit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// activity is when a message was last received from the client.
+type activity struct {
+	sync.Mutex
+	last time.Time
+}
+
+func (a *activity) touch() {
+	a.Lock()
+	a.last = time.Now()
+	a.Unlock()
+}
+
+func (a *activity) since() time.Duration {
+	a.Lock()
+	defer a.Unlock()
+	return time.Since(a.last)
+}
+
+// keepalive sends a PING when the client was quiet for PingInterval seconds
+// and disconnects it if nothing arrives within ClientTimeout seconds, so dead
+// connections are noticed. It returns when done is closed.
+func (s *server) keepalive(u *User, done <-chan struct{}) {
+	var pingedAt time.Time
+	for {
+		interval := time.Duration(configInt(u.v(), "PingInterval", 90)) * time.Second
+		timeout := time.Duration(configInt(u.v(), "ClientTimeout", 60)) * time.Second
+		if interval <= 0 {
+			interval = 90 * time.Second
+		}
+
+		idle := u.activity.since()
+		next := interval - idle
+		switch {
+		case idle < interval:
+			pingedAt = time.Time{}
+		case pingedAt.IsZero():
+			pingedAt = time.Now()
+			s.EncodeMessage(u, irc.PING, nil, s.Name()) //nolint:errcheck
+			next = timeout
+			if timeout <= 0 {
+				next = interval
+			}
+		case timeout > 0 && time.Since(pingedAt) >= timeout:
+			logger.Infof("disconnecting %s (%s): ping timeout", u.Nick, u.RemoteAddr())
+			u.Encode(&irc.Message{ //nolint:errcheck
+				Command:  irc.ERROR,
+				Trailing: fmt.Sprintf("Closing Link: Ping timeout: %d seconds", int(idle.Seconds())),
+			})
+			u.Conn.Close()
+			return
+		case timeout <= 0:
+			// ClientTimeout = 0 only pings
+			pingedAt = time.Time{}
+			next = interval
+		default:
+			next = timeout - time.Since(pingedAt)
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(next):
+		}
+	}
+}
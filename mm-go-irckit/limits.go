@@ -0,0 +1,250 @@
+package irckit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sorcix/irc"
+	"github.com/spf13/viper"
+)
+
+var ErrTooManyConnections = errors.New("too many connections")
+
+// configInt returns the int of the key, or def if it isn't set.
+func configInt(v *viper.Viper, key string, def int) int {
+	if !v.IsSet(key) {
+		return def
+	}
+	return v.GetInt(key)
+}
+
+// connections counts the connections per IP for MaxConnectionsPerIP.
+var connections = struct {
+	sync.Mutex
+	perIP map[string]int
+}{perIP: make(map[string]int)}
+
+// acquireConn counts the connection of the user, false if its IP has
+// MaxConnectionsPerIP connections already. The IPs of WEBIRC gateways are
+// not limited, their clients are counted again after WEBIRC.
+func acquireConn(u *User) bool {
+	releaseConn(u)
+	ip := connIP(u.RemoteAddr())
+	if ip == nil || isWebircGateway(u.v(), ip) {
+		return true
+	}
+	max := u.v().GetInt("MaxConnectionsPerIP")
+
+	connections.Lock()
+	defer connections.Unlock()
+	key := ip.String()
+	if max > 0 && connections.perIP[key] >= max {
+		return false
+	}
+	connections.perIP[key]++
+	u.connIP = key
+	return true
+}
+
+// releaseConn stops counting the connection of the user.
+func releaseConn(u *User) {
+	connections.Lock()
+	defer connections.Unlock()
+	if u.connIP == "" {
+		return
+	}
+	connections.perIP[u.connIP]--
+	if connections.perIP[u.connIP] <= 0 {
+		delete(connections.perIP, u.connIP)
+	}
+	u.connIP = ""
+}
+
+func isWebircGateway(v *viper.Viper, ip net.IP) bool {
+	var gateways []webircGateway
+	if err := v.UnmarshalKey("webirc", &gateways); err != nil {
+		return false
+	}
+	for _, gw := range gateways {
+		if len(gw.Hosts) > 0 && matchHosts(ip, gw.Hosts) {
+			return true
+		}
+	}
+	return false
+}
+
+// loginFailures are the failed logins by client IP and by account address.
+// After each failure from an IP the next login from it has to wait twice as
+// long, starting with a second, MaxLoginFailures lock the IP out for
+// LoginLockout seconds. Failures of an account only slow down its logins, a
+// second per failure over MaxLoginFailures up to maxAccountBackoff, so others
+// can't lock the owner out.
+var loginFailures = struct {
+	sync.Mutex
+	entries map[string]*loginFailure
+	swept   time.Time
+}{entries: make(map[string]*loginFailure)}
+
+type loginFailure struct {
+	count int
+	last  time.Time
+	until time.Time // no logins before
+}
+
+const (
+	maxLoginBackoff   = 5 * time.Minute
+	maxAccountBackoff = time.Minute
+)
+
+// loginKeys returns the IP and account the failures of a login are counted
+// for.
+func loginKeys(u *User) []string {
+	var keys []string
+	if addr := u.RemoteAddr(); addr != nil {
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+		keys = append(keys, "ip:"+host)
+	}
+	if login := u.Credentials.Login; login != "" && !strings.HasPrefix(login, "DCBACKUP:") {
+		keys = append(keys, "account:"+strings.ToLower(login))
+	}
+	return keys
+}
+
+// loginWait returns how long the user has to wait before logging in again.
+func loginWait(u *User) time.Duration {
+	loginFailures.Lock()
+	defer loginFailures.Unlock()
+	var wait time.Duration
+	for _, key := range loginKeys(u) {
+		if f, ok := loginFailures.entries[key]; ok {
+			if w := time.Until(f.until); w > wait {
+				wait = w
+			}
+		}
+	}
+	return wait
+}
+
+// loginFailed counts a failed login, it returns true if the user is locked
+// out now.
+func loginFailed(u *User) bool {
+	max := configInt(u.v(), "MaxLoginFailures", 5)
+	if max <= 0 {
+		return false
+	}
+	lockout := time.Duration(configInt(u.v(), "LoginLockout", 900)) * time.Second
+
+	loginFailures.Lock()
+	defer loginFailures.Unlock()
+	now := time.Now()
+	sweepLoginFailures(now, lockout)
+
+	locked := false
+	for _, key := range loginKeys(u) {
+		f, ok := loginFailures.entries[key]
+		if !ok || now.Sub(f.last) > lockout {
+			f = &loginFailure{}
+			loginFailures.entries[key] = f
+		}
+		f.count++
+		f.last = now
+
+		var backoff time.Duration
+		switch {
+		case strings.HasPrefix(key, "account:"):
+			if f.count >= max {
+				backoff = time.Duration(f.count-max+1) * time.Second
+			}
+			if backoff > maxAccountBackoff {
+				backoff = maxAccountBackoff
+			}
+		case f.count >= max:
+			backoff = lockout
+			locked = true
+		default:
+			backoff = time.Duration(math.Pow(2, float64(f.count-1))) * time.Second
+			if backoff > maxLoginBackoff {
+				backoff = maxLoginBackoff
+			}
+		}
+		f.until = now.Add(backoff)
+	}
+	return locked
+}
+
+// loginSucceeded forgets the failures of the IP and the account.
+func loginSucceeded(u *User) {
+	loginFailures.Lock()
+	defer loginFailures.Unlock()
+	for _, key := range loginKeys(u) {
+		delete(loginFailures.entries, key)
+	}
+}
+
+// sweepLoginFailures forgets old failures once a minute, loginFailures must
+// be locked.
+func sweepLoginFailures(now time.Time, lockout time.Duration) {
+	if now.Sub(loginFailures.swept) < time.Minute {
+		return
+	}
+	loginFailures.swept = now
+	for key, f := range loginFailures.entries {
+		if now.Sub(f.last) > lockout && now.After(f.until) {
+			delete(loginFailures.entries, key)
+		}
+	}
+}
+
+// floodLimiter is a token bucket for the commands of a client: FloodBurst
+// commands at once and FloodRate per second. Commands over the limit are
+// delayed, FloodBurst delayed commands in a row disconnect the client.
+type floodLimiter struct {
+	tokens    float64
+	last      time.Time
+	throttled int
+}
+
+// wait returns how long the command has to wait, and an error if the client
+// floods.
+func (f *floodLimiter) wait(v *viper.Viper) (time.Duration, error) {
+	rate := float64(v.GetInt("FloodRate"))
+	if rate <= 0 {
+		return 0, nil
+	}
+	burst := float64(configInt(v, "FloodBurst", 10))
+	if burst < 1 {
+		burst = 1
+	}
+
+	now := time.Now()
+	if f.last.IsZero() {
+		f.tokens = burst
+	} else {
+		f.tokens = math.Min(burst, f.tokens+now.Sub(f.last).Seconds()*rate)
+	}
+	f.last = now
+
+	f.tokens--
+	if f.tokens >= 0 {
+		f.throttled = 0
+		return 0, nil
+	}
+	f.throttled++
+	if float64(f.throttled) > burst {
+		return 0, fmt.Errorf("excess flood")
+	}
+	return time.Duration(-f.tokens / rate * float64(time.Second)), nil
+}
+
+// floodExempt are the commands that don't count for the flood limit.
+func floodExempt(msg *irc.Message) bool {
+	return msg.Command == irc.PONG || msg.Command == irc.QUIT
+}
@@ -0,0 +1,87 @@
+package irckit
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/deltachat/deltaircd/config"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFloodLimiter(t *testing.T) {
+	v := viper.New()
+	var f floodLimiter
+
+	// disabled without FloodRate
+	for i := 0; i < 100; i++ {
+		wait, err := f.wait(v)
+		assert.NoError(t, err)
+		assert.Zero(t, wait)
+	}
+
+	v.Set("FloodRate", 2)
+	v.Set("FloodBurst", 3)
+	f = floodLimiter{}
+	for i := 0; i < 3; i++ {
+		wait, err := f.wait(v)
+		assert.NoError(t, err)
+		assert.Zero(t, wait, "burst %d", i)
+	}
+	for i := 0; i < 3; i++ {
+		wait, err := f.wait(v)
+		assert.NoError(t, err)
+		assert.InDelta(t, float64(i+1)*float64(time.Second)/2, float64(wait), float64(10*time.Millisecond))
+	}
+	_, err := f.wait(v)
+	assert.Error(t, err, "more than FloodBurst commands delayed in a row")
+
+	// a pause refills the bucket
+	f.last = f.last.Add(-10 * time.Second)
+	wait, err := f.wait(v)
+	assert.NoError(t, err)
+	assert.Zero(t, wait)
+}
+
+func TestLoginFailures(t *testing.T) {
+	loginFailures.Lock()
+	loginFailures.entries = make(map[string]*loginFailure)
+	loginFailures.Unlock()
+
+	v := viper.New()
+	v.Set("MaxLoginFailures", 3)
+	newLoginUser := func(ip, login string) *User {
+		u := NewUser(nil)
+		u.cfg = config.NewConfig(v)
+		u.remoteAddr = &remoteAddr{ip: net.ParseIP(ip)}
+		u.Credentials.Login = login
+		return u
+	}
+
+	u := newLoginUser("192.0.2.1", "alice@example.org")
+	assert.Zero(t, loginWait(u))
+	assert.False(t, loginFailed(u))
+	assert.InDelta(t, float64(time.Second), float64(loginWait(u)), float64(50*time.Millisecond))
+	assert.False(t, loginFailed(u))
+	assert.InDelta(t, float64(2*time.Second), float64(loginWait(u)), float64(50*time.Millisecond))
+	assert.True(t, loginFailed(u), "locked out after MaxLoginFailures")
+	assert.InDelta(t, float64(900*time.Second), float64(loginWait(u)), float64(time.Second))
+
+	// the IP is locked out, also for other accounts
+	assert.NotZero(t, loginWait(newLoginUser("192.0.2.1", "bob@example.org")))
+
+	// the account is only slowed down from other IPs
+	owner := newLoginUser("198.51.100.7", "ALICE@example.org")
+	assert.InDelta(t, float64(time.Second), float64(loginWait(owner)), float64(50*time.Millisecond))
+	for i := 0; i < 100; i++ {
+		loginFailed(newLoginUser(fmt.Sprintf("203.0.113.%d", i), "alice@example.org"))
+	}
+	assert.InDelta(t, float64(maxAccountBackoff), float64(loginWait(owner)), float64(time.Second))
+	assert.Zero(t, loginWait(newLoginUser("198.51.100.7", "bob@example.org")))
+
+	// a login of the owner forgets the failures of the account
+	loginSucceeded(owner)
+	assert.Zero(t, loginWait(owner))
+}
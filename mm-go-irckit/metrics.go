@@ -0,0 +1,78 @@
+package irckit
+
+import (
+	"sort"
+
+	"github.com/deltachat/deltaircd/metrics"
+)
+
+var connectivityStates = []string{"not connected", "connecting", "working", "connected"}
+
+func init() {
+	metrics.RegisterGaugeFunc("deltaircd_clients", "Connected IRC clients.", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(len(Sessions()))}}
+	})
+	metrics.RegisterGaugeFunc("deltaircd_accounts", "Accounts logged in by at least one client.", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(len(loggedInAccounts()))}}
+	})
+	metrics.RegisterGaugeFunc("deltaircd_events_queued", "Bridge events waiting to be sent to the clients.", func() []metrics.Sample {
+		queued := 0
+		for _, u := range Sessions() {
+			queued += len(u.eventChan)
+		}
+		return []metrics.Sample{{Value: float64(queued)}}
+	})
+	metrics.RegisterGaugeFunc("deltaircd_account_connectivity", "Connectivity state of the accounts, 1 for the current state.", accountConnectivity)
+}
+
+// loggedInAccounts returns a session of each logged in account by account ID.
+func loggedInAccounts() map[string]*User {
+	accounts := make(map[string]*User)
+	for _, u := range Sessions() {
+		if br := u.Bridge(); br != nil {
+			if _, ok := accounts[br.AccountID()]; !ok {
+				accounts[br.AccountID()] = u
+			}
+		}
+	}
+	return accounts
+}
+
+// accountConnectivity labels the accounts with their ID, the addresses are
+// only used with MetricsAddresses.
+func accountConnectivity() []metrics.Sample {
+	accounts := loggedInAccounts()
+	ids := make([]string, 0, len(accounts))
+	for id := range accounts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var samples []metrics.Sample
+	for _, id := range ids {
+		u := accounts[id]
+		br := u.Bridge()
+		if br == nil {
+			continue
+		}
+		connectivity, err := br.Connectivity()
+		if err != nil {
+			continue
+		}
+		account := id
+		if u.v().GetBool("metricsaddresses") {
+			account = u.Account()
+		}
+		for _, state := range connectivityStates {
+			value := 0.0
+			if state == connectivity {
+				value = 1
+			}
+			samples = append(samples, metrics.Sample{
+				Labels: map[string]string{"account": account, "state": state},
+				Value:  value,
+			})
+		}
+	}
+	return samples
+}
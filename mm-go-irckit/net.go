@@ -1,8 +1,14 @@
 package irckit
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/sorcix/irc"
 )
@@ -13,14 +19,150 @@ type Conn interface {
 	Encode(*irc.Message) error
 	Decode() (*irc.Message, error)
 
+	// RemoteAddr returns the address of the client
+	RemoteAddr() net.Addr
+
 	// ResolveHost returns the resolved host of the RemoteAddr
 	ResolveHost() string
+
+	// TLSState returns the state of a TLS connection, nil for plaintext
+	TLSState() *tls.ConnectionState
 }
 
+const (
+	defaultSendQueue    = 4 << 20 // bytes
+	defaultWriteTimeout = 30 * time.Second
+	defaultCloseTimeout = 5 * time.Second
+)
+
+var errSendQueueFull = errors.New("send queue full")
+
+// conn sends the messages from a queue, so a slow or stuck client doesn't
+// block the bridge. The queue is limited in bytes, a full queue or a write
+// that doesn't finish within the write timeout closes the connection.
 type conn struct {
 	net.Conn
-	*irc.Encoder
 	*irc.Decoder
+	enc *irc.Encoder
+
+	mu           sync.Mutex
+	queue        [][]byte
+	queued       int // bytes in queue and being written
+	maxQueued    int
+	wake         chan struct{} // signals the writer that queue isn't empty
+	writeTimeout time.Duration
+	closeTimeout time.Duration // how long Close waits for the queue to be sent
+	closeOnce    sync.Once
+	quit         chan struct{} // closed by Close
+	done         chan struct{} // closed when the writer stopped
+}
+
+func newConn(c net.Conn, queue int, writeTimeout time.Duration) *conn {
+	if queue <= 0 {
+		queue = defaultSendQueue
+	}
+	nc := &conn{
+		Conn:         c,
+		Decoder:      irc.NewDecoder(c),
+		enc:          irc.NewEncoder(c),
+		maxQueued:    queue,
+		wake:         make(chan struct{}, 1),
+		writeTimeout: writeTimeout,
+		closeTimeout: defaultCloseTimeout,
+		quit:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go nc.writer()
+	return nc
+}
+
+// Encode queues the message, the connection is closed if the queue is full.
+func (c *conn) Encode(msg *irc.Message) error {
+	select {
+	case <-c.quit:
+		return net.ErrClosed
+	case <-c.done:
+		return net.ErrClosed
+	default:
+	}
+
+	line := msg.Bytes()
+	c.mu.Lock()
+	if c.queued+len(line) > c.maxQueued {
+		c.mu.Unlock()
+		logger.Errorf("send queue of %s is full, disconnecting", c.RemoteAddr())
+		go c.Close()
+		return errSendQueueFull
+	}
+	c.queue = append(c.queue, line)
+	c.queued += len(line)
+	c.mu.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Close sends the queued messages, e.g. an ERROR, and closes the connection.
+// Messages that aren't sent within the close timeout are dropped.
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() { close(c.quit) })
+	select {
+	case <-c.done:
+	case <-time.After(c.closeTimeout):
+		// interrupts a blocked write
+		c.Conn.Close()
+		<-c.done
+	}
+	return nil
+}
+
+func (c *conn) writer() {
+	defer close(c.done)
+	defer c.Conn.Close()
+	for {
+		select {
+		case <-c.wake:
+			if err := c.flush(); err != nil {
+				logger.Debugf("writing to %s failed: %v", c.RemoteAddr(), err)
+				return
+			}
+		case <-c.quit:
+			c.flush() //nolint:errcheck
+			return
+		}
+	}
+}
+
+// flush writes the queued messages.
+func (c *conn) flush() error {
+	c.mu.Lock()
+	lines := c.queue
+	c.queue = nil
+	c.mu.Unlock()
+
+	for _, line := range lines {
+		err := c.write(line)
+		c.mu.Lock()
+		c.queued -= len(line)
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn) write(line []byte) error {
+	if c.writeTimeout > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return err
+		}
+	}
+	_, err := c.enc.Write(line)
+	return err
 }
 
 // resolveHost will convert an IP to a Hostname, but fall back to IP on error.
@@ -44,3 +186,22 @@ func (c *conn) ResolveHost() string {
 
 	return strings.TrimSuffix(names[0], ".")
 }
+
+func (c *conn) TLSState() *tls.ConnectionState {
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	return &state
+}
+
+// certFP returns the SHA-256 fingerprint of the client certificate in hex,
+// empty if the client didn't send one.
+func certFP(state *tls.ConnectionState) string {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
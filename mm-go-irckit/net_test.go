@@ -0,0 +1,116 @@
+package irckit
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sorcix/irc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	SetLogger(logrus.NewEntry(logrus.New()))
+}
+
+func TestConnSendQueue(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	msg := &irc.Message{Command: irc.PING, Trailing: "test"}
+	size := len(msg.Bytes())
+	c := newConn(server, 2*size, 100*time.Millisecond)
+
+	// nobody reads: the writer is stuck with the first message, which still
+	// counts until it's written, one more fits in the queue
+	require.NoError(t, c.Encode(msg))
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, c.Encode(msg))
+	assert.Equal(t, errSendQueueFull, c.Encode(msg))
+
+	// the write deadline closes the connection
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		t.Fatal("the stuck connection wasn't closed")
+	}
+	assert.Error(t, c.Encode(msg))
+}
+
+func TestConnCloseFlushes(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := newConn(server, defaultSendQueue, time.Second)
+
+	lines := make(chan string, 2)
+	go func() {
+		r := bufio.NewReader(client)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	require.NoError(t, c.Encode(&irc.Message{Command: irc.NOTICE, Params: []string{"nick"}, Trailing: "bye"}))
+	require.NoError(t, c.Encode(&irc.Message{Command: irc.ERROR, Trailing: "Closing Link: test"}))
+	require.NoError(t, c.Close())
+
+	assert.Equal(t, "NOTICE nick :bye\r\n", <-lines)
+	assert.Equal(t, "ERROR :Closing Link: test\r\n", <-lines)
+	_, open := <-lines
+	assert.False(t, open, "the connection is closed")
+}
+
+func TestConnCloseTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := newConn(server, defaultSendQueue, time.Minute)
+	c.closeTimeout = 50 * time.Millisecond
+	require.NoError(t, c.Encode(&irc.Message{Command: irc.ERROR, Trailing: "Closing Link: test"}))
+
+	// nobody reads, Close doesn't wait for the write timeout
+	start := time.Now()
+	require.NoError(t, c.Close())
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestConnLoginBurst(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := newConn(server, defaultSendQueue, time.Second)
+
+	// a slow client reading the JOINs and NAMES of many channels at once
+	const channels = 2000
+	received := make(chan int)
+	go func() {
+		r := bufio.NewReader(client)
+		n := 0
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				received <- n
+				return
+			}
+			n++
+			if n%100 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	names := strings.TrimSpace(strings.Repeat("someone-with-a-long-nick ", 16))
+	for i := 0; i < channels; i++ {
+		channel := "#channel-with-a-long-name-" + strings.Repeat("x", i%20)
+		require.NoError(t, c.Encode(&irc.Message{Prefix: &irc.Prefix{Name: "me"}, Command: irc.JOIN, Params: []string{channel}}))
+		require.NoError(t, c.Encode(&irc.Message{Command: irc.RPL_NAMREPLY, Params: []string{"me", "=", channel}, Trailing: names}))
+		require.NoError(t, c.Encode(&irc.Message{Command: irc.RPL_ENDOFNAMES, Params: []string{"me", channel}, Trailing: "End of /NAMES list."}))
+	}
+	require.NoError(t, c.Close())
+	assert.Equal(t, 3*channels, <-received)
+}
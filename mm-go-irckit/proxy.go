@@ -0,0 +1,189 @@
+package irckit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyV2Signature starts a binary PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// a v1 header is at most 107 bytes including the CRLF
+const proxyV1MaxLen = 107
+
+var errNoProxyHeader = errors.New("no PROXY protocol header")
+
+// proxyConn is a connection with the client address of a PROXY protocol
+// header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// NewProxyConn reads the PROXY protocol v1 or v2 header that HAProxy, stunnel
+// and others send before the client data. The returned connection has the
+// client address as RemoteAddr. Health checks (UNKNOWN or LOCAL) keep the
+// address of the proxy.
+func NewProxyConn(c net.Conn, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		defer c.SetReadDeadline(time.Time{}) //nolint:errcheck
+	}
+
+	pc := &proxyConn{Conn: c, r: bufio.NewReader(c)}
+	first, err := pc.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		err = pc.readV1()
+	case proxyV2Signature[0]:
+		err = pc.readV2()
+	default:
+		err = errNoProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// readV1 parses "PROXY TCP4 <src> <dst> <srcport> <dstport>\r\n".
+func (c *proxyConn) readV1() error {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if len(line) > proxyV1MaxLen {
+			return fmt.Errorf("PROXY header too long")
+		}
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return errNoProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil
+	case "TCP4", "TCP6":
+	default:
+		return fmt.Errorf("unsupported PROXY protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return fmt.Errorf("invalid PROXY header %q", strings.TrimSpace(string(line)))
+	}
+
+	src, err := parseTCPAddr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseTCPAddr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	if (src.IP.To4() != nil) != (fields[1] == "TCP4") {
+		return fmt.Errorf("address %s is not %s", src.IP, fields[1])
+	}
+	c.remote, c.local = src, dst
+	return nil
+}
+
+func parseTCPAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("invalid address %q in PROXY header", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in PROXY header", port)
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+// readV2 parses the binary header: the signature, version and command,
+// address family, length and the addresses.
+func (c *proxyConn) readV2() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return errNoProxyHeader
+	}
+	if header[12]>>4 != 2 {
+		return fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	command, family := header[12]&0xf, header[13]
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return err
+	}
+
+	switch command {
+	case 0x0: // LOCAL, e.g. a health check of the proxy
+		return nil
+	case 0x1: // PROXY
+	default:
+		return fmt.Errorf("unsupported PROXY command %d", command)
+	}
+
+	var size int
+	switch family {
+	case 0x11: // TCP over IPv4
+		size = net.IPv4len
+	case 0x21: // TCP over IPv6
+		size = net.IPv6len
+	default:
+		// UDP and unix sockets don't have a usable client address
+		return nil
+	}
+	if len(body) < 2*size+4 {
+		return fmt.Errorf("PROXY header too short for its addresses")
+	}
+	c.remote = &net.TCPAddr{
+		IP:   net.IP(body[:size]),
+		Port: int(binary.BigEndian.Uint16(body[2*size:])),
+	}
+	c.local = &net.TCPAddr{
+		IP:   net.IP(body[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(body[2*size+2:])),
+	}
+	return nil
+}
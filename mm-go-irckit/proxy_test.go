@@ -0,0 +1,120 @@
+package irckit
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type ProxyTest struct {
+	Desc   string
+	Header []byte
+	Remote string // empty keeps the address of the proxy
+	IsGood bool
+}
+
+func proxyV2Header(command, family byte, body []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(body)))
+	return append(header, body...)
+}
+
+var proxyTests = []ProxyTest{
+	{
+		Desc:   "v1 TCP4",
+		Header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 6667\r\n"),
+		Remote: "192.0.2.1:56324",
+		IsGood: true,
+	},
+	{
+		Desc:   "v1 TCP6",
+		Header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 6667\r\n"),
+		Remote: "[2001:db8::1]:56324",
+		IsGood: true,
+	},
+	{
+		Desc:   "v1 UNKNOWN",
+		Header: []byte("PROXY UNKNOWN\r\n"),
+		IsGood: true,
+	},
+	{
+		Desc:   "v1 family mismatch",
+		Header: []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 6667\r\n"),
+	},
+	{
+		Desc:   "v1 invalid port",
+		Header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 99999 6667\r\n"),
+	},
+	{
+		Desc:   "v1 too long",
+		Header: []byte("PROXY TCP4 " + string(make([]byte, 120)) + "\r\n"),
+	},
+	{
+		Desc:   "no header",
+		Header: []byte("NICK test\r\n"),
+	},
+	{
+		Desc: "v2 TCP4",
+		Header: proxyV2Header(0x1, 0x11, []byte{
+			192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x1a, 0x0b,
+		}),
+		Remote: "192.0.2.1:56324",
+		IsGood: true,
+	},
+	{
+		Desc: "v2 TCP6 with TLVs",
+		Header: proxyV2Header(0x1, 0x21, append(append(append(
+			net.ParseIP("2001:db8::1").To16(),
+			net.ParseIP("2001:db8::2").To16()...),
+			0xdc, 0x04, 0x1a, 0x0b),
+			0x04, 0x00, 0x01, 0x00)),
+		Remote: "[2001:db8::1]:56324",
+		IsGood: true,
+	},
+	{
+		Desc:   "v2 LOCAL",
+		Header: proxyV2Header(0x0, 0x00, nil),
+		IsGood: true,
+	},
+	{
+		Desc:   "v2 short addresses",
+		Header: proxyV2Header(0x1, 0x11, []byte{192, 0, 2, 1}),
+	},
+}
+
+func TestNewProxyConn(t *testing.T) {
+	for _, test := range proxyTests {
+		client, server := net.Pipe()
+		go func(header []byte) {
+			client.Write(append(header, "NICK test\r\n"...)) //nolint:errcheck
+			client.Close()
+		}(test.Header)
+
+		conn, err := NewProxyConn(server, time.Second)
+		if !test.IsGood {
+			assert.Error(t, err, test.Desc)
+			server.Close()
+			continue
+		}
+		if !assert.NoError(t, err, test.Desc) {
+			server.Close()
+			continue
+		}
+
+		remote := test.Remote
+		if remote == "" {
+			remote = server.RemoteAddr().String()
+		}
+		assert.Equal(t, remote, conn.RemoteAddr().String(), test.Desc)
+
+		rest, err := io.ReadAll(conn)
+		assert.NoError(t, err, test.Desc)
+		assert.Equal(t, "NICK test\r\n", string(rest), test.Desc)
+		conn.Close()
+	}
+}
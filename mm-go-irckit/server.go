@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/deltachat/deltaircd/bridge"
+	"github.com/deltachat/deltaircd/metrics"
 	"github.com/sorcix/irc"
 )
 
@@ -36,6 +37,9 @@ type Server interface {
 	// Motd is the Message of the Day for the server.
 	Motd() []string
 
+	// Version of the server software.
+	Version() string
+
 	// Connect starts the handshake for a new user, blocks until it's completed or failed with an error.
 	Connect(*User) error
 
@@ -52,6 +56,10 @@ type Server interface {
 	// Returns whether the rename was was successful.
 	RenameUser(*User, string) bool
 
+	// RenameChannel changes the name of a Channel if the new name is available.
+	// Returns whether the rename was successful.
+	RenameChannel(Channel, string) bool
+
 	// Channel gets or creates a new channel with the given name and Id.
 	Channel(string) Channel
 
@@ -89,7 +97,7 @@ type ServerConfig struct {
 	// DiscardEmpty setting will start a goroutine to discard empty channels.
 	DiscardEmpty bool
 	// NewChannel overrides the constructor for a new Channel in a given Server and Name.
-	NewChannel func(s Server, channelId string, name string, service string, modes map[string]bool) Channel
+	NewChannel func(s Server, channelId string, name string, service string, modes map[string]string) Channel
 	// Commands is the handler registry to use (default: DefaultCommands())
 	Commands Commands
 }
@@ -146,6 +154,10 @@ func (s *server) Motd() []string {
 	return s.config.Motd
 }
 
+func (s *server) Version() string {
+	return s.config.Version
+}
+
 func (s *server) Close() error {
 	// TODO: Send notice or something?
 	// TODO: Clear channels?
@@ -239,11 +251,8 @@ func (s *server) Channel(channelID string) Channel {
 			info = &bridge.ChannelInfo{}
 		}
 
-		modes := make(map[string]bool)
-		modes["p"] = info.Private
-
 		newFn := s.config.NewChannel
-		ch = newFn(s, channelID, name, service, modes)
+		ch = newFn(s, channelID, name, service, channelModes(info))
 
 		logger.Debugf("new channel id: %s, name: %s", channelID, name)
 
@@ -256,6 +265,21 @@ func (s *server) Channel(channelID string) Channel {
 	return ch
 }
 
+// RenameChannel stores the channel under its new name and tells its users.
+func (s *server) RenameChannel(ch Channel, name string) bool {
+	s.Lock()
+	if other, exists := s.channels[name]; exists && other != ch {
+		s.Unlock()
+		return false
+	}
+	delete(s.channels, ch.String())
+	s.channels[name] = ch
+	s.Unlock()
+
+	ch.Rename(name)
+	return true
+}
+
 // UnlinkChannel unlinks the channel from the server's storage, returns whether it existed.
 func (s *server) UnlinkChannel(ch Channel) {
 	s.Lock()
@@ -270,23 +294,38 @@ func (s *server) UnlinkChannel(ch Channel) {
 
 // Connect starts the handshake for a new User and returns when complete or failed.
 func (s *server) Connect(u *User) error {
+	if !acquireConn(u) {
+		u.Encode(&irc.Message{ //nolint:errcheck
+			Command:  irc.ERROR,
+			Trailing: "Closing Link: Too many connections from your IP",
+		})
+		u.Close()
+		return ErrTooManyConnections
+	}
 	err := s.handshake(u)
 	if err != nil {
+		metrics.HandshakeFailures.Inc()
+		releaseConn(u)
 		u.Close()
 		return err
 	}
+	addSession(u)
 	go s.handle(u)
 	return nil
 }
 
 // Quit will remove the user from all channels and disconnect.
 func (s *server) Quit(u *User, message string) {
+	removeSession(u)
+	releaseConn(u)
 	go u.Close()
 	s.Lock()
 	delete(s.users, u.ID())
 	s.Unlock()
 
-	u.br.Logout()
+	if u.br != nil {
+		u.br.Logout()
+	}
 }
 
 // Len returns the number of users connected to the server.
@@ -321,6 +360,12 @@ func (s *server) welcome(u *User) error {
 			Command: irc.RPL_MYINFO,
 			Params:  []string{u.Nick, s.config.Name, s.config.Version, "o", "o"},
 		},
+		&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  "005", // RPL_ISUPPORT
+			Params:   []string{u.Nick, fmt.Sprintf("MONITOR=%d", monitorLimit)},
+			Trailing: "are supported by this server",
+		},
 		&irc.Message{
 			Prefix:   s.Prefix(),
 			Command:  irc.RPL_LUSERCLIENT,
@@ -351,12 +396,36 @@ func (s *server) Handle(u *User) {
 func (s *server) handle(u *User) {
 	var partMsg string
 	defer s.Quit(u, partMsg)
+	// let running commands finish before logging out, e.g. a flushed paste
+	var running sync.WaitGroup
+	defer running.Wait()
+	done := make(chan struct{})
+	defer close(done)
+	go s.keepalive(u, done)
+
+	flooded := false
 	for msg := range u.DecodeCh {
-		if msg == nil {
-			// Ignore empty messages
+		if msg == nil || flooded {
+			// Ignore empty messages, read until the decoder stopped
 			continue
 		}
+		if !floodExempt(msg) {
+			wait, err := u.flood.wait(u.v())
+			if err != nil {
+				logger.Infof("disconnecting %s (%s): %v", u.Nick, u.RemoteAddr(), err)
+				u.Encode(&irc.Message{ //nolint:errcheck
+					Command:  irc.ERROR,
+					Trailing: "Closing Link: Excess Flood",
+				})
+				u.Conn.Close()
+				flooded = true
+				continue
+			}
+			time.Sleep(wait)
+		}
+		running.Add(1)
 		go func(msg *irc.Message) {
+			defer running.Done()
 			err := s.commands.Run(s, u, msg)
 			logger.Debugf("Executed %#v %#v", msg, err)
 			if err == ErrUnknownCommand {
@@ -403,7 +472,7 @@ func (s *server) handshake(u *User) error {
 	u.Host = u.ResolveHost()
 	go u.Decode()
 
-	timeout := u.v.GetInt("HandshakeTimeout")
+	timeout := u.v().GetInt("HandshakeTimeout")
 	if timeout == 0 {
 		timeout = 10
 	}
@@ -443,20 +512,31 @@ outerloop:
 				u.Pass = msg.Params
 			case irc.JOIN:
 				s.EncodeMessage(u, irc.ERR_NOTREGISTERED, []string{"*"}, "Please register first")
+			// https://ircv3.net/specs/extensions/webirc
+			case "WEBIRC":
+				if u.Nick != "" || u.User != "" {
+					continue
+				}
+				if err := s.webirc(u, msg); err != nil {
+					logger.Infof("refused WEBIRC from %s: %v", u.Conn.RemoteAddr(), err)
+					u.Encode(&irc.Message{ //nolint:errcheck
+						Command:  irc.ERROR,
+						Trailing: "Closing Link: WEBIRC refused",
+					})
+					return ErrHandshakeFailed
+				}
+				// count the client instead of the gateway
+				if !acquireConn(u) {
+					u.Encode(&irc.Message{ //nolint:errcheck
+						Command:  irc.ERROR,
+						Trailing: "Closing Link: Too many connections from your IP",
+					})
+					return ErrTooManyConnections
+				}
+				continue
 			// https://ircv3.net/specs/extensions/capability-negotiation.html
 			case irc.CAP:
-				subcommand := msg.Params[0]
-				switch subcommand {
-				case irc.CAP_LS, irc.CAP_LIST:
-					params := fmt.Sprintf("* %s :", subcommand)
-					s.EncodeMessage(u, irc.CAP, []string{params}, "") //nolint:errcheck
-				case irc.CAP_END, irc.CAP_REQ:
-					// Do nothing.
-				default:
-					params := fmt.Sprintf("* %s", subcommand)
-					// github.com/sorcix/irc doesn't yet support ERR_INVALIDCAPCMD (410)
-					s.EncodeMessage(u, "410", []string{params}, "Invalid or unsupported CAP command") //nolint:errcheck
-				}
+				CmdCap(s, u, msg) //nolint:errcheck
 				continue
 			}
 
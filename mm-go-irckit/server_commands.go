@@ -2,10 +2,12 @@ package irckit
 
 import (
 	"fmt"
+	"net"
 	"regexp"
 	"strconv"
 	"strings"
 
+	"github.com/deltachat/deltaircd/bridge"
 	"github.com/sorcix/irc"
 )
 
@@ -13,6 +15,7 @@ func DefaultCommands() Commands {
 	cmds := commands{}
 
 	cmds.Add(Handler{Command: irc.AWAY, Call: CmdAway, LoggedIn: true})
+	cmds.Add(Handler{Command: irc.CAP, Call: CmdCap, MinParams: 1})
 	cmds.Add(Handler{Command: irc.ISON, Call: CmdIson})
 	cmds.Add(Handler{Command: irc.INVITE, Call: CmdInvite, LoggedIn: true, MinParams: 2})
 	cmds.Add(Handler{Command: irc.JOIN, Call: CmdJoin, MinParams: 1, LoggedIn: true})
@@ -20,6 +23,7 @@ func DefaultCommands() Commands {
 	cmds.Add(Handler{Command: irc.LIST, Call: CmdList, LoggedIn: true})
 	cmds.Add(Handler{Command: irc.LUSERS, Call: CmdLusers})
 	cmds.Add(Handler{Command: irc.MODE, Call: CmdMode, MinParams: 1, LoggedIn: true})
+	cmds.Add(Handler{Command: "MONITOR", Call: CmdMonitor, MinParams: 1, LoggedIn: true})
 	cmds.Add(Handler{Command: irc.MOTD, Call: CmdMotd})
 	cmds.Add(Handler{Command: irc.NAMES, Call: CmdNames, MinParams: 1, LoggedIn: true})
 	cmds.Add(Handler{Command: irc.NICK, Call: CmdNick, MinParams: 1})
@@ -44,6 +48,82 @@ func CmdAway(s Server, u *User, msg *irc.Message) error {
 	return s.EncodeMessage(u, irc.RPL_NOWAWAY, []string{u.Nick}, "You have been marked as being away")
 }
 
+// supportedCaps are the IRCv3 capabilities clients can request.
+var supportedCaps = []string{"away-notify", "draft/channel-rename"}
+
+// stsPolicy returns the value of the sts capability, which tells clients to
+// only connect with TLS: the port of TLSBind (or STSPort) on plaintext and the
+// STSDuration on TLS connections. Empty if STSDuration isn't set.
+// https://ircv3.net/specs/extensions/sts
+func stsPolicy(u *User) string {
+	duration := u.v().GetInt("stsduration")
+	if duration <= 0 {
+		return ""
+	}
+	if u.TLSState() != nil {
+		return "duration=" + strconv.Itoa(duration)
+	}
+	port := u.v().GetInt("stsport")
+	if port == 0 {
+		if _, p, err := net.SplitHostPort(u.v().GetString("tlsbind")); err == nil {
+			port, _ = strconv.Atoi(p)
+		}
+	}
+	if port == 0 {
+		return ""
+	}
+	return "port=" + strconv.Itoa(port)
+}
+
+func capVersion(version string) int {
+	v, _ := strconv.Atoi(version)
+	return v
+}
+
+// CmdCap is a handler for the CAP command (capability negotiation).
+// https://ircv3.net/specs/extensions/capability-negotiation.html
+func CmdCap(s Server, u *User, msg *irc.Message) error {
+	target := u.Nick
+	if target == "" {
+		target = "*"
+	}
+	subcommand := strings.ToUpper(msg.Params[0])
+
+	switch subcommand {
+	case irc.CAP_LS:
+		caps := supportedCaps
+		// caps with values need CAP LS 302
+		if len(msg.Params) > 1 && capVersion(msg.Params[1]) >= 302 {
+			if sts := stsPolicy(u); sts != "" {
+				caps = append(append([]string{}, caps...), "sts="+sts)
+			}
+		}
+		return s.EncodeMessage(u, irc.CAP, []string{target, irc.CAP_LS}, strings.Join(caps, " "))
+	case irc.CAP_LIST:
+		return s.EncodeMessage(u, irc.CAP, []string{target, irc.CAP_LIST}, strings.Join(u.Caps(), " "))
+	case irc.CAP_REQ:
+		requested := msg.Trailing
+		if requested == "" && len(msg.Params) > 1 {
+			requested = strings.Join(msg.Params[1:], " ")
+		}
+		caps := strings.Fields(requested)
+		for _, c := range caps {
+			if !stringInSlice(strings.TrimPrefix(c, "-"), supportedCaps) {
+				return s.EncodeMessage(u, irc.CAP, []string{target, irc.CAP_NAK}, requested)
+			}
+		}
+		for _, c := range caps {
+			u.setCap(strings.TrimPrefix(c, "-"), !strings.HasPrefix(c, "-"))
+		}
+		return s.EncodeMessage(u, irc.CAP, []string{target, irc.CAP_ACK}, requested)
+	case irc.CAP_END:
+		return nil
+	default:
+		// github.com/sorcix/irc doesn't yet support ERR_INVALIDCAPCMD (410)
+		return s.EncodeMessage(u, "410", []string{target, subcommand}, "Invalid or unsupported CAP command")
+	}
+}
+
 func CmdInvite(s Server, u *User, msg *irc.Message) error {
 	who := msg.Params[0]
 	channel := msg.Params[1]
@@ -69,9 +149,13 @@ func CmdIson(s Server, u *User, msg *irc.Message) error {
 	if len(msg.Params) == 0 {
 		nicks = strings.Fields(msg.Trailing)
 	}
+	var statuses map[string]string
+	if u.br != nil {
+		statuses, _ = u.br.StatusUsers()
+	}
 	on := make([]string, 0, len(nicks))
 	for _, nick := range nicks {
-		if _, ok := s.HasUser(nick); ok {
+		if other, ok := s.HasUser(nick); ok && isOnline(other, statuses) {
 			on = append(on, nick)
 		}
 	}
@@ -130,17 +214,8 @@ func CmdJoin(s Server, u *User, msg *irc.Message) error {
 
 		sync = u.syncChannel
 
-		/*u.v.GetStringSlice(u.br.Protocol()+".joinexclude")
-		u.v.Set(key string, value interface{})
-		*/
 		// if we joined, remove channel from exclude and add to include
-		u.v.Set(u.br.Protocol()+".joinexclude", removeStringInSlice(channel, u.v.GetStringSlice(u.br.Protocol()+".joinexclude")))
-
-		if len(u.v.GetStringSlice(u.br.Protocol()+".joininclude")) > 0 {
-			channels := u.v.GetStringSlice(u.br.Protocol() + ".joininclude")
-			channels = append(channels, channel)
-			u.v.Set(u.br.Protocol()+".joininclude", channels)
-		}
+		u.updateJoinLists(channel, true)
 
 		ch := s.Channel(channelID)
 		sync(channelID, channelName)
@@ -193,23 +268,29 @@ func CmdLusers(s Server, u *User, msg *irc.Message) error {
 func CmdMode(s Server, u *User, msg *irc.Message) error {
 	modetype := ""
 	channel := msg.Params[0]
-	mode := ""
-
-	if s.Channel(channel).IsPrivate() {
-		mode = "p"
-	}
+	ch := s.Channel(channel)
+	mode := ch.Modes()
 
 	r := []*irc.Message{}
 	if len(msg.Params) > 1 {
 		modetype = msg.Params[1]
 	}
+	switch {
+	case modetype == "" || modetype == "b" || modetype == "+b":
+		modetype = strings.TrimPrefix(modetype, "+")
+	case strings.HasPrefix(channel, "#"):
+		args := msg.Params[2:]
+		if msg.Trailing != "" {
+			args = append(args, msg.Trailing)
+		}
+		return setChannelModes(s, u, ch, modetype, args)
+	}
 	switch modetype {
 	case "":
 		r = append(r, &irc.Message{
-			Prefix:   s.Prefix(),
-			Command:  irc.RPL_CHANNELMODEIS,
-			Params:   []string{u.Nick, channel},
-			Trailing: " " + mode,
+			Prefix:  s.Prefix(),
+			Command: irc.RPL_CHANNELMODEIS,
+			Params:  []string{u.Nick, channel, mode},
 		})
 	case "b":
 		r = append(r, &irc.Message{
@@ -222,6 +303,86 @@ func CmdMode(s Server, u *User, msg *irc.Message) error {
 	return u.Encode(r...)
 }
 
+// setChannelModes changes the chat properties that are mapped to channel
+// modes, see channelModes().
+func setChannelModes(s Server, u *User, ch Channel, modestring string, args []string) error {
+	modes := ch.GetModes()
+	set := true
+	var r []*irc.Message
+	for _, c := range modestring {
+		mode := string(c)
+		var err error
+		switch mode {
+		case "+", "-":
+			set = mode == "+"
+			continue
+		case "M":
+			err = u.br.SetChannelMuted(ch.ID(), set)
+		case "P":
+			err = u.br.SetChannelPinned(ch.ID(), set)
+		case "A":
+			err = u.br.SetChannelArchived(ch.ID(), set)
+		case "E":
+			var seconds uint
+			if set {
+				if len(args) == 0 {
+					r = append(r, &irc.Message{
+						Prefix:   s.Prefix(),
+						Command:  irc.ERR_NEEDMOREPARAMS,
+						Params:   []string{u.Nick, irc.MODE},
+						Trailing: "Mode E needs the ephemeral timer, e.g. +E 1d",
+					})
+					continue
+				}
+				seconds, err = parseDuration(args[0])
+				args = args[1:]
+				if err != nil {
+					break
+				}
+			}
+			err = u.br.SetChannelEphemeralTimer(ch.ID(), seconds)
+			if err == nil {
+				if seconds > 0 {
+					modes[mode] = formatDuration(seconds)
+				} else {
+					delete(modes, mode)
+				}
+				continue
+			}
+		case "p", "m", "n", "V":
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERR_CHANOPRIVSNEEDED,
+				Params:   []string{u.Nick, ch.String()},
+				Trailing: "Mode " + mode + " can't be changed",
+			})
+			continue
+		default:
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERR_UNKNOWNMODE,
+				Params:   []string{u.Nick, mode},
+				Trailing: "is unknown mode char to me for " + ch.String(),
+			})
+			continue
+		}
+
+		if err != nil {
+			u.MsgSpoofUser(u, u.br.Protocol(), "mode "+mode+" could not be changed: "+err.Error())
+			continue
+		}
+		if set {
+			modes[mode] = ""
+		} else {
+			delete(modes, mode)
+		}
+	}
+
+	ch.SetModes(u, modes)
+
+	return u.Encode(r...)
+}
+
 // CmdMotd is a handler for the /MOTD command.
 func CmdMotd(s Server, u *User, _ *irc.Message) error {
 	motd := s.Motd()
@@ -308,7 +469,7 @@ func CmdPart(s Server, u *User, msg *irc.Message) error {
 		// first part on irc
 		ch.Part(u, msg.Trailing)
 		// now part on Delta Chat
-		if !u.v.GetBool(u.br.Protocol() + ".PartFake") {
+		if !u.settingBool("partfake") {
 			err = u.br.Part(ch.ID())
 			if err != nil {
 				return err
@@ -317,10 +478,9 @@ func CmdPart(s Server, u *User, msg *irc.Message) error {
 		// part all other (ghost)users on the channel
 		for _, k := range ch.Users() {
 			ch.Part(k, "")
-			// if we parted, remove channel from include
-			u.v.Set(u.br.Protocol()+".joininclude",
-				removeStringInSlice(chName, u.v.GetStringSlice(u.br.Protocol()+".joininclude")))
 		}
+		// if we parted, remove channel from include
+		u.updateJoinLists(chName, false)
 	}
 
 	u.br.UpdateChannels()
@@ -378,6 +538,16 @@ func CmdPrivMsg(s Server, u *User, msg *irc.Message) error {
 			return nil
 		}
 
+		// mailing lists without post address and broadcast lists of others
+		if ch.HasMode("m") {
+			return u.Encode(&irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERR_CANNOTSENDTOCHAN,
+				Params:   []string{u.Nick, ch.String()},
+				Trailing: "Cannot send to channel (read-only)",
+			})
+		}
+
 		if parseReactionToMsg(u, msg, ch.ID()) {
 			return nil
 		}
@@ -400,7 +570,7 @@ func CmdPrivMsg(s Server, u *User, msg *irc.Message) error {
 		defer u.msgLastMutex.Unlock()
 		u.msgLast[ch.ID()] = [2]string{msgID, ""}
 
-		if u.v.GetBool(u.br.Protocol()+".prefixcontext") || u.v.GetBool(u.br.Protocol()+".suffixcontext") {
+		if u.settingBool("prefixcontext") || u.settingBool("suffixcontext") {
 			u.prefixContext(ch.ID(), msgID, "", "")
 		}
 
@@ -410,7 +580,7 @@ func CmdPrivMsg(s Server, u *User, msg *irc.Message) error {
 	// or a user
 	if toUser, exists := s.HasUser(query); exists {
 		switch {
-		case query == "deltachat": //nolint:goconst
+		case query == "deltachat", query == "deltaircd": //nolint:goconst
 			go u.handleServiceBot(query, toUser, msg.Trailing)
 			msg.Trailing = "<redacted>"
 		case toUser.Ghost, toUser.Me:
@@ -444,7 +614,7 @@ func CmdPrivMsg(s Server, u *User, msg *irc.Message) error {
 			defer u.msgLastMutex.Unlock()
 			u.msgLast[toUser.User] = [2]string{msgID, ""}
 
-			if u.v.GetBool(u.br.Protocol()+".prefixcontext") || u.v.GetBool(u.br.Protocol()+".suffixcontext") {
+			if u.settingBool("prefixcontext") || u.settingBool("suffixcontext") {
 				u.prefixContext(toUser.User, msgID, "", "")
 			}
 
@@ -650,7 +820,7 @@ func threadMsgChannelUser(u *User, msg *irc.Message, channelID string, toUser bo
 	defer u.msgLastMutex.Unlock()
 	u.msgLast[channelID] = [2]string{msgID, threadID}
 
-	if u.v.GetBool(u.br.Protocol()+".prefixcontext") || u.v.GetBool(u.br.Protocol()+".suffixcontext") {
+	if u.settingBool("prefixcontext") || u.settingBool("suffixcontext") {
 		u.prefixContext(channelID, msgID, "", "")
 	}
 
@@ -744,7 +914,7 @@ func CmdWho(s Server, u *User, msg *irc.Message) error {
 
 	for _, other := range ch.Users() {
 		status := "H"
-		if statuses[other.User] != "online" {
+		if !isOnline(other, statuses) || other == u && u.away {
 			status = "G"
 		}
 		// <me> <channel> <user> <host> <server> <nick> [H/G]: 0 <real>
@@ -766,49 +936,238 @@ func CmdWho(s Server, u *User, msg *irc.Message) error {
 	return u.Encode(r...)
 }
 
-// CmdWhois is a handler for the /WHOIS command.
-func CmdWhois(s Server, u *User, msg *irc.Message) error {
-	who := msg.Params[0]
-	if _, ok := s.HasUser(msg.Params[0]); ok {
-		other, _ := s.HasUser(who)
+// monitorLimit is the maximum number of nicks in the MONITOR list.
+const monitorLimit = 100
+
+// CmdMonitor is a handler for the MONITOR command.
+// https://ircv3.net/specs/extensions/monitor
+func CmdMonitor(s Server, u *User, msg *irc.Message) error {
+	var targets []string
+	for _, param := range append(msg.Params[1:], msg.Trailing) {
+		for _, nick := range strings.Split(param, ",") {
+			if nick != "" {
+				targets = append(targets, nick)
+			}
+		}
+	}
+
+	switch msg.Params[0] {
+	case "+":
+		var rejected []string
+		u.monitorMutex.Lock()
+		for i, nick := range targets {
+			if len(u.monitor) >= monitorLimit {
+				rejected = targets[i:]
+				targets = targets[:i]
+				break
+			}
+			u.monitor[strings.ToLower(nick)] = nick
+		}
+		u.monitorMutex.Unlock()
+
+		if len(rejected) > 0 {
+			u.Encode(&irc.Message{ //nolint:errcheck
+				Prefix:   s.Prefix(),
+				Command:  "734", // ERR_MONLISTFULL
+				Params:   []string{u.Nick, strconv.Itoa(monitorLimit), strings.Join(rejected, ",")},
+				Trailing: "Monitor list is full.",
+			})
+		}
+		return u.sendMonitorStatus(targets)
+	case "-":
+		u.monitorMutex.Lock()
+		for _, nick := range targets {
+			delete(u.monitor, strings.ToLower(nick))
+		}
+		u.monitorMutex.Unlock()
+	case "C", "c":
+		u.monitorMutex.Lock()
+		u.monitor = make(map[string]string)
+		u.monitorMutex.Unlock()
+	case "L", "l":
 		var r []*irc.Message
+		nicks := u.monitoredNicks()
+		if len(nicks) > 0 {
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  "732", // RPL_MONLIST
+				Params:   []string{u.Nick},
+				Trailing: strings.Join(nicks, ","),
+			})
+		}
 		r = append(r, &irc.Message{
 			Prefix:   s.Prefix(),
-			Params:   []string{u.Nick, other.Nick, other.User, other.Host, "*"},
-			Command:  irc.RPL_WHOISUSER,
-			Trailing: other.Real,
+			Command:  "733", // RPL_ENDOFMONLIST
+			Params:   []string{u.Nick},
+			Trailing: "End of MONITOR list",
 		})
+		return u.Encode(r...)
+	case "S", "s":
+		return u.sendMonitorStatus(u.monitoredNicks())
+	}
+	return nil
+}
 
-		var chlist string
-		for _, ch := range other.Channels() {
-			chlist += ch.String() + " "
+// CmdWhois is a handler for the /WHOIS command.
+func CmdWhois(s Server, u *User, msg *irc.Message) error {
+	who := msg.Params[0]
+	if u.br == nil {
+		return s.EncodeMessage(u, irc.ERR_NOSUCHNICK, msg.Params, "No such nick/channel")
+	}
+	other, ok := s.HasUser(who)
+	if !ok && strings.ContainsAny(who, "@|") {
+		// an address or nick of a contact we don't have a ghost for yet, the
+		// reply is built from its info without adding a ghost
+		if info := u.br.GetUserByUsername(who); info != nil && !info.Me {
+			other, ok = whoisUser(info), true
+		} else if strings.Contains(who, "@") {
+			return u.Encode(whoisUnknownAddress(s, u, who)...)
 		}
+	}
+	if !ok {
+		return s.EncodeMessage(u, irc.ERR_NOSUCHNICK, msg.Params, "No such nick/channel")
+	}
 
+	var r []*irc.Message
+	r = append(r, &irc.Message{
+		Prefix:   s.Prefix(),
+		Params:   []string{u.Nick, other.Nick, other.User, other.Host, "*"},
+		Command:  irc.RPL_WHOISUSER,
+		Trailing: other.Real,
+	})
+	if fp := other.CertFP(); fp != "" && other == u {
+		// github.com/sorcix/irc doesn't yet support RPL_WHOISCERTFP (276)
 		r = append(r, &irc.Message{
 			Prefix:   s.Prefix(),
 			Params:   []string{u.Nick, other.Nick},
-			Command:  irc.RPL_WHOISCHANNELS,
-			Trailing: chlist,
+			Command:  "276",
+			Trailing: "has client certificate fingerprint " + fp,
 		})
+	}
+
+	var details *bridge.UserDetails
+	if other.Ghost {
+		details, _ = u.br.GetUserDetails(other.User)
+	}
 
-		status, _ := u.br.StatusUser(other.User)
+	var chlist string
+	for _, ch := range other.Channels() {
+		chlist += ch.String() + " "
+	}
+	if details != nil {
+		for _, id := range details.ChannelIDs {
+			if ch, ok := s.HasChannel(id); ok && !ch.HasUser(other) {
+				chlist += ch.String() + " "
+			}
+		}
+	}
+
+	r = append(r, &irc.Message{
+		Prefix:   s.Prefix(),
+		Params:   []string{u.Nick, other.Nick},
+		Command:  irc.RPL_WHOISCHANNELS,
+		Trailing: chlist,
+	})
 
-		if status != "online" {
+	if details != nil {
+		for _, line := range whoisDetails(details) {
 			r = append(r, &irc.Message{
 				Prefix:   s.Prefix(),
 				Params:   []string{u.Nick, other.Nick},
-				Command:  irc.RPL_AWAY,
-				Trailing: status,
+				Command:  "320",
+				Trailing: line,
 			})
 		}
+	}
+
+	status, _ := u.br.StatusUser(other.User)
 
+	if status != "online" {
 		r = append(r, &irc.Message{
 			Prefix:   s.Prefix(),
 			Params:   []string{u.Nick, other.Nick},
+			Command:  irc.RPL_AWAY,
+			Trailing: status,
+		})
+	}
+
+	r = append(r, &irc.Message{
+		Prefix:   s.Prefix(),
+		Params:   []string{u.Nick, other.Nick},
+		Command:  irc.RPL_ENDOFWHOIS,
+		Trailing: "End of /WHOIS list.",
+	})
+	return u.Encode(r...)
+}
+
+// whoisUser returns a user for the info that isn't added to the server.
+func whoisUser(info *bridge.UserInfo) *User {
+	other := NewUser(nil)
+	i := *info
+	i.Nick = sanitizeNick(i.Nick)
+	other.UserInfo = &i
+	return other
+}
+
+// whoisDetails returns the lines sent as 320 (RPL_WHOISSPECIAL) in WHOIS.
+func whoisDetails(details *bridge.UserDetails) []string {
+	var lines []string
+	if details.DisplayName != "" {
+		lines = append(lines, "display name: "+details.DisplayName)
+	}
+	lines = append(lines, "address: "+details.Address)
+	if status := strings.TrimSpace(details.Status); status != "" {
+		lines = append(lines, "status: "+strings.Join(strings.Fields(status), " "))
+	}
+	switch {
+	case details.Online:
+		lines = append(lines, "last seen: online")
+	case details.LastSeen.IsZero():
+		lines = append(lines, "last seen: never")
+	default:
+		lines = append(lines, "last seen: "+details.LastSeen.Format("2006-01-02 15:04"))
+	}
+	switch {
+	case details.Verified && details.VerifiedBy != "":
+		lines = append(lines, "verified by "+details.VerifiedBy)
+	case details.Verified:
+		lines = append(lines, "verified")
+	default:
+		lines = append(lines, "not verified")
+	}
+	if details.Encryption != "" {
+		lines = append(lines, "encryption: "+details.Encryption)
+	}
+	if details.Fingerprint != "" {
+		lines = append(lines, "fingerprint: "+details.Fingerprint)
+	}
+	return lines
+}
+
+// whoisUnknownAddress is the WHOIS reply for an address that isn't a contact.
+func whoisUnknownAddress(s Server, u *User, addr string) []*irc.Message {
+	user, host := addr, ""
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		user, host = addr[:i], addr[i+1:]
+	}
+	return []*irc.Message{
+		{
+			Prefix:   s.Prefix(),
+			Params:   []string{u.Nick, addr, user, host, "*"},
+			Command:  irc.RPL_WHOISUSER,
+			Trailing: addr,
+		},
+		{
+			Prefix:   s.Prefix(),
+			Params:   []string{u.Nick, addr},
+			Command:  "320",
+			Trailing: "is not a contact yet",
+		},
+		{
+			Prefix:   s.Prefix(),
+			Params:   []string{u.Nick, addr},
 			Command:  irc.RPL_ENDOFWHOIS,
 			Trailing: "End of /WHOIS list.",
-		})
-		return u.Encode(r...)
+		},
 	}
-	return s.EncodeMessage(u, irc.ERR_NOSUCHNICK, msg.Params, "No such nick/channel")
 }
@@ -0,0 +1,25 @@
+package irckit
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/sorcix/irc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWhoisBeforeLogin(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	u := NewUserNet(server)
+	defer u.Close()
+
+	go func() {
+		_ = CmdWhois(NewServer("test"), u, &irc.Message{Command: irc.WHOIS, Params: []string{"alice@example.org"}})
+	}()
+	line, err := bufio.NewReader(client).ReadString('\n')
+	require.NoError(t, err)
+	assert.Contains(t, line, " "+irc.ERR_NOSUCHNICK+" ")
+}
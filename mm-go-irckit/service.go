@@ -3,12 +3,17 @@ package irckit
 import (
 	"errors"
 	"fmt"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
 	"github.com/deltachat/deltaircd/bridge"
+	"github.com/muesli/reflow/wordwrap"
+	"github.com/sorcix/irc"
 )
 
 type CommandHandler interface {
@@ -21,6 +26,9 @@ type Command struct {
 	minParams int
 	maxParams int
 	login     bool
+	// raw commands get their last argument verbatim instead of parsed, so
+	// it may contain quotes (e.g. JSON)
+	raw bool
 }
 
 func logout(u *User, toUser *User, args []string, service string) {
@@ -52,41 +60,296 @@ func login(u *User, toUser *User, args []string, service string) {
 		return
 	}
 
+	method := authMethod(u.Credentials, u.CertFP())
+	if method == "certfp" && u.authAllowed("account") {
+		// the account doesn't need a registered certificate
+		method = "account"
+	}
+	if !u.authAllowed(method) {
+		logger.Infof("refused %s login of %s from %s", method, u.Nick, u.RemoteAddr())
+		u.MsgUser(toUser, "logging in with "+method+" is not allowed on this connection")
+		return
+	}
+
+	if method == "certfp" {
+		// the bridge checks that the certificate is registered
+		u.Credentials.CertFP = u.CertFP()
+	}
+
+	if wait := loginWait(u); wait > 0 {
+		u.MsgUser(toUser, fmt.Sprintf("too many failed logins, try again in %s", wait.Round(time.Second)))
+		return
+	}
+
 	u.inprogress = true
 	defer func() { u.inprogress = false }()
 
 	if err := u.loginTo("deltachat"); err != nil {
-		u.MsgUser(toUser, err.Error())
+		// the same reply for every failure, so it doesn't tell which
+		// accounts exist
+		logger.Infof("%s login of %s from %s failed: %v", method, u.Nick, u.RemoteAddr(), err)
+		u.MsgUser(toUser, "login failed, use LOGIN <email> <pass> to log in with a password")
+		if loginFailed(u) {
+			logger.Infof("too many failed logins of %s from %s, disconnecting", u.Nick, u.RemoteAddr())
+			u.Encode(&irc.Message{ //nolint:errcheck
+				Command:  irc.ERROR,
+				Trailing: "Closing Link: Too many failed logins",
+			})
+			u.Conn.Close()
+		}
 		return
 	}
+	loginSucceeded(u)
 
 	u.MsgUser(toUser, "login OK")
 }
 
-//nolint:cyclop
+// authMethod returns how the credentials log in, see config.AuthMethods. An
+// address without a password logs in with the client certificate if there
+// is one.
+func authMethod(cred bridge.Credentials, certfp string) string {
+	switch {
+	case cred.Pass != "":
+		return "password"
+	case strings.HasPrefix(cred.Login, "DCBACKUP:"):
+		return "backup"
+	case certfp != "":
+		return "certfp"
+	default:
+		return "account"
+	}
+}
+
+// SetAuthMethods restricts the ways the user may log in, nil allows all.
+func (u *User) SetAuthMethods(methods []string) {
+	u.authMethods = methods
+}
+
+func (u *User) authAllowed(method string) bool {
+	if u.authMethods == nil {
+		return true
+	}
+	for _, m := range u.authMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+const searchPageSize = 10
+
+type searchQuery struct {
+	target string // #channel or nick, empty searches all chats
+	from   string
+	before time.Time
+	after  time.Time
+	terms  string
+}
+
+type searchState struct {
+	query   *searchQuery
+	fromID  string
+	pending []*deltachat.Message
+}
+
+func searchUsage(u *User, toUser *User) {
+	u.MsgUser(toUser, "need SEARCH [#<channel>|<user>] [from:<user>] [before:<date>] [after:<date>] <terms>")
+	u.MsgUser(toUser, "e.g. SEARCH #bugs from:alice after:2023-01-31 crash (dates are YYYY-MM-DD[THH:MM])")
+	u.MsgUser(toUser, "use SEARCH MORE to show the next results")
+}
+
+func parseSearchDate(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+func parseSearchArgs(args []string) (*searchQuery, error) {
+	query := &searchQuery{}
+	var terms []string
+	for i, arg := range args {
+		var err error
+		switch {
+		case i == 0 && strings.HasPrefix(arg, "#"):
+			query.target = arg
+		case strings.HasPrefix(arg, "from:"):
+			query.from = strings.TrimPrefix(arg, "from:")
+		case strings.HasPrefix(arg, "before:"):
+			query.before, err = parseSearchDate(strings.TrimPrefix(arg, "before:"))
+		case strings.HasPrefix(arg, "after:"):
+			query.after, err = parseSearchDate(strings.TrimPrefix(arg, "after:"))
+		default:
+			terms = append(terms, arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	query.terms = strings.Join(terms, " ")
+	if query.terms == "" {
+		return nil, errors.New("no search terms given")
+	}
+	return query, nil
+}
+
 func search(u *User, toUser *User, args []string, service string) {
-	posts, ok := u.br.SearchPosts(strings.Join(args, " ")).([]*deltachat.MsgSearchResult)
+	if len(args) == 0 {
+		searchUsage(u, toUser)
+		return
+	}
+	if len(args) == 1 && strings.EqualFold(args[0], "more") {
+		searchMore(u, toUser)
+		return
+	}
 
-	if !ok || posts == nil || len(posts) == 0 {
+	// a leading nick restricts the search to the direct chat with that user
+	target := ""
+	if user, exists := u.Srv.HasUser(args[0]); exists && len(args) > 1 && user.Ghost && user.Host != "service" {
+		target = args[0]
+		args = args[1:]
+	}
+
+	query, err := parseSearchArgs(args)
+	if err != nil {
+		u.MsgUser(toUser, err.Error())
+		searchUsage(u, toUser)
+		return
+	}
+	if target != "" {
+		query.target = target
+	}
+
+	channelID := ""
+	switch {
+	case strings.HasPrefix(query.target, "#"):
+		channelID = u.br.GetChannelID(strings.TrimPrefix(query.target, "#"), u.br.GetMe().TeamID)
+		if channelID == "" {
+			u.MsgUser(toUser, "no such channel "+query.target)
+			return
+		}
+	case query.target != "":
+		user, _ := u.Srv.HasUser(query.target)
+		channelID = u.br.GetUserChannelID(user.User, u.br.GetMe().TeamID)
+	}
+
+	state := &searchState{query: query}
+	if query.from != "" {
+		user, exists := u.Srv.HasUser(query.from)
+		if !exists {
+			u.MsgUser(toUser, "unknown user "+query.from)
+			return
+		}
+		state.fromID = user.User
+	}
+
+	posts, ok := u.br.SearchPosts(channelID, query.terms).([]*deltachat.Message)
+	if !ok || len(posts) == 0 {
 		u.MsgUser(toUser, "no results")
 		return
 	}
+	state.pending = posts
 
-	for i := len(posts) - 1; i >= 0; i-- {
-		post := posts[i]
-		timestamp := post.Timestamp.Format("January 02, 2006 15:04")
-		header := "<" + post.AuthorName + "> " + timestamp
-		u.MsgUser(toUser, header)
-		u.MsgUser(toUser, strings.Repeat("=", len(header)))
+	u.searchMutex.Lock()
+	u.search = state
+	u.searchMutex.Unlock()
 
-		for _, post := range strings.Split(post.Message, "\n") {
-			if post != "" {
-				u.MsgUser(toUser, post)
-			}
+	searchMore(u, toUser)
+}
+
+func searchMore(u *User, toUser *User) {
+	u.searchMutex.Lock()
+	defer u.searchMutex.Unlock()
+
+	state := u.search
+	if state == nil || len(state.pending) == 0 {
+		u.MsgUser(toUser, "no more results")
+		return
+	}
+
+	// cache the name and context key of every chat we come across
+	type chatContext struct{ name, key string }
+	chats := make(map[deltachat.ChatId]chatContext)
+
+	shown := 0
+	for shown < searchPageSize && len(state.pending) > 0 {
+		msgData, err := state.pending[0].Snapshot()
+		state.pending = state.pending[1:]
+		if err != nil || !state.matches(msgData) {
+			continue
+		}
+
+		chat, ok := chats[msgData.ChatId]
+		if !ok {
+			chat.name, chat.key = u.searchChatContext(msgData)
+			chats[msgData.ChatId] = chat
+		}
+
+		nick := u.br.GetUser(msgData.Sender).Nick
+		if msgData.IsInfo {
+			nick = systemUser
 		}
-		u.MsgUser(toUser, "")
-		u.MsgUser(toUser, "")
+
+		text := strings.TrimSpace(strings.SplitN(msgData.Text, "\n", 2)[0])
+		if text == "" && msgData.File != "" {
+			text = "file://" + msgData.File
+		}
+		if runes := []rune(text); len(runes) > 200 {
+			text = string(runes[:200]) + "…"
+		}
+
+		msgID := strconv.FormatUint(uint64(msgData.Id), 10)
+		u.MsgUser(toUser, fmt.Sprintf("%s [%s] %s <%s> %s",
+			chat.name, u.messageContextID(chat.key, msgID), msgData.Timestamp.Format("2006-01-02 15:04"), nick, text))
+		shown++
 	}
+
+	switch {
+	case len(state.pending) > 0:
+		u.MsgUser(toUser, "-- more results available, use SEARCH MORE --")
+	case shown == 0:
+		u.MsgUser(toUser, "no more results")
+		u.search = nil
+	default:
+		u.MsgUser(toUser, "-- end of results --")
+		u.search = nil
+	}
+}
+
+func (state *searchState) matches(msgData *deltachat.MsgSnapshot) bool {
+	switch {
+	case state.fromID != "" && strconv.FormatUint(uint64(msgData.FromId), 10) != state.fromID:
+		return false
+	case !state.query.before.IsZero() && !msgData.Timestamp.Before(state.query.before):
+		return false
+	case !state.query.after.IsZero() && msgData.Timestamp.Before(state.query.after):
+		return false
+	}
+	return true
+}
+
+// searchChatContext returns the IRC name of the chat a message belongs to and
+// the key its context IDs are stored under, so that replies and reactions
+// sent to that channel or user resolve them.
+func (u *User) searchChatContext(msgData *deltachat.MsgSnapshot) (string, string) {
+	channelID := strconv.FormatUint(uint64(msgData.ChatId), 10)
+	info, err := u.br.GetChannel(channelID)
+	if err != nil || !info.DM {
+		return u.br.GetChannelName(channelID), channelID
+	}
+
+	users, _ := u.br.GetChannelUsers(channelID)
+	for _, user := range users {
+		if !user.Me {
+			return u.createUserFromInfo(user).Nick, user.User
+		}
+	}
+
+	// chat with ourself
+	return u.Nick, u.User
 }
 
 func searchUsers(u *User, toUser *User, args []string, service string) {
@@ -166,7 +429,7 @@ func scrollback(u *User, toUser *User, args []string, service string) {
 
 		for _, post := range strings.Split(text, "\n") {
 			switch { // nolint:dupl
-			case u.v.GetBool(u.br.Protocol()+".prefixcontext") && strings.HasPrefix(args[0], "#") && nick != "system":
+			case u.settingBool("prefixcontext") && strings.HasPrefix(args[0], "#") && nick != "system":
 				quotedId := ""
 				if msgData.Quote != nil && msgData.Quote.MessageId != 0 {
 					quotedId = strconv.FormatUint(uint64(msgData.Quote.MessageId), 10)
@@ -177,7 +440,7 @@ func scrollback(u *User, toUser *User, args []string, service string) {
 			case strings.HasPrefix(args[0], "#"):
 				scrollbackMsg := "[" + ts.Format("2006-01-02 15:04") + "] " + post
 				spoof(nick, scrollbackMsg)
-			case u.v.GetBool(u.br.Protocol()+".prefixcontext"):
+			case u.settingBool("prefixcontext"):
 				quotedId := ""
 				if msgData.Quote != nil && msgData.Quote.MessageId != 0 {
 					quotedId = strconv.FormatUint(uint64(msgData.Quote.MessageId), 10)
@@ -193,32 +456,244 @@ func scrollback(u *User, toUser *User, args []string, service string) {
 	}
 }
 
+func webxdc(u *User, toUser *User, args []string, service string) {
+	if len(args) != 3 {
+		u.MsgUser(toUser, "need XDC (#<channel>|<user>) <message id> <json>")
+		u.MsgUser(toUser, `e.g. XDC #team 01a {"payload": {"vote": 1}} for [webxdc 01a] (a bare value is sent as the payload)`)
+		return
+	}
+
+	msgID, err := u.contextMessageID(args[0], args[1])
+	if err != nil {
+		u.MsgUser(toUser, err.Error())
+		return
+	}
+	if err := u.br.SendWebxdcUpdate(msgID, args[2]); err != nil {
+		u.MsgUser(toUser, "update could not be sent: "+err.Error())
+		return
+	}
+
+	u.MsgUser(toUser, "update sent")
+}
+
+func ephemeral(u *User, toUser *User, args []string, service string) {
+	usage := func() {
+		u.MsgUser(toUser, "need EPHEMERAL (#<channel>|<user>) [off|<duration>]")
+		u.MsgUser(toUser, "e.g. EPHEMERAL #friends 1d (durations are 30s, 5m, 1h, 1d or 1w)")
+	}
+	if len(args) == 0 || len(args) > 2 {
+		usage()
+		return
+	}
+
+	var channelID string
+	user, exists := u.Srv.HasUser(args[0])
+	switch {
+	case strings.HasPrefix(args[0], "#"):
+		channelID = u.br.GetChannelID(strings.TrimPrefix(args[0], "#"), u.br.GetMe().TeamID)
+	case exists && user.Ghost:
+		channelID = u.br.GetUserChannelID(user.User, u.br.GetMe().TeamID)
+	}
+	if channelID == "" {
+		usage()
+		return
+	}
+
+	if len(args) == 1 {
+		info, err := u.br.GetChannel(channelID)
+		if err != nil {
+			u.MsgUser(toUser, "could not get the chat: "+err.Error())
+			return
+		}
+		if info.EphemeralTimer == 0 {
+			u.MsgUser(toUser, args[0]+": disappearing messages are off")
+		} else {
+			u.MsgUser(toUser, args[0]+": messages disappear after "+formatDuration(info.EphemeralTimer))
+		}
+		return
+	}
+
+	var seconds uint
+	if !strings.EqualFold(args[1], "off") {
+		var err error
+		if seconds, err = parseDuration(args[1]); err != nil {
+			usage()
+			return
+		}
+	}
+
+	if err := u.br.SetChannelEphemeralTimer(channelID, seconds); err != nil {
+		u.MsgUser(toUser, "timer could not be set: "+err.Error())
+		return
+	}
+
+	if seconds == 0 {
+		u.MsgUser(toUser, args[0]+": disappearing messages turned off")
+	} else {
+		u.MsgUser(toUser, args[0]+": messages disappear after "+formatDuration(seconds))
+	}
+}
+
+func alias(u *User, toUser *User, args []string, service string) {
+	usage := func() {
+		u.MsgUser(toUser, "need ALIAS #<channel> [off|<name>]")
+		u.MsgUser(toUser, "e.g. ALIAS #family|12 family (off goes back to the automatic name)")
+	}
+	if len(args) == 0 || len(args) > 2 || !strings.HasPrefix(args[0], "#") {
+		usage()
+		return
+	}
+
+	channelID := u.br.GetChannelID(strings.TrimPrefix(args[0], "#"), u.br.GetMe().TeamID)
+	if _, err := u.br.GetChannel(channelID); err != nil {
+		u.MsgUser(toUser, "could not get the chat: "+err.Error())
+		return
+	}
+
+	if len(args) == 1 {
+		u.MsgUser(toUser, args[0]+" is "+u.br.GetChannelName(channelID))
+		return
+	}
+
+	name := args[1]
+	if strings.EqualFold(name, "off") {
+		name = ""
+	}
+	if err := u.br.SetChannelAlias(channelID, name); err != nil {
+		u.MsgUser(toUser, "alias could not be set: "+err.Error())
+		return
+	}
+
+	u.MsgUser(toUser, args[0]+" is now "+u.br.GetChannelName(channelID))
+}
+
+// htmlMaxLines limits how much of a long HTML message is shown.
+const htmlMaxLines = 200
+
+func showHTML(u *User, toUser *User, args []string, service string) {
+	if len(args) != 2 {
+		u.MsgUser(toUser, "need HTML (#<channel>|<user>) <message id>")
+		u.MsgUser(toUser, "e.g. HTML #news 01a for a message with [full message: html 01a]")
+		return
+	}
+
+	msgID, err := u.contextMessageID(args[0], args[1])
+	if err != nil {
+		u.MsgUser(toUser, err.Error())
+		return
+	}
+	text, err := u.br.GetPostHTML(msgID)
+	if err != nil {
+		u.MsgUser(toUser, "message could not be shown: "+err.Error())
+		return
+	}
+
+	lines := strings.Split(wordwrap.String(text, 440), "\n")
+	if len(lines) > htmlMaxLines {
+		lines = append(lines[:htmlMaxLines], fmt.Sprintf("-- %d more lines not shown --", len(lines)-htmlMaxLines))
+	}
+	for _, line := range lines {
+		if line == "" {
+			line = " "
+		}
+		u.MsgUser(toUser, line)
+	}
+}
+
+func sendLocation(u *User, toUser *User, args []string, service string) {
+	usage := func() {
+		u.MsgUser(toUser, "need SENDLOCATION (#<channel>|<user>) <latitude> <longitude>")
+		u.MsgUser(toUser, "e.g. SENDLOCATION #hiking 46.5584 7.8353")
+	}
+	if len(args) != 3 {
+		usage()
+		return
+	}
+
+	latitude, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || latitude < -90 || latitude > 90 {
+		usage()
+		return
+	}
+	longitude, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || longitude < -180 || longitude > 180 {
+		usage()
+		return
+	}
+
+	var channelID string
+	user, exists := u.Srv.HasUser(args[0])
+	switch {
+	case strings.HasPrefix(args[0], "#"):
+		channelID = u.br.GetChannelID(strings.TrimPrefix(args[0], "#"), u.br.GetMe().TeamID)
+	case exists && user.Ghost:
+		channelID = u.br.GetUserChannelID(user.User, u.br.GetMe().TeamID)
+	default:
+		usage()
+		return
+	}
+
+	if _, err := u.br.MsgChannelLocation(channelID, latitude, longitude); err != nil {
+		u.MsgUser(toUser, "location could not be sent: "+err.Error())
+		return
+	}
+
+	u.MsgUser(toUser, "location sent")
+}
+
 var cmds = map[string]Command{
-	"logout":      {handler: logout, login: true, minParams: 0, maxParams: 0},
-	"login":       {handler: login, minParams: 0, maxParams: 2},
-	"search":      {handler: search, login: true, minParams: 1, maxParams: -1},
-	"searchusers": {handler: searchUsers, login: true, minParams: 1, maxParams: -1},
-	"scrollback":  {handler: scrollback, login: true, minParams: 2, maxParams: 2},
+	"logout":       {handler: logout, login: true, minParams: 0, maxParams: 0},
+	"alias":        {handler: alias, login: true, minParams: 1, maxParams: 2},
+	"certfp":       {handler: certfp, login: true, minParams: 0, maxParams: 2},
+	"ephemeral":    {handler: ephemeral, login: true, minParams: 1, maxParams: 2},
+	"get":          {handler: showSettings, login: true, minParams: 0, maxParams: -1},
+	"html":         {handler: showHTML, login: true, minParams: 2, maxParams: 2},
+	"login":        {handler: login, minParams: 0, maxParams: 2},
+	"search":       {handler: search, login: true, minParams: 1, maxParams: -1},
+	"searchusers":  {handler: searchUsers, login: true, minParams: 1, maxParams: -1},
+	"scrollback":   {handler: scrollback, login: true, minParams: 2, maxParams: 2},
+	"sendlocation": {handler: sendLocation, login: true, minParams: 3, maxParams: 3},
+	"set":          {handler: changeSetting, login: true, minParams: 1, maxParams: -1},
+	"xdc":          {handler: webxdc, login: true, minParams: 3, maxParams: 3, raw: true},
 }
 
 func (u *User) handleServiceBot(service string, toUser *User, msg string) {
+	table := cmds
+	if service == "deltaircd" {
+		if !u.isAdmin() {
+			u.MsgUser(toUser, "Permission denied, you're not an admin.")
+			return
+		}
+		table = adminCmds
+	}
+
 	commands, err := parseCommandString(msg)
 	if err != nil {
-		u.MsgUser(toUser, fmt.Sprintf("\"%s\" is improperly formatted", msg))
-		return
+		// raw commands don't need valid quoting, e.g. the JSON of XDC
+		fields := strings.Fields(msg)
+		if len(fields) == 0 || !table[strings.ToLower(fields[0])].raw {
+			u.MsgUser(toUser, fmt.Sprintf("\"%s\" is improperly formatted", msg))
+			return
+		}
+		commands = fields
 	}
 
-	cmd, ok := cmds[strings.ToLower(commands[0])]
+	cmd, ok := table[strings.ToLower(commands[0])]
 	if !ok {
 		keys := make([]string, 0)
-		for k := range cmds {
+		for k := range table {
 			keys = append(keys, k)
 		}
+		sort.Strings(keys)
 		u.MsgUser(toUser, "possible commands: "+strings.Join(keys, ", "))
 		u.MsgUser(toUser, "<command> help for more info")
 		return
 	}
 
+	if cmd.raw && cmd.maxParams > 0 {
+		commands = regexp.MustCompile(`\s+`).Split(strings.TrimSpace(msg), cmd.maxParams+1)
+	}
+
 	if cmd.login {
 		if u.br == nil {
 			u.MsgUser(toUser, "You're not logged in. Use LOGIN first.")
@@ -235,6 +710,10 @@ func (u *User) handleServiceBot(service string, toUser *User, msg string) {
 		u.MsgUser(toUser, fmt.Sprintf("%s takes at most %v arguments", commands[0], cmd.maxParams))
 		return
 	}
+	if service == "deltaircd" && len(commands[1:]) < cmd.minParams {
+		u.MsgUser(toUser, fmt.Sprintf("%s requires at least %v arguments", commands[0], cmd.minParams))
+		return
+	}
 
 	cmd.handler(u, toUser, commands[1:], service)
 }
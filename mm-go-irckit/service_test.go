@@ -3,7 +3,11 @@ package irckit
 import (
 	"fmt"
 	"testing"
+	"time"
 
+	"github.com/deltachat/deltaircd/bridge"
+	"github.com/deltachat/deltaircd/config"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -104,3 +108,71 @@ func TestParseCommandString(t *testing.T) {
 		}
 	}
 }
+
+func TestParseSearchArgs(t *testing.T) {
+	query, err := parseSearchArgs([]string{"#bugs", "from:alice", "after:2023-01-31", "before:2023-02-01T12:30", "crash", "report"})
+	assert.Nil(t, err)
+	assert.Equal(t, "#bugs", query.target)
+	assert.Equal(t, "alice", query.from)
+	assert.Equal(t, "crash report", query.terms)
+	assert.Equal(t, time.Date(2023, 1, 31, 0, 0, 0, 0, time.Local), query.after)
+	assert.Equal(t, time.Date(2023, 2, 1, 12, 30, 0, 0, time.Local), query.before)
+
+	query, err = parseSearchArgs([]string{"hello", "#world"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", query.target)
+	assert.Equal(t, "hello #world", query.terms)
+
+	_, err = parseSearchArgs([]string{"#bugs", "from:alice"})
+	assert.NotNil(t, err)
+
+	_, err = parseSearchArgs([]string{"after:yesterday", "crash"})
+	assert.NotNil(t, err)
+}
+
+func TestParseDuration(t *testing.T) {
+	seconds, err := parseDuration("1d")
+	assert.Nil(t, err)
+	assert.Equal(t, uint(86400), seconds)
+	assert.Equal(t, "1d", formatDuration(seconds))
+
+	seconds, err = parseDuration("90")
+	assert.Nil(t, err)
+	assert.Equal(t, "90s", formatDuration(seconds))
+	assert.Equal(t, "36h", formatDuration(36*60*60))
+
+	_, err = parseDuration("soon")
+	assert.NotNil(t, err)
+}
+
+// accountBridge is logged in as admin@example.org.
+type accountBridge struct {
+	bridge.Bridger
+	lookups int
+}
+
+func (b *accountBridge) Connected() bool { return true }
+
+func (b *accountBridge) GetMe() *bridge.UserInfo { return &bridge.UserInfo{User: "1"} }
+
+func (b *accountBridge) GetUserDetails(userID string) (*bridge.UserDetails, error) {
+	b.lookups++
+	return &bridge.UserDetails{Address: "admin@example.org"}, nil
+}
+
+func TestIsAdmin(t *testing.T) {
+	br := &accountBridge{}
+	u := NewUser(&recordConn{})
+	u.cfg = config.NewConfig(viper.New())
+	u.v().Set("admins", []string{"Admin@example.org"})
+	assert.False(t, u.isAdmin())
+
+	// the address is looked up once and kept until logout
+	u.br = br
+	assert.True(t, u.isAdmin())
+	assert.True(t, u.isAdmin())
+	assert.Equal(t, 1, br.lookups)
+
+	u.v().Set("admins", []string{"other@example.org"})
+	assert.False(t, u.isAdmin())
+}
@@ -0,0 +1,172 @@
+package irckit
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/deltachat/deltaircd/bridge"
+	"github.com/sorcix/irc"
+)
+
+// sessions are the connected users of all servers.
+var sessions = struct {
+	sync.Mutex
+	users  map[*User]struct{}
+	lastID int
+}{users: make(map[*User]struct{})}
+
+func addSession(u *User) {
+	sessions.Lock()
+	defer sessions.Unlock()
+	sessions.lastID++
+	u.sessionID = sessions.lastID
+	u.connectedAt = time.Now()
+	sessions.users[u] = struct{}{}
+}
+
+func removeSession(u *User) {
+	sessions.Lock()
+	defer sessions.Unlock()
+	delete(sessions.users, u)
+}
+
+// Sessions returns the connected users, oldest first.
+func Sessions() []*User {
+	sessions.Lock()
+	defer sessions.Unlock()
+	users := make([]*User, 0, len(sessions.users))
+	for u := range sessions.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].sessionID < users[j].sessionID })
+	return users
+}
+
+// SessionID returns the number of the session, starting at 1 and unique for
+// the lifetime of the process.
+func (u *User) SessionID() int {
+	return u.sessionID
+}
+
+// ConnectedAt returns when the handshake of the session completed.
+func (u *User) ConnectedAt() time.Time {
+	return u.connectedAt
+}
+
+// Bridge returns the bridge of the session, nil if it never logged in.
+func (u *User) Bridge() bridge.Bridger {
+	if u.br == nil || !u.br.Connected() {
+		return nil
+	}
+	return u.br
+}
+
+// Account returns the email address of the logged in account, or "". The
+// address is kept from the login, it is only looked up if that failed.
+func (u *User) Account() string {
+	br := u.Bridge()
+	if br == nil {
+		return ""
+	}
+
+	u.RLock()
+	account := u.account
+	u.RUnlock()
+	if account != "" {
+		return account
+	}
+
+	details, err := br.GetUserDetails(br.GetMe().User)
+	if err != nil {
+		return ""
+	}
+	u.Lock()
+	u.account = details.Address
+	u.Unlock()
+	return details.Address
+}
+
+// Logout logs the session out of its account, the IRC connection stays open.
+func (u *User) Logout() error {
+	if u.br == nil {
+		return nil
+	}
+	if err := u.br.Logout(); err != nil {
+		return err
+	}
+	return u.logoutFrom(u.br.Protocol())
+}
+
+// Shutdown tells every session that the server stops and closes the
+// connections. The sessions flush their paste buffer and log out, Shutdown
+// waits for that until the timeout.
+func Shutdown(reason string, timeout time.Duration) {
+	for _, u := range Sessions() {
+		u.Encode(&irc.Message{ //nolint:errcheck
+			Prefix:   u.Srv.Prefix(),
+			Command:  irc.NOTICE,
+			Params:   []string{u.Nick},
+			Trailing: reason,
+		}, &irc.Message{
+			Command:  irc.ERROR,
+			Trailing: "Closing Link: " + reason,
+		})
+		// closing waits for the ERROR to be sent, don't wait for one
+		// client after another
+		go u.Conn.Close()
+	}
+
+	deadline := time.Now().Add(timeout)
+	for len(Sessions()) > 0 {
+		if time.Now().After(deadline) {
+			logger.Errorf("%d sessions did not quit in %s", len(Sessions()), timeout)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// ApplyConfig applies a reloaded config to the running sessions, changed are
+// the lowercased keys that changed. Most options are read when they are used,
+// the join lists need the channels to be joined or parted again.
+func ApplyConfig(changed []string) {
+	for _, u := range Sessions() {
+		u.applyConfig(changed)
+	}
+}
+
+func (u *User) applyConfig(changed []string) {
+	if u.br == nil || !u.br.Connected() {
+		return
+	}
+
+	protocol := u.br.Protocol()
+	for _, key := range changed {
+		switch key {
+		case protocol + ".joinonly", protocol + ".joininclude", protocol + ".joinexclude":
+			logger.Debugf("join lists of %s changed, syncing channels", u.Nick)
+			u.syncJoins()
+			return
+		}
+	}
+}
+
+// syncJoins joins the channels mayJoin allows now and parts the ones it
+// doesn't allow anymore. With SkipJoinOnStart channels are only parted.
+func (u *User) syncJoins() {
+	skipJoin := u.settingBool("skipjoinonstart")
+	for _, info := range u.br.GetChannels() {
+		if info.DM {
+			continue
+		}
+		ch := u.Srv.Channel(info.ID)
+		mayJoin := u.mayJoin(info.ID)
+		switch {
+		case mayJoin && !skipJoin && !ch.HasUser(u):
+			u.syncChannel(info.ID, ch.String())
+		case !mayJoin && ch.HasUser(u):
+			ch.Part(u, "excluded by the configuration")
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package irckit
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type settingKind int
+
+const (
+	settingBool settingKind = iota
+	settingString
+	settingList // space separated
+)
+
+// userSettingKeys are the settings a user can change with the set command,
+// the global configuration of the protocol is the default.
+var userSettingKeys = map[string]settingKind{
+	"hidereactions":      settingBool,
+	"joinexclude":        settingList,
+	"joininclude":        settingList,
+	"joinonly":           settingList,
+	"partfake":           settingBool,
+	"prefixcontext":      settingBool,
+	"showcontextmulti":   settingBool,
+	"showmentions":       settingBool,
+	"skipjoinonstart":    settingBool,
+	"suffixcontext":      settingBool,
+	"syntaxhighlighting": settingString,
+}
+
+// userSettings are the settings of a user, stored with the account.
+type userSettings struct {
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+// loadSettings reads the settings of the account from the bridge.
+func (u *User) loadSettings() {
+	values, err := u.br.GetSettings()
+	if err != nil {
+		logger.Errorf("failed to load settings: %v", err)
+	}
+	if values == nil {
+		values = make(map[string]string)
+	}
+	u.settings.mu.Lock()
+	u.settings.values = values
+	u.settings.mu.Unlock()
+}
+
+func (u *User) setting(key string) (string, bool) {
+	u.settings.mu.RLock()
+	defer u.settings.mu.RUnlock()
+	value, ok := u.settings.values[key]
+	return value, ok
+}
+
+// settingBool returns the value of a boolean setting of the user, or the
+// global one if the user didn't set it.
+func (u *User) settingBool(key string) bool {
+	if value, ok := u.setting(key); ok {
+		b, _ := strconv.ParseBool(value)
+		return b
+	}
+	return u.v().GetBool(u.br.Protocol() + "." + key)
+}
+
+func (u *User) settingString(key string) string {
+	if value, ok := u.setting(key); ok {
+		return value
+	}
+	return u.v().GetString(u.br.Protocol() + "." + key)
+}
+
+func (u *User) settingList(key string) []string {
+	if value, ok := u.setting(key); ok {
+		return strings.Fields(value)
+	}
+	return u.v().GetStringSlice(u.br.Protocol() + "." + key)
+}
+
+// setSetting changes a setting of the user and stores it, an empty value
+// goes back to the global default.
+func (u *User) setSetting(key, value string) error {
+	kind, ok := userSettingKeys[key]
+	if !ok {
+		return fmt.Errorf("unknown setting %s", key)
+	}
+	if kind == settingBool && value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s needs true or false", key)
+		}
+		value = strconv.FormatBool(b)
+	}
+	if kind == settingList {
+		for _, entry := range strings.Fields(value) {
+			if _, err := regexp.Compile(entry); err != nil {
+				return fmt.Errorf("%s is not a valid regular expression: %v", entry, err)
+			}
+		}
+	}
+
+	return u.storeSetting(key, value)
+}
+
+// storeSetting changes and stores a setting without checking it, an empty
+// value removes it.
+func (u *User) storeSetting(key, value string) error {
+	u.settings.mu.Lock()
+	defer u.settings.mu.Unlock()
+
+	values := make(map[string]string, len(u.settings.values)+1)
+	for k, v := range u.settings.values {
+		values[k] = v
+	}
+	if value == "" {
+		delete(values, key)
+	} else {
+		values[key] = value
+	}
+	if err := u.br.SaveSettings(values); err != nil {
+		return err
+	}
+	u.settings.values = values
+	return nil
+}
+
+// setSettingList is setSetting for list settings, an empty list is kept as
+// such instead of going back to the global default.
+func (u *User) setSettingList(key string, list []string) error {
+	value := strings.Join(list, " ")
+	if value == "" {
+		value = " "
+	}
+	return u.setSetting(key, value)
+}
+
+// channelPattern returns the join list entry matching only the channel.
+func channelPattern(channel string) string {
+	return "^" + regexp.QuoteMeta(channel) + "$"
+}
+
+// updateJoinLists keeps the join lists of the user in sync with JOIN and
+// PART, so it's remembered after a restart. Joined channels are removed from
+// joinexclude and added to joininclude if it is used, parted channels are
+// removed from joininclude.
+func (u *User) updateJoinLists(channel string, joined bool) {
+	pattern := channelPattern(channel)
+	remove := func(list []string) []string {
+		return removeStringInSlice(pattern, removeStringInSlice(channel, list))
+	}
+
+	include := u.settingList("joininclude")
+	exclude := u.settingList("joinexclude")
+	newInclude, newExclude := remove(include), remove(exclude)
+	if joined {
+		if len(include) > 0 {
+			newInclude = append(newInclude, pattern)
+		}
+	} else {
+		newExclude = exclude
+	}
+
+	for key, lists := range map[string][2][]string{
+		"joininclude": {include, newInclude},
+		"joinexclude": {exclude, newExclude},
+	} {
+		if strings.Join(lists[0], " ") == strings.Join(lists[1], " ") {
+			continue
+		}
+		if err := u.setSettingList(key, lists[1]); err != nil {
+			logger.Errorf("failed to update %s: %v", key, err)
+		}
+	}
+}
+
+// formatSetting returns the value of a setting as shown by get.
+func (u *User) formatSetting(key string) string {
+	var value string
+	switch userSettingKeys[key] {
+	case settingBool:
+		value = strconv.FormatBool(u.settingBool(key))
+	case settingString:
+		value = strconv.Quote(u.settingString(key))
+	case settingList:
+		value = "[" + strings.Join(u.settingList(key), " ") + "]"
+	}
+	if _, ok := u.setting(key); !ok {
+		value += " (default)"
+	}
+	return key + " = " + value
+}
+
+func showSettings(u *User, toUser *User, args []string, service string) {
+	keys := args
+	if len(keys) == 0 {
+		for key := range userSettingKeys {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+	for _, key := range keys {
+		key = strings.ToLower(key)
+		if _, ok := userSettingKeys[key]; !ok {
+			u.MsgUser(toUser, "unknown setting "+key)
+			continue
+		}
+		u.MsgUser(toUser, u.formatSetting(key))
+	}
+}
+
+func changeSetting(u *User, toUser *User, args []string, service string) {
+	if len(args) == 0 {
+		u.MsgUser(toUser, "need SET <setting> [<value>], see GET for the settings")
+		return
+	}
+	key := strings.ToLower(args[0])
+	kind, ok := userSettingKeys[key]
+	if !ok {
+		u.MsgUser(toUser, "unknown setting "+key+", see GET for the settings")
+		return
+	}
+	if kind != settingList && len(args) > 2 {
+		u.MsgUser(toUser, "need SET "+key+" [<value>]")
+		return
+	}
+
+	var err error
+	switch {
+	case len(args) == 1:
+		err = u.setSetting(key, "")
+	case kind == settingList:
+		err = u.setSettingList(key, args[1:])
+	default:
+		err = u.setSetting(key, args[1])
+	}
+	if err != nil {
+		u.MsgUser(toUser, "setting could not be changed: "+err.Error())
+		return
+	}
+	u.MsgUser(toUser, u.formatSetting(key))
+}
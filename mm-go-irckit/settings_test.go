@@ -0,0 +1,135 @@
+package irckit
+
+import (
+	"testing"
+
+	"github.com/deltachat/deltaircd/bridge"
+	"github.com/deltachat/deltaircd/config"
+	"github.com/sorcix/irc"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// settingsBridge stores the settings of a test user.
+type settingsBridge struct {
+	bridge.Bridger
+	saved map[string]string
+}
+
+func (b *settingsBridge) Protocol() string { return "deltachat" }
+
+func (b *settingsBridge) GetSettings() (map[string]string, error) { return b.saved, nil }
+
+func (b *settingsBridge) SaveSettings(settings map[string]string) error {
+	b.saved = settings
+	return nil
+}
+
+// recordConn keeps the messages sent to a test user.
+type recordConn struct {
+	Conn
+	msgs []*irc.Message
+}
+
+func (c *recordConn) Encode(msg *irc.Message) error {
+	c.msgs = append(c.msgs, msg)
+	return nil
+}
+
+func newSettingsUser(t *testing.T) (*User, *settingsBridge, *recordConn) {
+	t.Helper()
+	conn := &recordConn{}
+	u := NewUser(conn)
+	u.Nick = "me"
+	u.cfg = config.NewConfig(viper.New())
+	br := &settingsBridge{}
+	u.br = br
+	u.loadSettings()
+	return u, br, conn
+}
+
+func TestSetSetting(t *testing.T) {
+	tests := []struct {
+		key, value string
+		stored     string // empty if the setting is removed
+		err        bool
+	}{
+		{key: "partfake", value: "true", stored: "true"},
+		{key: "partfake", value: "1", stored: "true"},
+		{key: "partfake", value: "yes", err: true},
+		{key: "partfake", value: ""},
+		{key: "syntaxhighlighting", value: "monokai", stored: "monokai"},
+		{key: "joinexclude", value: "^#a$ #b.*", stored: "^#a$ #b.*"},
+		{key: "joinexclude", value: "#(", err: true},
+		{key: "nosuchsetting", value: "true", err: true},
+	}
+	for _, test := range tests {
+		u, br, _ := newSettingsUser(t)
+		err := u.setSetting(test.key, test.value)
+		if test.err {
+			assert.Error(t, err, "%s = %q", test.key, test.value)
+			assert.Empty(t, br.saved, "%s = %q", test.key, test.value)
+			continue
+		}
+		require.NoError(t, err, "%s = %q", test.key, test.value)
+		value, ok := br.saved[test.key]
+		assert.Equal(t, test.stored != "", ok, "%s = %q", test.key, test.value)
+		assert.Equal(t, test.stored, value, "%s = %q", test.key, test.value)
+	}
+}
+
+func TestSettingDefaults(t *testing.T) {
+	u, _, _ := newSettingsUser(t)
+	u.v().Set("deltachat.partfake", true)
+	u.v().Set("deltachat.joinexclude", []string{"#global"})
+	assert.True(t, u.settingBool("partfake"))
+	assert.Equal(t, []string{"#global"}, u.settingList("joinexclude"))
+
+	require.NoError(t, u.setSetting("partfake", "false"))
+	require.NoError(t, u.setSettingList("joinexclude", nil))
+	assert.False(t, u.settingBool("partfake"))
+	assert.Empty(t, u.settingList("joinexclude"), "an empty list overrides the default")
+
+	require.NoError(t, u.setSetting("partfake", ""))
+	assert.True(t, u.settingBool("partfake"))
+}
+
+func TestChangeSettingUsage(t *testing.T) {
+	u, br, conn := newSettingsUser(t)
+	service := NewUser(nil)
+	service.Nick = "deltachat"
+
+	changeSetting(u, service, nil, "deltachat")
+	require.Len(t, conn.msgs, 1)
+	assert.Contains(t, conn.msgs[0].Trailing, "need SET")
+
+	changeSetting(u, service, []string{"PartFake", "true"}, "deltachat")
+	assert.Equal(t, "true", br.saved["partfake"])
+}
+
+func TestUpdateJoinLists(t *testing.T) {
+	u, br, _ := newSettingsUser(t)
+	require.NoError(t, u.setSettingList("joinexclude", []string{"#a", "#b"}))
+
+	u.updateJoinLists("#a", true)
+	assert.Equal(t, "#b", br.saved["joinexclude"], "joined channels aren't excluded")
+	_, ok := br.saved["joininclude"]
+	assert.False(t, ok, "joininclude isn't used")
+
+	require.NoError(t, u.setSettingList("joininclude", []string{"#c"}))
+	u.updateJoinLists("#a.b", true)
+	assert.Equal(t, `#c ^#a\.b$`, br.saved["joininclude"])
+
+	u.v().Set("deltachat.partfake", true)
+	u.updateJoinLists("#a.b", false)
+	assert.Equal(t, "#c", br.saved["joininclude"])
+	assert.Equal(t, "#b", br.saved["joinexclude"], "parting doesn't exclude")
+
+	// the lists are loaded again after a restart
+	u2, _, _ := newSettingsUser(t)
+	u2.br = br
+	u2.loadSettings()
+	assert.Equal(t, []string{"#c"}, u2.settingList("joininclude"))
+	assert.Equal(t, []string{"#b"}, u2.settingList("joinexclude"))
+}
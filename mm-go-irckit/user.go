@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/deltachat/deltaircd/bridge"
+	"github.com/deltachat/deltaircd/config"
 	"github.com/desertbit/timer"
 	"github.com/sorcix/irc"
 	"github.com/spf13/viper"
@@ -28,11 +30,7 @@ func NewUser(c Conn) *User {
 
 // NewUserNet creates a *User from a net.Conn connection.
 func NewUserNet(c net.Conn) *User {
-	return NewUser(&conn{
-		Conn:    c,
-		Encoder: irc.NewEncoder(c),
-		Decoder: irc.NewDecoder(c),
-	})
+	return NewUser(newConn(c, defaultSendQueue, defaultWriteTimeout))
 }
 
 const defaultCloseMsg = "Closed."
@@ -47,12 +45,59 @@ type User struct {
 	DecodeCh    chan *irc.Message
 
 	channels map[Channel]struct{}
+	caps     map[string]bool // enabled IRCv3 capabilities
+	account  string          // address of the logged in account
 
-	v *viper.Viper
+	sessionID   int // set when the handshake completed
+	connectedAt time.Time
+	authMethods []string // allowed by the listener, nil allows all
+	remoteAddr  net.Addr // set by a WEBIRC gateway
+	connIP      string   // counted for MaxConnectionsPerIP
+	flood       floodLimiter
+	activity    activity // for the keepalive
+
+	cfg *config.Config
 
 	UserBridge
 }
 
+// v returns the current config.
+func (u *User) v() *viper.Viper {
+	return u.cfg.Viper()
+}
+
+// HasCap returns whether the client enabled the IRCv3 capability.
+func (u *User) HasCap(capability string) bool {
+	u.RLock()
+	defer u.RUnlock()
+	return u.caps[capability]
+}
+
+// Caps returns the enabled IRCv3 capabilities.
+func (u *User) Caps() []string {
+	u.RLock()
+	defer u.RUnlock()
+	var caps []string
+	for c := range u.caps {
+		caps = append(caps, c)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+func (u *User) setCap(capability string, enabled bool) {
+	u.Lock()
+	defer u.Unlock()
+	if u.caps == nil {
+		u.caps = make(map[string]bool)
+	}
+	if enabled {
+		u.caps[capability] = true
+	} else {
+		delete(u.caps, capability)
+	}
+}
+
 func (u *User) ID() string {
 	// return strings.ToLower(u.Nick)
 	return strings.ToLower(u.User)
@@ -152,15 +197,21 @@ func (u *User) Decode() {
 	}
 	buffer := make(chan *irc.Message)
 	stop := make(chan struct{})
-	bufferTimeout := u.v.GetInt("PasteBufferTimeout")
-	// we need at least 100
-	if bufferTimeout < 100 {
-		bufferTimeout = 100
+	// read for every buffer, so config reloads apply
+	bufferTimeout := func() time.Duration {
+		timeout := u.v().GetInt("PasteBufferTimeout")
+		// we need at least 100
+		if timeout < 100 {
+			timeout = 100
+		}
+		return time.Duration(timeout) * time.Millisecond
 	}
-	logger.Debugf("using paste buffer timeout: %#v", bufferTimeout)
-	t := timer.NewTimer(time.Duration(bufferTimeout) * time.Millisecond)
+	logger.Debugf("using paste buffer timeout: %v", bufferTimeout())
+	t := timer.NewTimer(bufferTimeout())
 	t.Stop()
+	done := make(chan struct{})
 	go func(buffer chan *irc.Message, stop chan struct{}) {
+		defer close(done)
 		for {
 			select {
 			case msg := <-buffer:
@@ -168,7 +219,7 @@ func (u *User) Decode() {
 				if u.BufferedMsg == nil {
 					u.BufferedMsg = msg
 					// start timer now
-					t.Reset(time.Duration(bufferTimeout) * time.Millisecond)
+					t.Reset(bufferTimeout())
 				} else {
 					replyRe := regexp.MustCompile(`\@\@(?:[0-9a-z]{26}|[0-9a-f]{3}|!!)\s`)
 					modifyRe := regexp.MustCompile(`^s/(?:[0-9a-z]{26}|[0-9a-f]{3}|!!)?/`)
@@ -200,6 +251,13 @@ func (u *User) Decode() {
 					t.Stop()
 				}
 			case <-stop:
+				// don't lose a paste when the connection is closed
+				if u.BufferedMsg != nil {
+					u.BufferedMsg.Trailing = strings.TrimSpace(u.BufferedMsg.Trailing)
+					logger.Debugf("flushing buffer on close: %#v", u.BufferedMsg)
+					u.DecodeCh <- u.BufferedMsg
+					u.BufferedMsg = nil
+				}
 				logger.Debug("closing decode()")
 				return
 			}
@@ -215,6 +273,7 @@ func (u *User) Decode() {
 			break
 		}
 
+		u.activity.touch()
 		if msg == nil {
 			continue
 		}
@@ -236,6 +295,9 @@ func (u *User) Decode() {
 			u.DecodeCh <- msg
 		}
 	}
+	// the server quits the user when DecodeCh is closed
+	<-done
+	close(u.DecodeCh)
 }
 
 func (u *User) createService(nick string, what string) {
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -12,9 +14,10 @@ import (
 	"github.com/davecgh/go-spew/spew"
 	"github.com/deltachat/deltaircd/bridge"
 	"github.com/deltachat/deltaircd/bridge/deltachat"
+	"github.com/deltachat/deltaircd/config"
+	"github.com/deltachat/deltaircd/metrics"
 	"github.com/muesli/reflow/wordwrap"
 	"github.com/sorcix/irc"
-	"github.com/spf13/viper"
 )
 
 const systemUser = "system"
@@ -37,22 +40,29 @@ type UserBridge struct {
 
 	updateCounterMutex sync.Mutex           //nolint:structcheck
 	updateCounter      map[string]time.Time //nolint:structcheck
+
+	searchMutex sync.Mutex   //nolint:structcheck
+	search      *searchState //nolint:structcheck
+
+	monitorMutex sync.Mutex        //nolint:structcheck
+	monitor      map[string]string //nolint:structcheck
+
+	settings userSettings //nolint:structcheck
 }
 
-func NewUserBridge(c net.Conn, srv Server, cfg *viper.Viper) *User {
-	u := NewUser(&conn{
-		Conn:    c,
-		Encoder: irc.NewEncoder(c),
-		Decoder: irc.NewDecoder(c),
-	})
+func NewUserBridge(c net.Conn, srv Server, cfg *config.Config) *User {
+	v := cfg.Viper()
+	writeTimeout := time.Duration(configInt(v, "WriteTimeout", 30)) * time.Second
+	u := NewUser(newConn(c, v.GetInt("SendQueue"), writeTimeout))
 
 	u.Srv = srv
-	u.v = cfg
+	u.cfg = cfg
 	u.msgLast = make(map[string][2]string)
 	u.msgMap = make(map[string]map[string]int)
 	u.msgCounter = make(map[string]int)
 	u.updateCounter = make(map[string]time.Time)
 	u.eventChan = make(chan *bridge.Event, 1000)
+	u.monitor = make(map[string]string)
 
 	// used for login
 	u.createService("deltachat", "loginservice")
@@ -65,11 +75,19 @@ func (u *User) handleEventChan() {
 		logger.Tracef("eventchan %s", spew.Sdump(event))
 		switch e := event.Data.(type) {
 		case *bridge.ChannelMessageEvent:
+			metrics.MessagesReceived.Inc()
 			u.handleChannelMessageEvent(e)
 		case *bridge.DirectMessageEvent:
+			metrics.MessagesReceived.Inc()
 			u.handleDirectMessageEvent(e)
 		case *bridge.ChannelTopicEvent:
 			u.handleChannelTopicEvent(e)
+		case *bridge.ChannelModeEvent:
+			u.handleChannelModeEvent(e)
+		case *bridge.ChannelRenameEvent:
+			u.handleChannelRenameEvent(e)
+		case *bridge.MessagesDeletedEvent:
+			u.handleMessagesDeletedEvent(e)
 		case *bridge.FileEvent:
 			u.handleFileEvent(e)
 		case *bridge.ChannelAddEvent:
@@ -88,6 +106,8 @@ func (u *User) handleEventChan() {
 			u.handleReactionEvent(e)
 		case *bridge.LogoutEvent:
 			return
+		default:
+			logger.Debugf("no handler for event %T", e)
 		}
 	}
 }
@@ -108,8 +128,155 @@ func (u *User) handleChannelTopicEvent(event *bridge.ChannelTopicEvent) {
 	logger.Errorf("topic change failure: userID %s not found", event.UserID)
 }
 
+func (u *User) handleChannelModeEvent(event *bridge.ChannelModeEvent) {
+	ch, ok := u.Srv.HasChannel(event.ChannelID)
+	if !ok {
+		return
+	}
+
+	svc, _ := u.Srv.HasUser(u.br.Protocol())
+	ch.SetModes(svc, channelModes(event.Info))
+}
+
+func (u *User) handleChannelRenameEvent(event *bridge.ChannelRenameEvent) {
+	// channels that don't exist yet get the new name when created
+	ch, ok := u.Srv.HasChannel(event.ChannelID)
+	if !ok {
+		return
+	}
+
+	if !u.Srv.RenameChannel(ch, event.Name) {
+		logger.Errorf("rename of %s to %s failed: name is used by another channel", ch.String(), event.Name)
+	}
+}
+
+// handleMessagesDeletedEvent forgets the context IDs of deleted messages, so
+// they can't be replied to and don't reveal expired ephemeral messages.
+func (u *User) handleMessagesDeletedEvent(event *bridge.MessagesDeletedEvent) {
+	key := event.ChannelID
+	if event.UserID != "" {
+		key = event.UserID
+	}
+
+	u.msgLastMutex.RLock()
+	last, hasLast := u.msgLast[key]
+	u.msgLastMutex.RUnlock()
+
+	u.msgMapMutex.RLock()
+	msgIDs := make([]string, 0, len(u.msgMap[key])+1)
+	for msgID := range u.msgMap[key] {
+		msgIDs = append(msgIDs, msgID)
+	}
+	if _, ok := u.msgMap[key][last[0]]; hasLast && !ok {
+		msgIDs = append(msgIDs, last[0])
+	}
+	u.msgMapMutex.RUnlock()
+
+	if len(msgIDs) == 0 {
+		return
+	}
+	deleted, err := u.br.DeletedMessages(event.ChannelID, msgIDs)
+	if err != nil {
+		logger.Errorf("failed to check for deleted messages in %s: %s", event.ChannelID, err)
+		return
+	}
+	if len(deleted) == 0 {
+		return
+	}
+
+	u.msgMapMutex.Lock()
+	for _, msgID := range deleted {
+		delete(u.msgMap[key], msgID)
+	}
+	u.msgMapMutex.Unlock()
+
+	u.msgLastMutex.Lock()
+	for _, msgID := range deleted {
+		if last, ok := u.msgLast[key]; ok && last[0] == msgID {
+			delete(u.msgLast, key)
+		}
+	}
+	u.msgLastMutex.Unlock()
+}
+
+// handleGhostStatusChange sends away-notify AWAY messages and MONITOR
+// replies when a contact comes online or goes away.
+func (u *User) handleGhostStatusChange(ghost *User, status string) {
+	if u.HasCap("away-notify") {
+		msg := &irc.Message{
+			Prefix:  ghost.Prefix(),
+			Command: irc.AWAY,
+		}
+		if status != "online" {
+			msg.Trailing, _ = u.br.StatusUser(ghost.User)
+			if msg.Trailing == "" {
+				msg.Trailing = status
+			}
+		}
+		u.Encode(msg) //nolint:errcheck
+	}
+
+	u.monitorMutex.Lock()
+	_, monitored := u.monitor[strings.ToLower(ghost.Nick)]
+	u.monitorMutex.Unlock()
+	if monitored {
+		u.sendMonitorStatus([]string{ghost.Nick}) //nolint:errcheck
+	}
+}
+
+// isOnline returns whether other is present, only contacts can be away.
+func isOnline(other *User, statuses map[string]string) bool {
+	status, ok := statuses[other.User]
+	return !other.Ghost || !ok || status == "online"
+}
+
+func (u *User) monitoredNicks() []string {
+	u.monitorMutex.Lock()
+	defer u.monitorMutex.Unlock()
+
+	nicks := make([]string, 0, len(u.monitor))
+	for _, nick := range u.monitor {
+		nicks = append(nicks, nick)
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
+// sendMonitorStatus sends RPL_MONONLINE and RPL_MONOFFLINE for the nicks.
+func (u *User) sendMonitorStatus(nicks []string) error {
+	statuses, _ := u.br.StatusUsers()
+
+	var online, offline []string
+	for _, nick := range nicks {
+		if other, ok := u.Srv.HasUser(nick); ok && isOnline(other, statuses) {
+			online = append(online, other.Prefix().String())
+		} else {
+			offline = append(offline, nick)
+		}
+	}
+
+	var r []*irc.Message
+	if len(online) > 0 {
+		r = append(r, &irc.Message{
+			Prefix:   u.Srv.Prefix(),
+			Command:  "730", // RPL_MONONLINE
+			Params:   []string{u.Nick},
+			Trailing: strings.Join(online, ","),
+		})
+	}
+	if len(offline) > 0 {
+		r = append(r, &irc.Message{
+			Prefix:   u.Srv.Prefix(),
+			Command:  "731", // RPL_MONOFFLINE
+			Params:   []string{u.Nick},
+			Trailing: strings.Join(offline, ","),
+		})
+	}
+	return u.Encode(r...)
+}
+
 func (u *User) handleDirectMessageEvent(event *bridge.DirectMessageEvent) {
-	if u.v.GetBool(u.br.Protocol() + ".showmentions") {
+	if u.settingBool("showmentions") {
 		for _, m := range u.MentionKeys {
 			if m == u.Nick {
 				continue
@@ -126,6 +293,7 @@ func (u *User) handleDirectMessageEvent(event *bridge.DirectMessageEvent) {
 		prefixUser = event.Receiver.User
 	}
 	text, prefix, suffix, showContext, maxlen := u.handleMessageThreadContext(prefixUser, event.MessageID, event.ParentID, event.Event, event.Text)
+	text = u.expandMessageRef(prefixUser, event.MessageID, text)
 
 	lexer := ""
 	codeBlockBackTick := false
@@ -145,6 +313,11 @@ func (u *User) handleDirectMessageEvent(event *bridge.DirectMessageEvent) {
 			text = prefix + text + suffix
 		}
 
+		if event.Event == "webxdc" {
+			u.webxdcNotice(event.Receiver.Nick + ": " + text)
+			continue
+		}
+
 		if event.Sender.Me {
 			if event.Receiver.Me {
 				u.MsgSpoofUser(u, u.Nick, text, len(text))
@@ -157,6 +330,21 @@ func (u *User) handleDirectMessageEvent(event *bridge.DirectMessageEvent) {
 	}
 }
 
+// webxdcNotice sends a webxdc update of a direct chat as a notice from the
+// service, as the sender of updates isn't known.
+func (u *User) webxdcNotice(text string) {
+	svc, ok := u.Srv.HasUser(u.br.Protocol())
+	if !ok {
+		return
+	}
+	u.Encode(&irc.Message{ //nolint:errcheck
+		Prefix:   svc.Prefix(),
+		Command:  irc.NOTICE,
+		Params:   []string{u.Nick},
+		Trailing: text,
+	})
+}
+
 func (u *User) handleChannelAddEvent(event *bridge.ChannelAddEvent) {
 	ch := u.Srv.Channel(event.ChannelID)
 
@@ -232,12 +420,18 @@ func (u *User) handleChannelMessageEvent(event *bridge.ChannelMessageEvent) {
 	if event.Sender.Me {
 		nick = u.Nick
 	}
+	// webxdc updates don't tell their sender
+	if event.Event == "webxdc" {
+		if svc, ok := u.Srv.HasUser(u.br.Protocol()); ok {
+			nick = svc.Nick
+		}
+	}
 
 	if event.ChannelType != "D" && ch.ID() == "&messages" {
 		nick += "/" + u.Srv.Channel(event.ChannelID).String()
 	}
 
-	if u.v.GetBool(u.br.Protocol() + ".showmentions") {
+	if u.settingBool("showmentions") {
 		for _, m := range u.MentionKeys {
 			if m == u.Nick {
 				continue
@@ -257,6 +451,7 @@ func (u *User) handleChannelMessageEvent(event *bridge.ChannelMessageEvent) {
 	if u.Nick != systemUser {
 		text, prefix, suffix, showContext, maxlen = u.handleMessageThreadContext(event.ChannelID, event.MessageID, event.ParentID, event.Event, event.Text)
 	}
+	text = u.expandMessageRef(event.ChannelID, event.MessageID, text)
 
 	lexer := ""
 	codeBlockBackTick := false
@@ -320,18 +515,15 @@ func (u *User) handleChannelCreateEvent(event *bridge.ChannelCreateEvent) {
 }
 
 func (u *User) handleChannelDeleteEvent(event *bridge.ChannelDeleteEvent) {
-	ch := u.Srv.Channel(event.ChannelID)
-
-	for _, brchannel := range u.br.GetChannels() {
-		if brchannel.ID == event.ChannelID {
-			logger.Debugf("ACTION_CHANNEL_DELETED removing myself from %s (%s)", u.br.GetChannelName(event.ChannelID), event.ChannelID)
+	ch, ok := u.Srv.HasChannel(event.ChannelID)
+	if ok && ch.HasUser(u) {
+		logger.Debugf("ACTION_CHANNEL_DELETED removing myself from %s (%s)", ch.String(), event.ChannelID)
 
-			ch.Part(u, "")
-			return
-		}
+		ch.Part(u, "")
+		return
 	}
 
-	logger.Debugf("ACTION_CHANNEL_DELETED not in channel %s (%s)", u.br.GetChannelName(event.ChannelID), event.ChannelID)
+	logger.Debugf("ACTION_CHANNEL_DELETED not in channel %s", event.ChannelID)
 }
 
 func (u *User) handleUserUpdateEvent(event *bridge.UserUpdateEvent) {
@@ -339,6 +531,11 @@ func (u *User) handleUserUpdateEvent(event *bridge.UserUpdateEvent) {
 }
 
 func (u *User) handleStatusChangeEvent(event *bridge.StatusChangeEvent) {
+	if ghost, ok := u.Srv.HasUserID(event.UserID); ok && ghost.Ghost {
+		u.handleGhostStatusChange(ghost, event.Status)
+		return
+	}
+
 	if event.UserID == u.br.GetMe().User {
 		switch event.Status {
 		case "online":
@@ -369,7 +566,7 @@ func (u *User) handleReactionEvent(event *bridge.ReactionAddEvent) {
 	channelType := event.ChannelType
 	reaction := event.Reaction
 
-	if u.v.GetBool(u.br.Protocol() + ".hidereactions") {
+	if u.settingBool("hidereactions") {
 		logger.Debug("Not showing reaction: " + text + reaction)
 		return
 	}
@@ -425,6 +622,10 @@ func (u *User) CreateUsersFromInfo(info []*bridge.UserInfo) []*User {
 }
 
 func (u *User) updateUserFromInfo(info *bridge.UserInfo) *User {
+	// the bridge may keep info, don't change its nick
+	i := *info
+	i.Nick = sanitizeNick(i.Nick)
+	info = &i
 	if ghost, ok := u.Srv.HasUserID(info.User); ok {
 		if ghost.Nick != info.Nick {
 			changeMsg := &irc.Message{
@@ -453,9 +654,10 @@ func (u *User) createUserFromInfo(info *bridge.UserInfo) *User {
 		return ghost
 	}
 
+	i := *info
+	i.Nick = sanitizeNick(i.Nick)
 	ghost := NewUser(u.Conn)
-	ghost.UserInfo = info
-	ghost.Nick = sanitizeNick(ghost.Nick)
+	ghost.UserInfo = &i
 
 	u.Srv.Add(ghost)
 
@@ -479,6 +681,8 @@ func (u *User) onConnect() {
 
 	srv := u.Srv
 
+	u.loadSettings()
+
 	// set self-nick to account nick
 	srv.RenameUser(u, u.br.GetMe().Nick)
 
@@ -502,7 +706,7 @@ func (u *User) onConnect() {
 	ch.Join(u)
 
 	// only join chats on startup when specified
-	if u.v.GetBool(u.br.Protocol() + ".skipjoinonstart") {
+	if u.settingBool("skipjoinonstart") {
 		logger.Debug("Skipping joining channels")
 	} else {
 		for _, brchannel := range u.br.GetChannels() {
@@ -594,9 +798,9 @@ func (u *User) syncChannel(id string, name string) {
 func (u *User) mayJoin(channelID string) bool {
 	ch := u.Srv.Channel(channelID)
 
-	jo := u.v.GetStringSlice(u.br.Protocol() + ".joinonly")
-	ji := u.v.GetStringSlice(u.br.Protocol() + ".joininclude")
-	je := u.v.GetStringSlice(u.br.Protocol() + ".joinexclude")
+	jo := u.settingList("joinonly")
+	ji := u.settingList("joininclude")
+	je := u.settingList("joinexclude")
 
 	switch {
 	// if we have joinonly channels specified we are only allowed to join those
@@ -631,13 +835,13 @@ func (u *User) mayJoin(channelID string) bool {
 }
 
 func (u *User) isValidServer(server, protocol string) bool {
-	if len(u.v.GetStringSlice(protocol+".restrict")) == 0 {
+	if len(u.v().GetStringSlice(protocol+".restrict")) == 0 {
 		return true
 	}
 
-	logger.Debugf("restrict: %s", u.v.GetStringSlice(protocol+".restrict"))
+	logger.Debugf("restrict: %s", u.v().GetStringSlice(protocol+".restrict"))
 
-	for _, srv := range u.v.GetStringSlice(protocol + ".restrict") {
+	for _, srv := range u.v().GetStringSlice(protocol + ".restrict") {
 		if srv == server {
 			return true
 		}
@@ -651,8 +855,8 @@ func (u *User) loginTo(protocol string) error {
 
 	switch protocol {
 	case "deltachat":
-		u.eventChan = make(chan *bridge.Event)
-		u.br, err = deltachat.New(u.v, u.Credentials, u.eventChan, u.onConnect)
+		u.eventChan = make(chan *bridge.Event, 1000)
+		u.br, err = deltachat.New(u.cfg, u.Credentials, u.eventChan, u.onConnect)
 	}
 	if err != nil {
 		return err
@@ -668,6 +872,12 @@ func (u *User) loginTo(protocol string) error {
 	u.User = info.User
 	u.MentionKeys = info.MentionKeys
 
+	if details, err := u.br.GetUserDetails(info.User); err == nil {
+		u.Lock()
+		u.account = details.Address
+		u.Unlock()
+	}
+
 	return nil
 }
 
@@ -675,6 +885,9 @@ func (u *User) loginTo(protocol string) error {
 func (u *User) logoutFrom(protocol string) error {
 	logger.Debug("logging out from", protocol)
 
+	u.Lock()
+	u.account = ""
+	u.Unlock()
 	u.Srv.Logout(u)
 	return nil
 }
@@ -693,9 +906,9 @@ func (u *User) increaseMsgCounter(channelID string) int {
 func (u *User) formatContextMessage(ts, threadMsgID, msg string) string {
 	var formattedMsg string
 	switch {
-	case u.v.GetBool(u.br.Protocol() + ".prefixcontext"):
+	case u.settingBool("prefixcontext"):
 		formattedMsg = threadMsgID + " " + msg
-	case u.v.GetBool(u.br.Protocol() + ".suffixcontext"):
+	case u.settingBool("suffixcontext"):
 		formattedMsg = msg + " " + threadMsgID
 	}
 	if ts != "" {
@@ -727,7 +940,7 @@ func (u *User) prefixContext(channelID, messageID, parentID, event string) strin
 	u.msgMapMutex.Lock()
 	defer u.msgMapMutex.Unlock()
 
-	if event == "post_edited" || event == "post_deleted" || event == "reaction" {
+	if event == "post_edited" || event == "post_deleted" || event == "reaction" || event == "webxdc" {
 		return u.prefixContextModified(channelID, messageID)
 	}
 
@@ -764,6 +977,62 @@ func (u *User) prefixContext(channelID, messageID, parentID, event string) strin
 	return fmt.Sprintf("[%03x]", currentcount)
 }
 
+// messageContextID returns the context ID of messageID in channelID, assigning
+// a new one if the message was not shown before.
+func (u *User) messageContextID(channelID, messageID string) string {
+	u.msgMapMutex.Lock()
+	defer u.msgMapMutex.Unlock()
+
+	if _, ok := u.msgMap[channelID]; !ok {
+		u.msgMap[channelID] = make(map[string]int)
+	}
+
+	count, ok := u.msgMap[channelID][messageID]
+	if !ok {
+		count = u.increaseMsgCounter(channelID)
+		u.msgMap[channelID][messageID] = count
+	}
+
+	return fmt.Sprintf("%03x", count)
+}
+
+// expandMessageRef replaces bridge.MessageRef in the text of a message by its
+// context ID, after handleMessageThreadContext gave the message one.
+func (u *User) expandMessageRef(channelID, messageID, text string) string {
+	if !strings.Contains(text, bridge.MessageRef) {
+		return text
+	}
+	return strings.ReplaceAll(text, bridge.MessageRef, u.messageContextID(channelID, messageID))
+}
+
+// contextMessageID returns the message a context ID refers to in a channel or
+// in the direct chat with a nick.
+func (u *User) contextMessageID(target, contextID string) (string, error) {
+	id, err := strconv.ParseUint(strings.Trim(contextID, "[]"), 16, 0)
+	if err != nil {
+		return "", fmt.Errorf("invalid message id %s", contextID)
+	}
+
+	var key string
+	if strings.HasPrefix(target, "#") {
+		key = u.br.GetChannelID(strings.TrimPrefix(target, "#"), u.br.GetMe().TeamID)
+	} else if user, ok := u.Srv.HasUser(target); ok {
+		key = user.User
+	}
+	if key == "" {
+		return "", fmt.Errorf("no such channel or nick %s", target)
+	}
+
+	u.msgMapMutex.RLock()
+	defer u.msgMapMutex.RUnlock()
+	for msgID, count := range u.msgMap[key] {
+		if count == int(id) {
+			return msgID, nil
+		}
+	}
+	return "", fmt.Errorf("unknown message id %s in %s", contextID, target)
+}
+
 func (u *User) handleMessageThreadContext(channelID, messageID, parentID, event, text string) (string, string, string, bool, int) {
 	newText := text
 	prefix := ""
@@ -772,28 +1041,28 @@ func (u *User) handleMessageThreadContext(channelID, messageID, parentID, event,
 	showContext := false
 
 	switch {
-	case u.v.GetBool(u.br.Protocol()+".prefixcontext") && strings.HasPrefix(text, "\x01"):
+	case u.settingBool("prefixcontext") && strings.HasPrefix(text, "\x01"):
 		prefix = u.prefixContext(channelID, messageID, parentID, event) + " "
 		newText = strings.Replace(text, "\x01ACTION ", "\x01ACTION "+prefix, 1)
 		maxlen = len(newText)
-	case u.v.GetBool(u.br.Protocol()+".prefixcontext") && u.v.GetBool(u.br.Protocol()+".showcontextmulti"):
+	case u.settingBool("prefixcontext") && u.settingBool("showcontextmulti"):
 		prefix = u.prefixContext(channelID, messageID, parentID, event) + " "
 		newText = text
 		showContext = true
 		maxlen -= len(prefix)
-	case u.v.GetBool(u.br.Protocol() + ".prefixcontext"):
+	case u.settingBool("prefixcontext"):
 		prefix = u.prefixContext(channelID, messageID, parentID, event) + " "
 		newText = prefix + text
-	case u.v.GetBool(u.br.Protocol()+".suffixcontext") && strings.HasSuffix(text, "\x01"):
+	case u.settingBool("suffixcontext") && strings.HasSuffix(text, "\x01"):
 		suffix = " " + u.prefixContext(channelID, messageID, parentID, event)
 		newText = strings.Replace(text, " \x01", suffix+" \x01", 1)
 		maxlen = len(newText)
-	case u.v.GetBool(u.br.Protocol()+".suffixcontext") && u.v.GetBool(u.br.Protocol()+".showcontextmulti"):
+	case u.settingBool("suffixcontext") && u.settingBool("showcontextmulti"):
 		suffix = " " + u.prefixContext(channelID, messageID, parentID, event)
 		newText = text
 		showContext = true
 		maxlen -= len(suffix)
-	case u.v.GetBool(u.br.Protocol() + ".suffixcontext"):
+	case u.settingBool("suffixcontext"):
 		suffix = " " + u.prefixContext(channelID, messageID, parentID, event)
 		newText = strings.TrimRight(text, "\n") + suffix
 	}
@@ -811,7 +1080,7 @@ func (u *User) formatCodeBlockText(text string, prefix string, codeBlockBackTick
 		return "", codeBlockBackTick, codeBlockTilde, lexer
 	}
 
-	syntaxHighlighting := u.v.GetString(u.br.Protocol() + ".syntaxhighlighting")
+	syntaxHighlighting := u.settingString("syntaxhighlighting")
 
 	if (strings.HasPrefix(text, "```") || strings.HasPrefix(text, prefix+"```")) && !codeBlockTilde {
 		codeBlockBackTick = !codeBlockBackTick
@@ -0,0 +1,128 @@
+package irckit
+
+import (
+	"testing"
+
+	"github.com/deltachat/deltaircd/bridge"
+	"github.com/deltachat/deltaircd/config"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageRef(t *testing.T) {
+	u := NewUser(&recordConn{})
+	u.cfg = config.NewConfig(viper.New())
+	u.br = &settingsBridge{}
+	u.msgMap = make(map[string]map[string]int)
+	u.msgCounter = make(map[string]int)
+	u.Srv = NewServer("test")
+	bob := NewUser(nil)
+	bob.Nick, bob.User = "bob", "7"
+	u.Srv.Add(bob)
+
+	// the context ID of a message is kept once it was assigned
+	u.v().Set("deltachat.prefixcontext", true)
+	text, _, _, _, _ := u.handleMessageThreadContext("7", "100", "", "", "hi")
+	text = u.expandMessageRef("7", "100", text+" [full message: html "+bridge.MessageRef+"]")
+	assert.Equal(t, "[001] hi [full message: html 001]", text)
+
+	text = u.expandMessageRef("7", "101", "[webxdc "+bridge.MessageRef+"] Poll")
+	assert.Equal(t, "[webxdc 002] Poll", text)
+
+	msgID, err := u.contextMessageID("bob", "001")
+	require.NoError(t, err)
+	assert.Equal(t, "100", msgID)
+	msgID, err = u.contextMessageID("bob", "[002]")
+	require.NoError(t, err)
+	assert.Equal(t, "101", msgID)
+
+	_, err = u.contextMessageID("bob", "003")
+	assert.Error(t, err)
+	_, err = u.contextMessageID("alice", "001")
+	assert.Error(t, err)
+	_, err = u.contextMessageID("bob", "xyz")
+	assert.Error(t, err)
+}
+
+// deletedBridge reports the messages not in exists as deleted.
+type deletedBridge struct {
+	bridge.Bridger
+	exists  map[string]bool
+	checked []string
+}
+
+func (b *deletedBridge) DeletedMessages(channelID string, msgIDs []string) ([]string, error) {
+	b.checked = msgIDs
+	var deleted []string
+	for _, id := range msgIDs {
+		if !b.exists[id] {
+			deleted = append(deleted, id)
+		}
+	}
+	return deleted, nil
+}
+
+func TestMessagesDeleted(t *testing.T) {
+	br := &deletedBridge{exists: map[string]bool{"100": true}}
+	u := NewUser(&recordConn{})
+	u.br = br
+	u.msgMap = map[string]map[string]int{
+		"5": {"100": 1, "101": 2},
+		"6": {"200": 1},
+	}
+	u.msgLast = map[string][2]string{"5": {"101", ""}}
+
+	u.handleMessagesDeletedEvent(&bridge.MessagesDeletedEvent{ChannelID: "5"})
+	assert.ElementsMatch(t, []string{"100", "101"}, br.checked)
+	assert.Equal(t, map[string]int{"100": 1}, u.msgMap["5"])
+	assert.Equal(t, map[string]int{"200": 1}, u.msgMap["6"])
+	assert.NotContains(t, u.msgLast, "5")
+
+	// chats without known messages don't need a check
+	br.checked = nil
+	u.handleMessagesDeletedEvent(&bridge.MessagesDeletedEvent{ChannelID: "7"})
+	assert.Nil(t, br.checked)
+}
+
+func TestUserFromInfoKeepsInfo(t *testing.T) {
+	u := NewUser(&recordConn{})
+	u.Srv = NewServer("test")
+
+	info := &bridge.UserInfo{User: "7", Nick: "bob smith"}
+	ghost := u.createUserFromInfo(info)
+	assert.Equal(t, "bob-smith", ghost.Nick)
+	assert.Equal(t, "bob smith", info.Nick)
+
+	info = &bridge.UserInfo{User: "7", Nick: "bob jones"}
+	ghost = u.updateUserFromInfo(info)
+	assert.Equal(t, "bob-jones", ghost.Nick)
+	assert.Equal(t, "bob jones", info.Nick)
+}
+
+func TestWebxdcNotice(t *testing.T) {
+	conn := &recordConn{}
+	u := NewUser(conn)
+	u.Nick = "me"
+	u.cfg = config.NewConfig(viper.New())
+	u.v().Set("deltachat.prefixcontext", true)
+	u.br = &settingsBridge{}
+	u.msgMap = make(map[string]map[string]int)
+	u.msgCounter = make(map[string]int)
+	u.Srv = NewServer("test")
+	u.createService("deltachat", "loginservice")
+
+	// updates in direct chats come from the service, not from the contact
+	u.handleDirectMessageEvent(&bridge.DirectMessageEvent{
+		Text:      "webxdc update: Bob voted",
+		Sender:    &bridge.UserInfo{User: "1", Nick: "me", Me: true},
+		Receiver:  &bridge.UserInfo{User: "7", Nick: "bob"},
+		MessageID: "100",
+		ParentID:  "100",
+		Event:     "webxdc",
+	})
+	require.Len(t, conn.msgs, 1)
+	assert.Equal(t, "NOTICE", conn.msgs[0].Command)
+	assert.Equal(t, "deltachat", conn.msgs[0].Prefix.Name)
+	assert.Equal(t, "bob: [001] webxdc update: Bob voted", conn.msgs[0].Trailing)
+}
@@ -1,13 +1,19 @@
 package irckit
 
 import (
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
 func stringInRegexp(a string, list []string) bool {
 	for _, entry := range list {
-		re := regexp.MustCompile(entry)
+		re, err := regexp.Compile(entry)
+		if err != nil {
+			logger.Errorf("ignoring invalid regexp %q: %v", entry, err)
+			continue
+		}
 		if re.MatchString(a) {
 			return true
 		}
@@ -16,6 +22,15 @@ func stringInRegexp(a string, list []string) bool {
 	return false
 }
 
+func stringInSlice(a string, list []string) bool {
+	for _, b := range list {
+		if b == a {
+			return true
+		}
+	}
+	return false
+}
+
 func removeStringInSlice(a string, list []string) []string {
 	newlist := []string{}
 	for _, b := range list {
@@ -36,3 +51,45 @@ func sanitizeNick(nick string) string {
 	}
 	return strings.Map(sanitize, nick)
 }
+
+var durationUnits = []struct {
+	suffix  string
+	seconds uint
+}{
+	{"w", 7 * 24 * 60 * 60},
+	{"d", 24 * 60 * 60},
+	{"h", 60 * 60},
+	{"m", 60},
+	{"s", 1},
+}
+
+// formatDuration returns the seconds in the largest unit that fits exactly,
+// e.g. "1w", "36h" or "90s".
+func formatDuration(seconds uint) string {
+	for _, unit := range durationUnits {
+		if seconds%unit.seconds == 0 {
+			return strconv.FormatUint(uint64(seconds/unit.seconds), 10) + unit.suffix
+		}
+	}
+	return strconv.FormatUint(uint64(seconds), 10) + "s"
+}
+
+// parseDuration parses durations like "30", "30s", "5m", "1h", "1d" or "1w"
+// and returns the seconds.
+func parseDuration(text string) (uint, error) {
+	orig := text
+	text = strings.ToLower(strings.TrimSpace(text))
+	multiplier := uint(1)
+	for _, unit := range durationUnits {
+		if strings.HasSuffix(text, unit.suffix) {
+			text = strings.TrimSuffix(text, unit.suffix)
+			multiplier = unit.seconds
+			break
+		}
+	}
+	value, err := strconv.ParseUint(text, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", orig)
+	}
+	return uint(value) * multiplier, nil
+}
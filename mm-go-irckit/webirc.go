@@ -0,0 +1,127 @@
+package irckit
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// webircGateway is a [[webirc]] of the config, a web IRC gateway that may set
+// the address of its clients.
+type webircGateway struct {
+	Name     string   // the gateway name it sends, any if empty
+	Password string   // sent as first WEBIRC parameter
+	Hosts    []string // IPs or CIDRs the gateway connects from, any if empty
+}
+
+// remoteAddr is the client address set by WEBIRC.
+type remoteAddr struct {
+	ip net.IP
+}
+
+func (a *remoteAddr) Network() string { return "webirc" }
+func (a *remoteAddr) String() string  { return a.ip.String() }
+
+// RemoteAddr returns the address of the client, the one sent by a WEBIRC
+// gateway or else of the connection.
+func (u *User) RemoteAddr() net.Addr {
+	u.RLock()
+	addr := u.remoteAddr
+	u.RUnlock()
+	if addr != nil {
+		return addr
+	}
+	if u.Conn == nil {
+		return nil
+	}
+	return u.Conn.RemoteAddr()
+}
+
+// webirc handles "WEBIRC <password> <gateway> <hostname> <ip> [:<flags>]"
+// during the handshake: a configured gateway sets the client address and
+// hostname.
+func (s *server) webirc(u *User, msg *irc.Message) error {
+	params := msg.Params
+	if len(params) == 3 && msg.Trailing != "" {
+		params = append(params, msg.Trailing)
+	}
+	if len(params) < 4 {
+		return fmt.Errorf("not enough parameters")
+	}
+	password, gateway, hostname := params[0], params[1], params[2]
+	ip := net.ParseIP(params[3])
+	if ip == nil {
+		return fmt.Errorf("invalid IP %q", params[3])
+	}
+
+	var gateways []webircGateway
+	if err := u.v().UnmarshalKey("webirc", &gateways); err != nil {
+		return err
+	}
+	from := connIP(u.Conn.RemoteAddr())
+	for _, gw := range gateways {
+		if gw.Name != "" && gw.Name != gateway {
+			continue
+		}
+		if gw.Password == "" || subtle.ConstantTimeCompare([]byte(gw.Password), []byte(password)) != 1 {
+			continue
+		}
+		if !matchHosts(from, gw.Hosts) {
+			continue
+		}
+
+		u.Lock()
+		u.remoteAddr = &remoteAddr{ip: ip}
+		u.Unlock()
+		u.Host = webircHost(hostname, ip)
+		logger.Infof("WEBIRC from %s (%s): client %s (%s)", from, gateway, ip, u.Host)
+		return nil
+	}
+	return fmt.Errorf("no matching gateway for %s from %s", gateway, from)
+}
+
+func connIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *remoteAddr:
+		return addr.ip
+	}
+	return nil
+}
+
+// matchHosts reports whether ip is one of the IPs or in one of the CIDRs, an
+// empty list matches everything including unix sockets.
+func matchHosts(ip net.IP, hosts []string) bool {
+	if len(hosts) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, host := range hosts {
+		if _, network, err := net.ParseCIDR(host); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(host)) {
+			return true
+		}
+	}
+	return false
+}
+
+// webircHost returns the hostname of the gateway, or the IP if it isn't a
+// usable hostname. An IPv6 address can't start with a colon in a prefix.
+func webircHost(hostname string, ip net.IP) string {
+	if hostname == "" || strings.ContainsAny(hostname, " !@*?:") {
+		hostname = ip.String()
+	}
+	if strings.HasPrefix(hostname, ":") {
+		hostname = "0" + hostname
+	}
+	return hostname
+}
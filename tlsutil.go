@@ -1,12 +1,25 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
-	"log"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
 	"os"
-	"os/signal"
+	"path/filepath"
+	"runtime"
 	"sync"
-	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
 )
 
 type keypairReloader struct {
@@ -14,6 +27,7 @@ type keypairReloader struct {
 	cert     *tls.Certificate
 	certPath string
 	keyPath  string
+	watcher  *fsnotify.Watcher
 }
 
 // nolint:golint
@@ -27,27 +41,31 @@ func NewKeypairReloader(certPath, keyPath string) (*keypairReloader, error) {
 		return nil, err
 	}
 	result.cert = &cert
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGHUP)
-		for range c {
-			log.Printf("Received SIGHUP, reloading TLS certificate and key from %q and %q", certPath, keyPath)
-			if err := result.maybeReload(); err != nil {
-				log.Printf("Keeping old TLS certificate because the new one could not be loaded: %v", err)
-			}
-		}
-	}()
 	return result, nil
 }
 
 func (kpr *keypairReloader) maybeReload() error {
-	newCert, err := tls.LoadX509KeyPair(kpr.certPath, kpr.keyPath)
+	kpr.certMu.RLock()
+	certPath, keyPath := kpr.certPath, kpr.keyPath
+	kpr.certMu.RUnlock()
+	return kpr.setPaths(certPath, keyPath)
+}
+
+// setPaths loads the certificate and key from new files, the old ones are
+// kept if that fails.
+func (kpr *keypairReloader) setPaths(certPath, keyPath string) error {
+	newCert, err := tls.LoadX509KeyPair(certPath, keyPath)
 	if err != nil {
 		return err
 	}
 	kpr.certMu.Lock()
 	defer kpr.certMu.Unlock()
 	kpr.cert = &newCert
+	kpr.certPath = certPath
+	kpr.keyPath = keyPath
+	if kpr.watcher != nil {
+		kpr.watchDirs()
+	}
 	return nil
 }
 
@@ -58,3 +76,145 @@ func (kpr *keypairReloader) GetCertificateFunc() func(*tls.ClientHelloInfo) (*tl
 		return kpr.cert, nil
 	}
 }
+
+// watch reloads the certificate when its files change, e.g. after a renewal.
+// Both files are usually replaced, the reload waits until the changes
+// stopped for a second.
+func (kpr *keypairReloader) watch() error {
+	if runtime.GOOS == "illumos" {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	kpr.certMu.Lock()
+	kpr.watcher = watcher
+	kpr.watchDirs()
+	kpr.certMu.Unlock()
+
+	go func() {
+		defer watcher.Close()
+		var reload *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !kpr.isKeypairFile(event.Name) || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				if reload != nil {
+					reload.Stop()
+				}
+				reload = time.AfterFunc(time.Second, func() {
+					if err := kpr.maybeReload(); err != nil {
+						logger.Errorf("Keeping old TLS certificate because the new one could not be loaded: %v", err)
+						return
+					}
+					logger.Info("TLS certificate reloaded")
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Errorf("TLS certificate watcher error: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// watchDirs watches the directories of the files, they are often replaced.
+// certMu must be held.
+func (kpr *keypairReloader) watchDirs() {
+	for _, path := range []string{kpr.certPath, kpr.keyPath} {
+		if err := kpr.watcher.Add(filepath.Dir(path)); err != nil {
+			logger.Errorf("Can not watch %s for changes: %v", path, err)
+		}
+	}
+}
+
+func (kpr *keypairReloader) isKeypairFile(name string) bool {
+	kpr.certMu.RLock()
+	defer kpr.certMu.RUnlock()
+	name = filepath.Clean(name)
+	return name == filepath.Clean(kpr.certPath) || name == filepath.Clean(kpr.keyPath)
+}
+
+// selfSignedValidity is how long a generated certificate is valid, it isn't
+// renewed.
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+// generateSelfSigned creates a self-signed certificate for the hostname and
+// localhost if the certificate and key don't exist yet. It returns the
+// SHA-256 fingerprint of a new certificate, clients can pin it.
+func generateSelfSigned(certPath, keyPath string) (string, error) {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if certErr == nil || keyErr == nil {
+		if certErr == nil && keyErr == nil {
+			return "", nil
+		}
+		return "", errors.New("only one of the certificate and key exists")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", err
+	}
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hostname, Organization: []string{"deltaircd"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{hostname, "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	if err := writePEM(keyPath, "EC PRIVATE KEY", keyDER, 0o600); err != nil {
+		return "", err
+	}
+	if err := writePEM(certPath, "CERTIFICATE", der, 0o644); err != nil {
+		os.Remove(keyPath)
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func writePEM(path, blockType string, der []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(file, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}